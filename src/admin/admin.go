@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/protocol"
+	"distributed-systems-message-queue/src/security"
+)
+
+// Function to send a command to the admin port of the broker and get its result.
+// TLS settings and credentials are read from the same environment variables as clients use.
+func runCommand(port, command string) (string, error) {
+	settings, err := security.TLSSettingsFromEnv()
+	if err != nil {
+		return "", err
+	}
+
+	tlsConfig, err := settings.ClientConfig()
+	if err != nil {
+		return "", err
+	}
+
+	identity, err := settings.Identity()
+	if err != nil {
+		return "", err
+	}
+	if identity == "" {
+		identity = "admin-" + strconv.Itoa(os.Getpid())
+	}
+
+	netConn, err := security.Dial(":"+port, tlsConfig)
+	if err != nil {
+		return "", err
+	}
+
+	conn := protocol.NewConn(netConn)
+	defer conn.Close()
+
+	credentials := auth.CredentialsFromEnv()
+	hello := protocol.Frame{ClientID: identity, Role: protocol.RoleAdmin, Capabilities: protocol.Capabilities}
+	hello.Username, hello.Password, hello.Token = credentials.Username, credentials.Password, credentials.Token
+
+	_, err = conn.Handshake(hello, 0)
+	if err != nil {
+		return "", err
+	}
+
+	err = conn.WriteFrame(protocol.Frame{Type: protocol.CommandFrame, ID: "1", Body: command})
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			return "", err
+		}
+
+		switch frame.Type {
+		case protocol.ResultFrame:
+			return frame.Body, nil
+		case protocol.ErrorFrame:
+			return "", errors.New("error: " + frame.Reason)
+		}
+	}
+}
+
+// Function to handle error.
+// If there is an error it will be logged.
+func handleError(err error) {
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Function to check number of command line arguments.
+func checkCommandLineArguments() error {
+	arguments := os.Args
+
+	if len(arguments) < 3 {
+		return errors.New(`error: too few arguments. please provide <Port> <Command>`)
+	} else if len(arguments) > 3 {
+		return errors.New(`error: too many arguments. please provide <Port> <Command>`)
+	}
+
+	return nil
+}
+
+func main() {
+	err := checkCommandLineArguments()
+
+	handleError(err)
+
+	result, err := runCommand(os.Args[1], os.Args[2])
+
+	handleError(err)
+
+	fmt.Println(result)
+}
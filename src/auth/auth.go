@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Actions a user can be permitted to do on a queue.
+const (
+	Publish = "publish"
+	Consume = "consume"
+	Admin   = "admin"
+)
+
+// Environment variables used to configure authentication. The broker reads the users file,
+// clients and servers read their credentials.
+const (
+	UsersFileEnv = "MQ_USERS_FILE"
+	UsernameEnv  = "MQ_USERNAME"
+	PasswordEnv  = "MQ_PASSWORD"
+	TokenEnv     = "MQ_TOKEN"
+)
+
+// Number of PBKDF2 iterations used for new password hashes.
+const passwordIterations = 100000
+
+// Error returned when credentials are wrong. It does not tell which part was wrong.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// A structure that represent actions permitted on queues whose name matches a pattern.
+// Patterns use shell glob syntax, for example "client-*" or "*".
+type Permission struct {
+	Queue   string   `json:"queue"`
+	Actions []string `json:"actions"`
+}
+
+// A structure that represent a user in the users file. Password and tokens are stored hashed.
+type User struct {
+	Username    string       `json:"username"`
+	Password    string       `json:"password,omitempty"`
+	Tokens      []string     `json:"tokens,omitempty"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// A structure that represent credentials a client sends in handshake.
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// Function to get credentials from environment variables.
+func CredentialsFromEnv() Credentials {
+	return Credentials{Username: os.Getenv(UsernameEnv), Password: os.Getenv(PasswordEnv), Token: os.Getenv(TokenEnv)}
+}
+
+// A structure that represent the users file.
+type usersFile struct {
+	Users []User `json:"users"`
+}
+
+// A structure that represent the users known to the broker.
+// Users can be replaced while the broker is running, so every check sees the latest permissions.
+type Users struct {
+	mutex sync.RWMutex
+	users map[string]User
+}
+
+// Function to load users from a JSON file.
+func LoadUsers(file string) (*Users, error) {
+	users := &Users{}
+	err := users.Load(file)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Function to load users from a JSON file and replace current users.
+// Current users are kept if the file is not valid.
+func (u *Users) Load(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var content usersFile
+	err = json.Unmarshal(data, &content)
+	if err != nil {
+		return errors.New("users file " + file + " is not valid: " + err.Error())
+	}
+
+	users := make(map[string]User)
+	for _, user := range content.Users {
+		if user.Username == "" {
+			return errors.New("users file " + file + " has a user without username")
+		}
+		if _, ok := users[user.Username]; ok {
+			return errors.New("users file " + file + " has user " + user.Username + " more than once")
+		}
+		for _, permission := range user.Permissions {
+			if _, err := path.Match(permission.Queue, ""); err != nil {
+				return errors.New("user " + user.Username + " has invalid queue pattern " + permission.Queue)
+			}
+			for _, action := range permission.Actions {
+				if action != Publish && action != Consume && action != Admin {
+					return errors.New("user " + user.Username + " has unknown action " + action)
+				}
+			}
+		}
+		users[user.Username] = user
+	}
+
+	u.mutex.Lock()
+	u.users = users
+	u.mutex.Unlock()
+
+	return nil
+}
+
+// Function to authenticate a user. A token is tried first, then username and password.
+// Without credentials, a user named after the identity in a verified certificate is used.
+// It returns the name of the authenticated user.
+func (u *Users) Authenticate(username, password, token, certificateIdentity string) (string, error) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	if token != "" {
+		hashed := HashToken(token)
+		for _, user := range u.users {
+			for _, other := range user.Tokens {
+				if subtle.ConstantTimeCompare([]byte(hashed), []byte(other)) == 1 {
+					return user.Username, nil
+				}
+			}
+		}
+		return "", ErrInvalidCredentials
+	}
+
+	if username != "" {
+		user, ok := u.users[username]
+		if !ok || user.Password == "" || !verifyPassword(user.Password, password) {
+			return "", ErrInvalidCredentials
+		}
+		return user.Username, nil
+	}
+
+	if certificateIdentity != "" {
+		if _, ok := u.users[certificateIdentity]; ok {
+			return certificateIdentity, nil
+		}
+		return "", errors.New("certificate " + certificateIdentity + " does not belong to a user")
+	}
+
+	return "", errors.New("authentication is required")
+}
+
+// Function to check whether a user is permitted to do an action on a queue.
+func (u *Users) Allowed(username, action, queue string) bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	user, ok := u.users[username]
+	if !ok {
+		return false
+	}
+
+	for _, permission := range user.Permissions {
+		if matched, _ := path.Match(permission.Queue, queue); !matched {
+			continue
+		}
+		for _, permitted := range permission.Actions {
+			if permitted == action {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Function to hash a password for the users file.
+// The result has the form pbkdf2-sha256$<iterations>$<salt>$<hash>.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	hash := pbkdf2([]byte(password), salt, passwordIterations)
+
+	return "pbkdf2-sha256$" + strconv.Itoa(passwordIterations) + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(hash), nil
+}
+
+// Function to hash a bearer token for the users file. Tokens are random, so a plain hash is enough.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256$" + hex.EncodeToString(sum[:])
+}
+
+// Function to check a password against a hash made by HashPassword.
+func verifyPassword(hashed, password string) bool {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iterations), expected) == 1
+}
+
+// Function to derive a key from a password with PBKDF2 using HMAC-SHA256.
+// Only one block is needed because the key has the size of the hash.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Function to check PBKDF2 with HMAC-SHA256 against known test vectors.
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		expects    string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"", "salt", 1, "f135c27993baf98773c5cdb40a5706ce6a345cde61b000a67858650cd6a324d7"},
+	}
+
+	for _, test := range tests {
+		key := hex.EncodeToString(pbkdf2([]byte(test.password), []byte(test.salt), test.iterations))
+		if key != test.expects {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, expected %s", test.password, test.salt, test.iterations, key, test.expects)
+		}
+	}
+}
+
+// Function to check passwords against hashes, including hashes that are not valid.
+func TestVerifyPassword(t *testing.T) {
+	hashed, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hashed   string
+		password string
+		expects  bool
+	}{
+		{"right password", hashed, "secret", true},
+		{"wrong password", hashed, "Secret", false},
+		{"empty password", hashed, "", false},
+		{"known hash", "pbkdf2-sha256$1$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", true},
+		{"other algorithm", "bcrypt$1$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{"missing part", "pbkdf2-sha256$1$c2FsdA", "password", false},
+		{"zero iterations", "pbkdf2-sha256$0$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{"salt is not base64", "pbkdf2-sha256$1$!!$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{"plain text", "secret", "secret", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := verifyPassword(test.hashed, test.password); ok != test.expects {
+				t.Errorf("verifyPassword = %v, expected %v", ok, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that permissions match queues with glob patterns and only for their actions.
+func TestAllowed(t *testing.T) {
+	users := &Users{users: map[string]User{
+		"alice": {Username: "alice", Permissions: []Permission{
+			{Queue: "client-*", Actions: []string{Publish}},
+			{Queue: "jobs", Actions: []string{Publish, Consume}},
+		}},
+		"bob": {Username: "bob", Permissions: []Permission{
+			{Queue: "*", Actions: []string{Consume, Admin}},
+		}},
+		"carol": {Username: "carol", Permissions: []Permission{
+			{Queue: "queue-?", Actions: []string{Consume}},
+			{Queue: "[ab]-jobs", Actions: []string{Consume}},
+		}},
+	}}
+
+	tests := []struct {
+		username string
+		action   string
+		queue    string
+		expects  bool
+	}{
+		{"alice", Publish, "client-0", true},
+		{"alice", Publish, "client-", true},
+		{"alice", Consume, "client-0", false},
+		{"alice", Publish, "my-client-0", false},
+		{"alice", Consume, "jobs", true},
+		{"alice", Consume, "jobs-2", false},
+		{"bob", Consume, "anything", true},
+		{"bob", Admin, "*", true},
+		{"bob", Publish, "anything", false},
+		{"carol", Consume, "queue-1", true},
+		{"carol", Consume, "queue-10", false},
+		{"carol", Consume, "a-jobs", true},
+		{"carol", Consume, "c-jobs", false},
+		{"dave", Consume, "jobs", false},
+	}
+
+	for _, test := range tests {
+		if ok := users.Allowed(test.username, test.action, test.queue); ok != test.expects {
+			t.Errorf("Allowed(%s, %s, %s) = %v, expected %v", test.username, test.action, test.queue, ok, test.expects)
+		}
+	}
+}
+
+// Function to check that a token is tried first, then username and password, then the certificate.
+func TestAuthenticate(t *testing.T) {
+	hashed, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &Users{users: map[string]User{
+		"alice":     {Username: "alice", Password: hashed},
+		"bob":       {Username: "bob", Tokens: []string{HashToken("bob-token")}},
+		"worker-01": {Username: "worker-01"},
+	}}
+
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		token       string
+		certificate string
+		expects     string
+		fails       bool
+	}{
+		{"password", "alice", "secret", "", "", "alice", false},
+		{"wrong password", "alice", "wrong", "", "", "", true},
+		{"user without password", "bob", "", "", "", "", true},
+		{"unknown user", "mallory", "secret", "", "", "", true},
+		{"token", "", "", "bob-token", "", "bob", false},
+		{"token before username", "alice", "secret", "bob-token", "", "bob", false},
+		{"wrong token", "alice", "secret", "other-token", "", "", true},
+		{"certificate", "", "", "", "worker-01", "worker-01", false},
+		{"certificate of no user", "", "", "", "worker-02", "", true},
+		{"credentials before certificate", "alice", "secret", "", "worker-01", "alice", false},
+		{"no credentials", "", "", "", "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			username, err := users.Authenticate(test.username, test.password, test.token, test.certificate)
+			if (err != nil) != test.fails {
+				t.Fatalf("err = %v, expected to fail: %v", err, test.fails)
+			}
+			if username != test.expects {
+				t.Errorf("username = %q, expected %q", username, test.expects)
+			}
+		})
+	}
+}
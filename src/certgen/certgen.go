@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"distributed-systems-message-queue/src/security"
+)
+
+// Function to generate a test CA and certificates for local development.
+// The CA is created only if the directory does not contain one yet, so more
+// certificates can be added later with the same CA.
+func generateCertificates(directory string, names []string) error {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(directory, "ca.pem")); os.IsNotExist(err) {
+		err = security.GenerateCA(directory)
+		if err != nil {
+			return err
+		}
+		log.Println("LOG:", "generated CA in "+directory)
+	}
+
+	for _, name := range names {
+		err = security.GenerateCertificate(directory, name)
+		if err != nil {
+			return err
+		}
+		log.Println("LOG:", "generated certificate for "+name)
+	}
+
+	return nil
+}
+
+// Function to handle error.
+// If there is an error it will be logged.
+func handleError(err error) {
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Function to check number of command line arguments.
+func checkCommandLineArguments() error {
+	if len(os.Args) < 2 {
+		return errors.New(`error: too few arguments. please provide <Directory> [<Name> ...]`)
+	}
+
+	return nil
+}
+
+func main() {
+	err := checkCommandLineArguments()
+
+	handleError(err)
+
+	names := os.Args[2:]
+	if len(names) == 0 {
+		names = []string{"broker"}
+	}
+
+	err = generateCertificates(os.Args[1], names)
+
+	handleError(err)
+}
@@ -2,117 +2,119 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/producer"
+	"distributed-systems-message-queue/src/security"
 )
 
-// Function to handle client writing. It first creates a TCP client and establishes a connection.
-// It tryes to write message to broekr (TCP server).
-func handleWrite(port, name string) {
-	conn, _ := createTCPclient(port)
+const (
+	heartbeat_interval = 10 * time.Second
+	reconnect_delay    = 1 * time.Second
+	send_interval      = 3 * time.Second
+)
 
-	messageNumber := 0
-	for {
-		message := "request " + fmt.Sprint(messageNumber)
-		sendMessage(conn, message, name)
-		println(">> " + message)
-		messageNumber++
-	}
-}
+// Host of the broker, given with the ports as host:port. It is the local machine when it is empty.
+var brokerHost string
 
-// Function to handle client reading. It first creates a TCP client and establishes a connection.
-// Then starts receiving messages from broekr (TCP server).
-func handleRead(port string) {
-	conn, _ := createTCPclient(port)
+// TLS configuration of connections to broker. Connections use plain TCP when it is nil.
+var tlsConfig *tls.Config
 
-	for {
-		receiveMessage(conn)
-	}
-}
+// Credentials sent to broker in handshake.
+var credentials = auth.CredentialsFromEnv()
 
-// Function to handle network errors.
-func handleNetError(err error) {
-	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-		fmt.Println("read timeout:", err) // time out
-	} else {
-		fmt.Println("read error:", err) // some error else, do something else, for example create new conn
-	}
-}
-
-// Function to receive a message from a server with given connection.
-func receiveMessage(conn net.Conn) (string, error) {
-	// set SetReadDeadline
-	err := conn.SetReadDeadline(time.Now().Add(50 * time.Second))
-	if err != nil {
-		log.Println("ERROR:", "SetReadDeadline failed:", err)
-		// do something else, for example create new conn
-	}
+// Function to create a producer connected to broker with given client ID.
+func createProducer(ctx context.Context, readingPort, writingPort, name string) *producer.Producer {
+	p, err := producer.Connect(ctx, readingPort, writingPort,
+		producer.WithAddress(brokerHost),
+		producer.WithClientID(name),
+		producer.WithTLSConfig(tlsConfig),
+		producer.WithPassword(credentials.Username, credentials.Password),
+		producer.WithToken(credentials.Token),
+		producer.WithHeartbeat(heartbeat_interval),
+		producer.WithReconnectDelay(reconnect_delay),
+		producer.WithHandler(printMessage),
+		producer.WithErrorHandler(printError))
 
-	// recvBuf := make([]byte, 1024)
-	// _, err = conn.Read(recvBuf[:]) // recv data
-
-	message, err := bufio.NewReader(conn).ReadString('\n')
-	if err != nil {
-		handleNetError(err)
-	} else {
-		fmt.Print("-> " + string(message))
-	}
+	handleError(err)
 
-	return message, err
+	return p
 }
 
-// Function to send a message to a server with given message and connection.
-func sendMessage(conn net.Conn, message, name string) {
-	time.Sleep(3 * time.Second)
-	fmt.Fprintf(conn, "client "+name+" "+message+"\n")
+// Function to print a message received from broker.
+func printMessage(message producer.Message) {
+	fmt.Println("-> " + message.Body)
 }
 
-// Fucntion to create TCP client and establish connection.
-func createTCPclient(port string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", ":"+port)
-
-	handleError(err)
-
-	return conn, err
+// Function to print an error sent by broker.
+func printError(err error) {
+	fmt.Println("-> error: " + err.Error())
 }
 
-// Function to handle message passing asynchronously.
-func handleMessagePassingAsynchronously(readingPort, writingPort, name string) {
-	go handleRead(readingPort)
-
-	time.Sleep(1 * time.Second)
+// Function to wait before the next message is sent. It returns false if ctx is done first.
+func wait(ctx context.Context) bool {
+	select {
+	case <-time.After(send_interval):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	go handleWrite(writingPort, name)
+// Function to handle message passing asynchronously. Messages are sent without waiting for
+// the broker, and whether the broker accepted each message is printed once it is confirmed.
+// Replies are printed whenever they arrive.
+func handleMessagePassingAsynchronously(ctx context.Context, readingPort, writingPort, name string) {
+	p := createProducer(ctx, readingPort, writingPort, name)
+	defer p.Close()
 
-	for {
-		time.Sleep(10 * time.Second)
-		fmt.Println("doing something ...")
+	for messageNumber := 0; wait(ctx); messageNumber++ {
+		message := "request " + fmt.Sprint(messageNumber)
+		p.PublishAsync(message).OnDone(func(err error) {
+			if err != nil {
+				fmt.Println("-> error: " + err.Error())
+			} else {
+				fmt.Println("-> broker accepted " + message)
+			}
+		})
+		fmt.Println(">> " + message)
 	}
 }
 
-// Function to handle message passing synchronously.
-func handleMessagePassingSynchronously(readingPort, writingPort, name string) {
-	clientReadConn, _ := createTCPclient(readingPort)
-	time.Sleep(1 * time.Second)
-	clientWriteConn, _ := createTCPclient(writingPort)
+// Function to handle message passing synchronously. Every message waits for its reply
+// before the next one is sent.
+func handleMessagePassingSynchronously(ctx context.Context, readingPort, writingPort, name string) {
+	p := createProducer(ctx, readingPort, writingPort, name)
+	defer p.Close()
 
-	messageNumber := 0
-	for {
+	for messageNumber := 0; wait(ctx); messageNumber++ {
 		message := "request " + fmt.Sprint(messageNumber)
-		sendMessage(clientWriteConn, message, name)
-		println(">> " + message)
-		messageNumber++
-
-		receiveMessage(clientReadConn)
+		fmt.Println(">> " + message)
+
+		reply, err := p.Request(ctx, message)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Println("-> error: " + err.Error())
+			continue
+		}
+		fmt.Println("-> " + reply.Body)
 	}
 }
 
-// Function to get a custom name from standard input.
+// Function to get a custom name from standard input. The name is the client ID used in handshake.
 func getName() string {
 	fmt.Print("Enter a name: ")
 	name, _ := bufio.NewReader(os.Stdin).ReadString('\n')
@@ -120,37 +122,101 @@ func getName() string {
 	return strings.TrimSpace(name)
 }
 
-// Function to get client's reading and writing port numbers.
-func getPortNumbers() (string, string, error) {
+// Function to get client ID. A client with a certificate is identified by its certificate subject,
+// otherwise a custom name is read from standard input.
+func getClientID() (string, error) {
+	identity, err := loadIdentity()
+	if err != nil || identity != "" {
+		return identity, err
+	}
+
+	return getName(), nil
+}
+
+// Function to split an argument given as port or host:port into host and port.
+func splitAddress(argument string) (string, string, error) {
+	if !strings.Contains(argument, ":") {
+		return "", argument, nil
+	}
+
+	return net.SplitHostPort(argument)
+}
+
+// Function to get host of the broker and client's reading and writing port numbers.
+// Ports are given as port or host:port, both on the same host.
+func getPortNumbers() (string, string, string, error) {
 	arguments := os.Args
 
-	return arguments[2], arguments[3], nil
+	readingHost, readingPort, err := splitAddress(arguments[2])
+	if err != nil {
+		return "", "", "", err
+	}
+	writingHost, writingPort, err := splitAddress(arguments[3])
+	if err != nil {
+		return "", "", "", err
+	}
+	if readingHost != writingHost {
+		return "", "", "", fmt.Errorf("error: reading port is on %q and writing port on %q, both should be on the same host",
+			readingHost, writingHost)
+	}
+
+	return readingHost, readingPort, writingPort, nil
 }
 
-// Function to handle how program message passing work based on messaging passing mode that can be sync or async.
-func handleMessagePassing(messagePassingMode string) {
-	readingPort, writingPort, err := getPortNumbers()
-	name := getName()
+// Function to handle how program message passing work based on messaging passing mode that can be sync, async or publish.
+func handleMessagePassing(ctx context.Context, messagePassingMode string) {
+	host, readingPort, writingPort, err := getPortNumbers()
+
+	handleError(err)
+
+	brokerHost = host
+
+	if messagePassingMode == "publish" {
+		handlePublishing(ctx, readingPort, writingPort, os.Args[4:])
+		return
+	}
+
+	name, err := getClientID()
 
 	handleError(err)
 
 	switch messagePassingMode {
 	case "sync":
-		handleMessagePassingSynchronously(readingPort, writingPort, name)
+		handleMessagePassingSynchronously(ctx, readingPort, writingPort, name)
 	case "async":
-		handleMessagePassingAsynchronously(readingPort, writingPort, name)
+		handleMessagePassingAsynchronously(ctx, readingPort, writingPort, name)
 	default:
 		log.Println("ERROR:", "mode does not exist")
 	}
 }
 
-// Function to get messaging passing mode that can be sync or async.
+// Function to get messaging passing mode that can be sync, async or publish.
 func getMessagePassingMode() (string, error) {
 	arguments := os.Args
 
 	return arguments[1], nil
 }
 
+// Function to load TLS configuration for connections to broker from environment variables.
+func loadTLSConfig() (*tls.Config, error) {
+	settings, err := security.TLSSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return settings.ClientConfig()
+}
+
+// Function to load identity from the certificate configured in environment variables.
+func loadIdentity() (string, error) {
+	settings, err := security.TLSSettingsFromEnv()
+	if err != nil {
+		return "", err
+	}
+
+	return settings.Identity()
+}
+
 // Function to handle error.
 // If there is an error it will be logged.
 func handleError(err error) {
@@ -167,7 +233,7 @@ func checkCommandLineArguments() error {
 	if len(arguments) < 4 {
 		return errors.New(`error: too few arguments. please provide port
 		 numbers for reading and writing`)
-	} else if len(arguments) > 4 {
+	} else if len(arguments) > 4 && arguments[1] != "publish" {
 		fmt.Println()
 		return errors.New(`error: too many arguments. please provide 
 		port numbers for reading and writing`)
@@ -185,5 +251,12 @@ func main() {
 
 	handleError(err)
 
-	handleMessagePassing(messagePassingMode)
+	tlsConfig, err = loadTLSConfig()
+
+	handleError(err)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	handleMessagePassing(ctx, messagePassingMode)
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// Function to check that ports are given alone or with the host of the broker, both on the same host.
+func TestGetPortNumbers(t *testing.T) {
+	arguments := os.Args
+	defer func() { os.Args = arguments }()
+
+	tests := []struct {
+		reading, writing string
+		host             string
+		failed           bool
+	}{
+		{"8003", "8004", "", false},
+		{"broker.example:8003", "broker.example:8004", "broker.example", false},
+		{"[::1]:8003", "[::1]:8004", "::1", false},
+		{":8003", "8004", "", false},
+		{"broker.example:8003", "8004", "", true},
+		{"broker.example:8003", "other.example:8004", "", true},
+		{"::1:8003", "8004", "", true},
+	}
+
+	for _, test := range tests {
+		os.Args = []string{"client", "async", test.reading, test.writing}
+
+		host, readingPort, writingPort, err := getPortNumbers()
+		if test.failed {
+			if err == nil {
+				t.Errorf("%s and %s are accepted", test.reading, test.writing)
+			}
+			continue
+		}
+		if err != nil || host != test.host || readingPort != "8003" || writingPort != "8004" {
+			t.Errorf("%s and %s give host %q, ports %s and %s, error %v", test.reading, test.writing,
+				host, readingPort, writingPort, err)
+		}
+	}
+}
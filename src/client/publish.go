@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/producer"
+)
+
+// A flag value that collects headers given as name=value, one per flag.
+type headers map[string]string
+
+// Function to describe headers given as flags.
+func (h headers) String() string {
+	pairs := make([]string, 0, len(h))
+	for name, value := range h {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Function to add a header given as name=value.
+func (h headers) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return errors.New("header should be name=value, not " + value)
+	}
+	h[value[:i]] = value[i+1:]
+	return nil
+}
+
+// A structure that represent a step of a scenario script. The body is published count times,
+// 1 by default, waiting delay before each message. "{n}" in the body is replaced by the number
+// of the message in the step, starting at 0. A step with a queue is published to that queue in
+// a transaction, as only transactions can name a queue. A request step waits for the reply of
+// the server and only sends the body.
+type step struct {
+	Queue   string            `json:"queue,omitempty"`
+	Key     string            `json:"key,omitempty"`
+	DedupID string            `json:"dedup_id,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+	Count   int               `json:"count,omitempty"`
+	Delay   config.Duration   `json:"delay,omitempty"`
+	Request bool              `json:"request,omitempty"`
+}
+
+// A structure that represent a scenario script. Its steps run one after another.
+type scenario struct {
+	Steps []step `json:"steps"`
+}
+
+// A structure that publishes messages and prints whether the broker accepted them and the replies.
+type publisher struct {
+	ctx      context.Context
+	producer *producer.Producer
+	pending  sync.WaitGroup // messages waiting for confirmation
+	sent     int64
+	failed   int64
+}
+
+// Function to publish a message of a step. Messages without queue or request are not waited for,
+// their confirmation is printed when it arrives. It returns false if ctx is done.
+func (p *publisher) publish(s step, body string) bool {
+	if p.ctx.Err() != nil {
+		return false
+	}
+
+	atomic.AddInt64(&p.sent, 1)
+	fmt.Println(">> " + body)
+
+	message := producer.Message{Key: s.Key, DedupID: s.DedupID, Headers: s.Headers, Body: body}
+
+	switch {
+	case s.Request:
+		reply, err := p.producer.Request(p.ctx, body)
+		if err != nil {
+			p.report(body, err)
+		} else {
+			fmt.Println("-> " + reply.Body)
+		}
+	case s.Queue != "":
+		p.report(body, p.publishTo(s.Queue, message))
+	default:
+		p.pending.Add(1)
+		p.producer.PublishMessageAsync(message).OnDone(func(err error) {
+			p.report(body, err)
+			p.pending.Done()
+		})
+	}
+
+	return p.ctx.Err() == nil
+}
+
+// Function to publish a message to a queue in a transaction and wait for the commit.
+func (p *publisher) publishTo(queue string, message producer.Message) error {
+	tx, err := p.producer.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = tx.PublishMessage(queue, message)
+	if err != nil {
+		tx.Abort()
+		return err
+	}
+
+	return tx.Commit(p.ctx)
+}
+
+// Function to print whether the broker accepted a message.
+func (p *publisher) report(body string, err error) {
+	if err != nil {
+		atomic.AddInt64(&p.failed, 1)
+		fmt.Println("-> error: " + err.Error())
+		return
+	}
+	fmt.Println("-> broker accepted " + body)
+}
+
+// Function to run a step of a scenario script. It returns false if ctx is done.
+func (p *publisher) run(s step) bool {
+	count := s.Count
+	if count == 0 {
+		count = 1
+	}
+
+	for n := 0; n < count; n++ {
+		if s.Delay.Duration > 0 {
+			select {
+			case <-time.After(s.Delay.Duration):
+			case <-p.ctx.Done():
+				return false
+			}
+		}
+
+		if !p.publish(s, strings.ReplaceAll(s.Body, "{n}", strconv.Itoa(n))) {
+			return false
+		}
+	}
+	return true
+}
+
+// Function to read message bodies, one per line or framed, and pass each of them to handle.
+// A framed body follows a line with its length in bytes, so it can span lines. A length over maxSize
+// is an error, so a wrong length does not make the client allocate without limit. It stops when
+// handle returns false.
+func readBodies(reader io.Reader, framed bool, maxSize int, handle func(body string) bool) error {
+	input := bufio.NewReader(reader)
+
+	for {
+		line, err := input.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		body := line
+		if framed {
+			if line == "" {
+				continue
+			}
+			length, err := strconv.Atoi(line)
+			if err != nil || length < 0 {
+				return errors.New("frame should start with the length of the body, not " + strconv.Quote(line))
+			}
+			if length > maxSize {
+				return errors.New("body of " + strconv.Itoa(length) + " bytes is larger than " + strconv.Itoa(maxSize) + " bytes")
+			}
+
+			data := make([]byte, length)
+			if _, err := io.ReadFull(input, data); err != nil {
+				return errors.New("body of " + strconv.Itoa(length) + " bytes is cut off")
+			}
+			body = string(data)
+		}
+
+		if !handle(body) {
+			return nil
+		}
+	}
+}
+
+// Function to load a scenario script from a JSON file.
+func loadScenario(path string) (scenario, error) {
+	var result scenario
+
+	file, err := os.Open(path)
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&result); err != nil {
+		return result, errors.New(path + ": " + err.Error())
+	}
+
+	for i, s := range result.Steps {
+		if s.Count < 0 {
+			return result, fmt.Errorf("%s: steps[%d].count should not be negative, not %d", path, i, s.Count)
+		}
+		if s.Delay.Duration < 0 {
+			return result, fmt.Errorf("%s: steps[%d].delay should not be negative", path, i)
+		}
+	}
+
+	return result, nil
+}
+
+// Function to handle publish mode. Message bodies are read from standard input or from the files
+// given after the options, or a scenario script is run. Whether the broker accepted each message
+// and the replies are printed. It waits for all confirmations before it returns, and exits with
+// an error status if any message failed.
+func handlePublishing(ctx context.Context, readingPort, writingPort string, arguments []string) {
+	flags := flag.NewFlagSet("publish", flag.ExitOnError)
+	name := flags.String("name", "", "client ID, the certificate subject or producer-<pid> by default")
+	framed := flags.Bool("framed", false, "every body follows a line with its length in bytes")
+	maxSize := flags.Int("max-size", config.DefaultMaxMessageSize, "largest framed body in bytes")
+	script := flags.String("script", "", "path of JSON scenario script to run instead of reading bodies")
+	request := flags.Bool("request", false, "send every body as a request and wait for the reply")
+	queue := flags.String("queue", "", "queue to publish to in a transaction instead of the queue of the client")
+	key := flags.String("key", "", "ordering key of every message")
+	messageHeaders := headers{}
+	flags.Var(messageHeaders, "header", "header of every message as name=value, can be repeated")
+	flags.Parse(arguments)
+
+	clientID, err := loadIdentity()
+	handleError(err)
+	if clientID == "" {
+		clientID = *name
+	}
+	if clientID == "" {
+		clientID = "producer-" + strconv.Itoa(os.Getpid())
+	}
+
+	var steps []step
+	if *script != "" {
+		s, err := loadScenario(*script)
+		handleError(err)
+		steps = s.Steps
+	}
+
+	p := &publisher{ctx: ctx, producer: createProducer(ctx, readingPort, writingPort, clientID)}
+	defer p.producer.Close()
+
+	template := step{Queue: *queue, Key: *key, Headers: messageHeaders, Request: *request}
+	if len(messageHeaders) == 0 {
+		template.Headers = nil
+	}
+
+	if *script != "" {
+		for _, s := range steps {
+			if !p.run(s) {
+				break
+			}
+		}
+	} else {
+		files := flags.Args()
+		if len(files) == 0 {
+			files = []string{"-"}
+		}
+
+		for _, path := range files {
+			if !p.publishFile(path, *framed, *maxSize, template) {
+				break
+			}
+		}
+	}
+
+	p.finish()
+
+	fmt.Println("published " + strconv.FormatInt(atomic.LoadInt64(&p.sent), 10) + " messages, " +
+		strconv.FormatInt(atomic.LoadInt64(&p.failed), 10) + " failed")
+
+	if atomic.LoadInt64(&p.failed) > 0 {
+		p.producer.Close()
+		os.Exit(1)
+	}
+}
+
+// Function to wait until the messages that are published are confirmed. When ctx is done first,
+// the producer is closed, so the messages that were not confirmed yet fail instead of being waited for.
+func (p *publisher) finish() {
+	confirmed := make(chan struct{})
+	go func() {
+		p.producer.Flush()
+		p.pending.Wait()
+		close(confirmed)
+	}()
+
+	select {
+	case <-confirmed:
+	case <-p.ctx.Done():
+		p.producer.Close()
+		<-confirmed
+	}
+}
+
+// Function to publish the bodies of a file, or of standard input when the path is "-".
+// It returns false if ctx is done.
+func (p *publisher) publishFile(path string, framed bool, maxSize int, template step) bool {
+	reader := io.Reader(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		handleError(err)
+		defer file.Close()
+		reader = file
+	}
+
+	err := readBodies(reader, framed, maxSize, func(body string) bool {
+		return p.publish(template, body)
+	})
+	if err != nil {
+		handleError(errors.New(path + ": " + err.Error()))
+	}
+
+	return p.ctx.Err() == nil
+}
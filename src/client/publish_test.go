@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/producer"
+	"distributed-systems-message-queue/src/protocol"
+)
+
+// Function to check that bodies are read one per line, or after their length when framed.
+func TestReadBodies(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		framed  bool
+		expects []string
+		err     string
+	}{
+		{"lines", "first\r\nsecond\n\nlast", false, []string{"first", "second", "", "last"}, ""},
+		{"empty input", "", false, nil, ""},
+		{"framed", "5\nhello\n11\ntwo\nlines\n!\n", true, []string{"hello", "two\nlines\n!"}, ""},
+		{"framed empty body", "0\n\n3\nabc", true, []string{"", "abc"}, ""},
+		{"framed without length", "hello\n", true, nil, `frame should start with the length of the body, not "hello"`},
+		{"framed negative length", "-1\n", true, nil, `frame should start with the length of the body, not "-1"`},
+		{"framed cut off", "10\nshort", true, nil, "body of 10 bytes is cut off"},
+		{"framed at max size", "16\n0123456789abcdef", true, []string{"0123456789abcdef"}, ""},
+		{"framed over max size", "17\n0123456789abcdefg", true, nil, "body of 17 bytes is larger than 16 bytes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var bodies []string
+			err := readBodies(strings.NewReader(test.input), test.framed, 16, func(body string) bool {
+				bodies = append(bodies, body)
+				return true
+			})
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("error is %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(bodies, test.expects) {
+				t.Errorf("bodies are %q, expected %q", bodies, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that reading stops as soon as the handler returns false.
+func TestReadBodiesStop(t *testing.T) {
+	count := 0
+	err := readBodies(strings.NewReader("a\nb\nc\n"), false, 16, func(body string) bool {
+		count++
+		return body != "b"
+	})
+
+	if err != nil || count != 2 {
+		t.Errorf("handled %d bodies with error %v, expected 2", count, err)
+	}
+}
+
+// Function to check that the example scenario loads, and that scenarios with invalid steps are rejected.
+func TestLoadScenario(t *testing.T) {
+	s, err := loadScenario(filepath.Join("..", "..", "scenario.example.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Steps) != 4 || s.Steps[0].Count != 3 || s.Steps[0].Delay.Duration != 500*time.Millisecond ||
+		s.Steps[1].Headers["type"] != "login" || s.Steps[2].Queue != "client-1" || !s.Steps[3].Request {
+		t.Errorf("example scenario is loaded as %+v", s)
+	}
+
+	invalid := map[string]string{
+		`{"steps": [{"body": "a", "count": -1}]}`:    "steps[0].count should not be negative, not -1",
+		`{"steps": [{"body": "a", "delay": "-1s"}]}`: "steps[0].delay should not be negative",
+		`{"steps": [{"body": "a", "repeat": 2}]}`:    "unknown field",
+	}
+	for content, expects := range invalid {
+		path := filepath.Join(t.TempDir(), "scenario.json")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := loadScenario(path); err == nil || !strings.Contains(err.Error(), expects) {
+			t.Errorf("loading %s gives error %v, expected %q", content, err, expects)
+		}
+	}
+}
+
+// Function to check that headers given as flags are split at the first "=".
+func TestHeaders(t *testing.T) {
+	h := headers{}
+	for _, value := range []string{"source=cli", "query=a=b", "empty="} {
+		if err := h.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(h, headers{"source": "cli", "query": "a=b", "empty": ""}) {
+		t.Errorf("headers are %v", h)
+	}
+
+	if err := h.Set("=value"); err == nil {
+		t.Error("header without name is accepted")
+	}
+	if err := h.Set("name"); err == nil {
+		t.Error("header without value is accepted")
+	}
+}
+
+// Function to listen on a free port like the broker does, completing the handshake of every
+// connection and never answering anything else.
+func silentBroker(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { netConn.Close() })
+
+			conn := protocol.NewConn(netConn)
+			go func() {
+				if _, err := conn.AcceptHandshake(0, nil); err != nil {
+					return
+				}
+				for {
+					if _, err := conn.ReadFrame(); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// Function to check that a cancelled publish command stops waiting for confirmations that do not come,
+// and counts their messages as failed.
+func TestFinishCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	connected, stop := context.WithTimeout(ctx, 5*time.Second)
+	defer stop()
+	p, err := producer.Connect(connected, silentBroker(t), silentBroker(t), producer.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	pub := &publisher{ctx: ctx, producer: p}
+	if !pub.publish(step{}, "never confirmed") {
+		t.Fatal("publish stopped before ctx is done")
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		pub.finish()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		t.Fatal("finish returns before the message is confirmed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("finish waits for confirmations after ctx is done")
+	}
+	if failed := atomic.LoadInt64(&pub.failed); failed != 1 {
+		t.Errorf("%d messages failed, expected 1", failed)
+	}
+}
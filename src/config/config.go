@@ -0,0 +1,530 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/security"
+)
+
+// Environment variables that override values of the configuration file. TLS settings and
+// users file are overridden by the same variables clients and servers use.
+const (
+	ConfigEnv    = "MQ_CONFIG"
+	MessagingEnv = "MQ_MESSAGING"
+	ModeEnv      = "MQ_MODE"
+	OverflowEnv  = "MQ_OVERFLOW"
+	HeartbeatEnv = "MQ_HEARTBEAT"
+)
+
+// Overflow policies that decide what happens when a message arrives at a full queue.
+const (
+	OverflowExit  = "exit"  // the broker stops with an error
+	OverflowPause = "pause" // the broker stops reading from the sender for a while
+	OverflowDrop  = "drop"  // the message is dropped
+)
+
+// Policies that decide what happens when a client publishes faster than its publish limit.
+const (
+	OverLimitThrottle = "throttle" // the broker stops reading from the client until the rate allows the message
+	OverLimitReject   = "reject"   // the message is rejected with a hint how long to wait before publishing again
+)
+
+// Scheduling policies that decide which client queue the server gets its next message from.
+const (
+	SchedulingRoundRobin = "round-robin" // queues take turns, one message each
+	SchedulingWeighted   = "weighted"    // queues take turns, as many messages as their weight
+	SchedulingDeficit    = "deficit"     // queues take turns, as many bytes as their weight times the quantum
+	SchedulingPriority   = "priority"    // the queue with the highest priority goes first, equal ones take turns
+)
+
+// Default values used for settings the configuration does not give.
+const (
+	DefaultCapacity          = 10
+	DefaultOverflow          = OverflowExit
+	DefaultHeartbeat         = 10 * time.Second
+	DefaultHandshakeTimeout  = 10 * time.Second
+	DefaultOverflowPause     = 30 * time.Second
+	DefaultDedupWindow       = 2 * time.Minute
+	DefaultDedupSize         = 10000
+	DefaultScheduling        = SchedulingRoundRobin
+	DefaultWeight            = 1
+	DefaultQuantum           = 1024
+	DefaultOverLimit         = OverLimitThrottle
+	DefaultBurst             = time.Second
+	DefaultMaxMessageSize    = 1 << 20
+	DefaultRequestTimeout    = 30 * time.Second
+	DefaultVisibilityTimeout = 30 * time.Second
+)
+
+// A structure that represent a duration written as text like "10s" or "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+// Function to decode a duration from JSON text.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return errors.New("duration should be text like \"10s\"")
+	}
+
+	d.Duration, err = time.ParseDuration(text)
+	return err
+}
+
+// Function to encode a duration as JSON text.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// A structure that represent ports a peer connects to.
+// The peer reads from the reading port and writes to the writing port.
+type Listener struct {
+	ReadingPort string `json:"reading_port"`
+	WritingPort string `json:"writing_port,omitempty"`
+}
+
+// A structure that represent a client listener and the queue its messages are enqueued to.
+type Client struct {
+	Listener
+	Queue        string    `json:"queue,omitempty"`
+	PublishLimit RateLimit `json:"publish_limit"`        // how fast the client may publish
+	OverLimit    string    `json:"over_limit,omitempty"` // throttle or reject, what happens to messages over the publish limit
+}
+
+// A structure that represent a rate limit kept with token buckets. A zero rate means no limit.
+type RateLimit struct {
+	Messages float64  `json:"messages,omitempty"` // messages per second
+	Bytes    float64  `json:"bytes,omitempty"`    // bytes of message bodies per second
+	Burst    Duration `json:"burst,omitempty"`    // how long unused rate is saved up, 1s by default
+}
+
+// Function to check whether a rate limit limits anything.
+func (r RateLimit) Enabled() bool {
+	return r.Messages > 0 || r.Bytes > 0
+}
+
+// Function to get how long unused rate is saved up.
+func (r RateLimit) BurstDuration() time.Duration {
+	if r.Burst.Duration > 0 {
+		return r.Burst.Duration
+	}
+	return DefaultBurst
+}
+
+// A structure that represent settings of a queue.
+type Queue struct {
+	Name          string    `json:"name"`
+	Capacity      int       `json:"capacity,omitempty"`
+	Overflow      string    `json:"overflow,omitempty"`
+	DedupWindow   *Duration `json:"dedup_window,omitempty"` // how long a message ID is remembered to drop duplicates, nil when not declared
+	DedupSize     int       `json:"dedup_size,omitempty"`   // how many message IDs are remembered at most
+	Weight        int       `json:"weight,omitempty"`       // share of the server in weighted and deficit scheduling
+	Priority      int       `json:"priority,omitempty"`     // queues with higher priority go first in priority scheduling
+	DeliveryLimit RateLimit `json:"delivery_limit"`         // how fast messages of the queue are delivered
+}
+
+// A structure that represent TLS settings of the listeners.
+type TLS struct {
+	Enabled    bool   `json:"enabled"`
+	Cert       string `json:"cert,omitempty"`
+	Key        string `json:"key,omitempty"`
+	CA         string `json:"ca,omitempty"`
+	ClientAuth bool   `json:"client_auth,omitempty"`
+}
+
+// A structure that represent configuration of the broker.
+type Broker struct {
+	Messaging         string    `json:"messaging"` // one or multi
+	Mode              string    `json:"mode"`      // sync or async
+	Server            Listener  `json:"server"`
+	Clients           []Client  `json:"clients"`
+	AdminPort         string    `json:"admin_port,omitempty"` // port for admin commands like reload, none if empty
+	HTTPPort          string    `json:"http_port,omitempty"`  // port of the HTTP gateway, none if empty
+	HTTPPublishLimit  RateLimit `json:"http_publish_limit"`   // how fast every user or address may publish over the HTTP gateway
+	Queues            []Queue   `json:"queues,omitempty"`
+	Overflow          string    `json:"overflow,omitempty"` // policy of queues that are not declared
+	Heartbeat         Duration  `json:"heartbeat"`
+	HandshakeTimeout  Duration  `json:"handshake_timeout"`
+	RequestTimeout    Duration  `json:"request_timeout"`    // how long a request waits for the server in sync mode
+	VisibilityTimeout Duration  `json:"visibility_timeout"` // how long a message pulled over HTTP waits for its acknowledgment
+	OverflowPause     Duration  `json:"overflow_pause"`
+	DedupWindow       Duration  `json:"dedup_window"` // deduplication of queues that do not declare it, "0s" disables it
+	DedupSize         int       `json:"dedup_size"`
+	Prefetch          int       `json:"prefetch"`         // deliveries the server may have unacknowledged at once, 0 for no limit
+	MaxMessageSize    int       `json:"max_message_size"` // bytes a message body may have at most, 0 for no limit
+	Scheduling        string    `json:"scheduling"`
+	Quantum           int       `json:"quantum"` // bytes a queue of weight 1 gets per turn in deficit scheduling
+	TLS               TLS       `json:"tls"`
+	UsersFile         string    `json:"users_file,omitempty"`
+}
+
+// Function to get configuration with default values.
+func Default() Broker {
+	return Broker{
+		Messaging:         "multi",
+		Mode:              "async",
+		Overflow:          DefaultOverflow,
+		Heartbeat:         Duration{DefaultHeartbeat},
+		HandshakeTimeout:  Duration{DefaultHandshakeTimeout},
+		RequestTimeout:    Duration{DefaultRequestTimeout},
+		VisibilityTimeout: Duration{DefaultVisibilityTimeout},
+		OverflowPause:     Duration{DefaultOverflowPause},
+		DedupWindow:       Duration{DefaultDedupWindow},
+		DedupSize:         DefaultDedupSize,
+		Scheduling:        DefaultScheduling,
+		Quantum:           DefaultQuantum,
+		MaxMessageSize:    DefaultMaxMessageSize,
+	}
+}
+
+// Function to load configuration from a JSON file on top of default values.
+// Unknown fields are errors so that typos do not go unnoticed.
+func Load(file string) (Broker, error) {
+	broker := Default()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return broker, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(&broker)
+	if err != nil {
+		return broker, errors.New("config file " + file + " is not valid: " + err.Error())
+	}
+
+	return broker, nil
+}
+
+// Function to override configuration with environment variables that are set.
+func (b *Broker) ApplyEnv() error {
+	if value, ok := os.LookupEnv(MessagingEnv); ok {
+		b.Messaging = value
+	}
+	if value, ok := os.LookupEnv(ModeEnv); ok {
+		b.Mode = value
+	}
+	if value, ok := os.LookupEnv(OverflowEnv); ok {
+		b.Overflow = value
+	}
+	if value, ok := os.LookupEnv(auth.UsersFileEnv); ok {
+		b.UsersFile = value
+	}
+	if value, ok := os.LookupEnv(security.TLSCertEnv); ok {
+		b.TLS.Cert = value
+	}
+	if value, ok := os.LookupEnv(security.TLSKeyEnv); ok {
+		b.TLS.Key = value
+	}
+	if value, ok := os.LookupEnv(security.TLSCAEnv); ok {
+		b.TLS.CA = value
+	}
+
+	if value, ok := os.LookupEnv(HeartbeatEnv); ok {
+		heartbeat, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New(HeartbeatEnv + " should be a duration like 10s")
+		}
+		b.Heartbeat.Duration = heartbeat
+	}
+	if value, ok := os.LookupEnv(security.TLSEnv); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New(security.TLSEnv + " should be true or false")
+		}
+		b.TLS.Enabled = enabled
+	}
+	if value, ok := os.LookupEnv(security.TLSClientAuthEnv); ok {
+		clientAuth, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New(security.TLSClientAuthEnv + " should be true or false")
+		}
+		b.TLS.ClientAuth = clientAuth
+	}
+
+	return nil
+}
+
+// Function to get settings of a queue. Queues that are not declared get default capacity and weight,
+// and the default overflow policy and deduplication of the broker.
+func (b Broker) Queue(name string) Queue {
+	window := b.DedupWindow
+	queue := Queue{Name: name, Capacity: DefaultCapacity, Overflow: b.Overflow, DedupWindow: &window, DedupSize: b.DedupSize,
+		Weight: DefaultWeight}
+
+	for _, declared := range b.Queues {
+		if declared.Name != name {
+			continue
+		}
+		if declared.Capacity != 0 {
+			queue.Capacity = declared.Capacity
+		}
+		if declared.Overflow != "" {
+			queue.Overflow = declared.Overflow
+		}
+		// A declared window of "0s" disables deduplication of the queue, so it is not replaced by the default.
+		if declared.DedupWindow != nil {
+			window = *declared.DedupWindow
+		}
+		if declared.DedupSize != 0 {
+			queue.DedupSize = declared.DedupSize
+		}
+		if declared.Weight != 0 {
+			queue.Weight = declared.Weight
+		}
+		queue.Priority = declared.Priority
+		queue.DeliveryLimit = declared.DeliveryLimit
+	}
+
+	if queue.Overflow == "" {
+		queue.Overflow = DefaultOverflow
+	}
+
+	return queue
+}
+
+// Function to get name of the queue messages of a client are enqueued to.
+func (b Broker) ClientQueue(index int) string {
+	if b.Clients[index].Queue != "" {
+		return b.Clients[index].Queue
+	}
+	if b.Messaging == "multi" && b.Mode == "async" {
+		return "client-" + strconv.Itoa(index)
+	}
+	return "requests"
+}
+
+// Function to validate configuration. All problems are reported together.
+func (b Broker) Validate() error {
+	problems := make([]string, 0)
+	report := func(format string, arguments ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, arguments...))
+	}
+
+	if b.Messaging != "one" && b.Messaging != "multi" {
+		report("messaging should be one or multi, not %q", b.Messaging)
+	}
+	if b.Mode != "sync" && b.Mode != "async" {
+		report("mode should be sync or async, not %q", b.Mode)
+	}
+
+	ports := make(map[string]string)
+	checkPort := func(field, port string) {
+		number, err := strconv.Atoi(port)
+		if err != nil || number < 1 || number > 65535 {
+			report("%s should be a port number between 1 and 65535, not %q", field, port)
+			return
+		}
+		if other, ok := ports[port]; ok {
+			report("%s uses port %s that is already used by %s", field, port, other)
+			return
+		}
+		ports[port] = field
+	}
+
+	checkPort("server.reading_port", b.Server.ReadingPort)
+	if b.Messaging == "multi" {
+		checkPort("server.writing_port", b.Server.WritingPort)
+	}
+
+	if len(b.Clients) == 0 {
+		report("clients should have at least one client")
+	}
+	checkLimit := func(field string, limit RateLimit) {
+		if limit.Messages < 0 || limit.Bytes < 0 {
+			report("%s rates should not be negative", field)
+		}
+		if limit.Burst.Duration < 0 {
+			report("%s.burst should not be negative", field)
+		}
+	}
+
+	for i, client := range b.Clients {
+		checkPort(fmt.Sprintf("clients[%d].reading_port", i), client.ReadingPort)
+		checkPort(fmt.Sprintf("clients[%d].writing_port", i), client.WritingPort)
+		checkLimit(fmt.Sprintf("clients[%d].publish_limit", i), client.PublishLimit)
+		if client.OverLimit != "" && client.OverLimit != OverLimitThrottle && client.OverLimit != OverLimitReject {
+			report("clients[%d].over_limit should be throttle or reject, not %q", i, client.OverLimit)
+		}
+	}
+	if b.AdminPort != "" {
+		checkPort("admin_port", b.AdminPort)
+	}
+	if b.HTTPPort != "" {
+		checkPort("http_port", b.HTTPPort)
+	}
+	checkLimit("http_publish_limit", b.HTTPPublishLimit)
+
+	queues := make(map[string]bool)
+	for i, queue := range b.Queues {
+		if queue.Name == "" {
+			report("queues[%d].name is required", i)
+		} else if queues[queue.Name] {
+			report("queues[%d].name %q is declared more than once", i, queue.Name)
+		}
+		queues[queue.Name] = true
+
+		if queue.Capacity < 0 {
+			report("queues[%d].capacity should be positive, not %d", i, queue.Capacity)
+		}
+		if queue.Overflow != "" && !validOverflow(queue.Overflow) {
+			report("queues[%d].overflow should be exit, pause or drop, not %q", i, queue.Overflow)
+		}
+		if queue.DedupWindow != nil && queue.DedupWindow.Duration < 0 {
+			report("queues[%d].dedup_window should not be negative", i)
+		}
+		if queue.DedupSize < 0 {
+			report("queues[%d].dedup_size should be positive, not %d", i, queue.DedupSize)
+		}
+		if queue.Weight < 0 {
+			report("queues[%d].weight should be positive, not %d", i, queue.Weight)
+		}
+		checkLimit(fmt.Sprintf("queues[%d].delivery_limit", i), queue.DeliveryLimit)
+	}
+	if !validOverflow(b.Overflow) {
+		report("overflow should be exit, pause or drop, not %q", b.Overflow)
+	}
+
+	if b.Heartbeat.Duration < 0 {
+		report("heartbeat should not be negative")
+	}
+	if b.HandshakeTimeout.Duration <= 0 {
+		report("handshake_timeout should be positive")
+	}
+	if b.RequestTimeout.Duration <= 0 {
+		report("request_timeout should be positive")
+	}
+	if b.VisibilityTimeout.Duration <= 0 {
+		report("visibility_timeout should be positive")
+	}
+	if b.OverflowPause.Duration <= 0 {
+		report("overflow_pause should be positive")
+	}
+	if b.DedupWindow.Duration < 0 {
+		report("dedup_window should not be negative")
+	}
+	if b.DedupSize < 0 {
+		report("dedup_size should be positive, not %d", b.DedupSize)
+	}
+	if b.Prefetch < 0 {
+		report("prefetch should not be negative, not %d", b.Prefetch)
+	}
+	if b.MaxMessageSize < 0 {
+		report("max_message_size should not be negative, not %d", b.MaxMessageSize)
+	}
+	if !validScheduling(b.Scheduling) {
+		report("scheduling should be round-robin, weighted, deficit or priority, not %q", b.Scheduling)
+	}
+	if b.Quantum <= 0 {
+		report("quantum should be positive, not %d", b.Quantum)
+	}
+
+	if b.TLS.Enabled && (b.TLS.Cert == "" || b.TLS.Key == "") {
+		report("tls.cert and tls.key are required when tls is enabled")
+	}
+	if b.TLS.ClientAuth && !b.TLS.Enabled {
+		report("tls.client_auth requires tls to be enabled")
+	}
+	if b.TLS.ClientAuth && b.TLS.CA == "" {
+		report("tls.ca is required when tls.client_auth is enabled")
+	}
+	files := [][2]string{{"tls.cert", b.TLS.Cert}, {"tls.key", b.TLS.Key}, {"tls.ca", b.TLS.CA}, {"users_file", b.UsersFile}}
+	for _, file := range files {
+		if file[1] == "" {
+			continue
+		}
+		if _, err := os.Stat(file[1]); err != nil {
+			report("%s cannot be read: %v", file[0], err)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return errors.New("configuration is not valid:\n  " + strings.Join(problems, "\n  "))
+}
+
+// Function to get configuration to use after reloading next configuration. Queues, overflow
+// policies, timeouts, the prefetch limit, scheduling, rate limits and users in the users file can be changed
+// while the broker is running.
+// Other settings keep their current values, and names of those that differ in next
+// configuration are returned because they need a restart.
+func (b Broker) Reload(next Broker) (Broker, []string) {
+	restartRequired := make([]string, 0)
+
+	if b.Messaging != next.Messaging {
+		restartRequired = append(restartRequired, "messaging")
+	}
+	if b.Mode != next.Mode {
+		restartRequired = append(restartRequired, "mode")
+	}
+	if b.Server != next.Server {
+		restartRequired = append(restartRequired, "server")
+	}
+	if !reflect.DeepEqual(withoutLimits(b.Clients), withoutLimits(next.Clients)) {
+		restartRequired = append(restartRequired, "clients")
+	} else {
+		// Publish limits of clients can change without a restart.
+		b.Clients = next.Clients
+	}
+	if b.AdminPort != next.AdminPort {
+		restartRequired = append(restartRequired, "admin_port")
+	}
+	if b.HTTPPort != next.HTTPPort {
+		restartRequired = append(restartRequired, "http_port")
+	}
+	if b.TLS != next.TLS {
+		restartRequired = append(restartRequired, "tls")
+	}
+	if (b.UsersFile == "") != (next.UsersFile == "") {
+		restartRequired = append(restartRequired, "users_file")
+		next.UsersFile = b.UsersFile
+	}
+
+	next.Messaging, next.Mode, next.Server, next.Clients = b.Messaging, b.Mode, b.Server, b.Clients
+	next.AdminPort, next.HTTPPort, next.TLS = b.AdminPort, b.HTTPPort, b.TLS
+
+	return next, restartRequired
+}
+
+// Function to get clients without their publish limits, to compare the settings that need a restart.
+func withoutLimits(clients []Client) []Client {
+	result := make([]Client, len(clients))
+	for i, client := range clients {
+		result[i] = Client{Listener: client.Listener, Queue: client.Queue}
+	}
+	return result
+}
+
+// Function to get policy of a client for messages over its publish limit.
+func (c Client) OverLimitPolicy() string {
+	if c.OverLimit != "" {
+		return c.OverLimit
+	}
+	return DefaultOverLimit
+}
+
+// Function to check whether a scheduling policy exists.
+func validScheduling(scheduling string) bool {
+	return scheduling == SchedulingRoundRobin || scheduling == SchedulingWeighted ||
+		scheduling == SchedulingDeficit || scheduling == SchedulingPriority
+}
+
+// Function to check whether an overflow policy exists.
+func validOverflow(overflow string) bool {
+	return overflow == OverflowExit || overflow == OverflowPause || overflow == OverflowDrop
+}
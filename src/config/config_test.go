@@ -0,0 +1,322 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/security"
+)
+
+// Function to get a valid configuration with two clients in asynchronous multi-way messaging.
+func validBroker() Broker {
+	broker := Default()
+	broker.Server = Listener{ReadingPort: "8000", WritingPort: "8001"}
+	broker.Clients = []Client{
+		{Listener: Listener{ReadingPort: "8002", WritingPort: "8003"}},
+		{Listener: Listener{ReadingPort: "8004", WritingPort: "8005"}},
+	}
+	return broker
+}
+
+// Function to write a file with given content to a temporary directory.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Function to check that the example configuration loads on top of defaults and is valid.
+func TestLoadExample(t *testing.T) {
+	broker, err := Load("../../config.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if broker.Messaging != "multi" || broker.Overflow != OverflowPause || len(broker.Clients) != 2 {
+		t.Errorf("broker = %+v", broker)
+	}
+	if broker.Heartbeat.Duration != 10*time.Second {
+		t.Errorf("heartbeat = %v, expected 10s", broker.Heartbeat)
+	}
+	if err := broker.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Function to check that files with unknown fields or wrong durations are not loaded.
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		reason  string
+	}{
+		{"unknown field", `{"mesaging": "one"}`, "unknown field"},
+		{"duration as number", `{"heartbeat": 10}`, "duration should be text"},
+		{"duration without unit", `{"heartbeat": "10"}`, "missing unit"},
+		{"not JSON", `messaging = "one"`, "not valid"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Load(writeFile(t, "broker.json", test.content))
+			if err == nil || !strings.Contains(err.Error(), test.reason) {
+				t.Errorf("err = %v, expected %q", err, test.reason)
+			}
+		})
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file is loaded")
+	}
+}
+
+// Function to check that set environment variables override the configuration and others do not.
+func TestApplyEnv(t *testing.T) {
+	t.Setenv(ModeEnv, "sync")
+	t.Setenv(HeartbeatEnv, "2s")
+	t.Setenv(security.TLSEnv, "true")
+	t.Setenv(security.TLSCertEnv, "broker.pem")
+
+	broker := validBroker()
+	broker.Overflow = OverflowDrop
+	if err := broker.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	if broker.Mode != "sync" || broker.Heartbeat.Duration != 2*time.Second || !broker.TLS.Enabled || broker.TLS.Cert != "broker.pem" {
+		t.Errorf("environment is not applied: %+v", broker)
+	}
+	if broker.Messaging != "multi" || broker.Overflow != OverflowDrop {
+		t.Errorf("values without environment variable are changed: %+v", broker)
+	}
+
+	t.Setenv(HeartbeatEnv, "often")
+	if err := broker.ApplyEnv(); err == nil {
+		t.Error("heartbeat that is not a duration is accepted")
+	}
+}
+
+// Function to check that declared queues override defaults only for the values they give.
+func TestQueue(t *testing.T) {
+	broker := validBroker()
+	broker.Overflow = OverflowPause
+	broker.Queues = []Queue{{Name: "client-1", Capacity: 5}, {Name: "responses", Overflow: OverflowDrop},
+		{Name: "orders", DedupWindow: &Duration{time.Hour}, DedupSize: 10, Weight: 3, Priority: 2}}
+
+	// A window of "0s" is declared, so it disables deduplication instead of being left to the default.
+	var events Queue
+	if err := json.Unmarshal([]byte(`{"name": "events", "dedup_window": "0s"}`), &events); err != nil {
+		t.Fatal(err)
+	}
+	broker.Queues = append(broker.Queues, events)
+
+	tests := []struct {
+		name string
+		edit func(expects *Queue) // changes of the expected settings from the defaults
+	}{
+		{"client-1", func(expects *Queue) { expects.Capacity = 5 }},
+		{"responses", func(expects *Queue) { expects.Overflow = OverflowDrop }},
+		{"orders", func(expects *Queue) {
+			expects.DedupWindow, expects.DedupSize, expects.Weight, expects.Priority = &Duration{time.Hour}, 10, 3, 2
+		}},
+		{"events", func(expects *Queue) { expects.DedupWindow = &Duration{0} }},
+		{"client-0", func(expects *Queue) {}},
+	}
+
+	for _, test := range tests {
+		expects := Queue{Name: test.name, Capacity: DefaultCapacity, Overflow: OverflowPause,
+			DedupWindow: &Duration{DefaultDedupWindow}, DedupSize: DefaultDedupSize, Weight: DefaultWeight}
+		test.edit(&expects)
+
+		if queue := broker.Queue(test.name); !reflect.DeepEqual(queue, expects) {
+			t.Errorf("Queue(%s) = %+v, expected %+v", test.name, queue, expects)
+		}
+	}
+
+	broker.Overflow = ""
+	if queue := broker.Queue("client-0"); queue.Overflow != DefaultOverflow {
+		t.Errorf("overflow without broker policy = %q, expected %q", queue.Overflow, DefaultOverflow)
+	}
+}
+
+// Function to check the queue messages of a client go to in every kind of messaging.
+func TestClientQueue(t *testing.T) {
+	broker := validBroker()
+	broker.Clients[1].Queue = "jobs"
+
+	if queue := broker.ClientQueue(0); queue != "client-0" {
+		t.Errorf("queue of client 0 = %s, expected client-0", queue)
+	}
+	if queue := broker.ClientQueue(1); queue != "jobs" {
+		t.Errorf("queue of client 1 = %s, expected jobs", queue)
+	}
+
+	broker.Mode = "sync"
+	if queue := broker.ClientQueue(0); queue != "requests" {
+		t.Errorf("queue in sync mode = %s, expected requests", queue)
+	}
+}
+
+// Function to check that every problem of a configuration is reported.
+func TestValidate(t *testing.T) {
+	usersFile := writeFile(t, "users.json", "{}")
+
+	tests := []struct {
+		name     string
+		edit     func(b *Broker)
+		problems []string
+	}{
+		{"valid", func(b *Broker) {}, nil},
+		{"valid one-way", func(b *Broker) {
+			b.Messaging, b.Server.WritingPort, b.Clients = "one", "", b.Clients[:1]
+		}, nil},
+		{"existing users file", func(b *Broker) { b.UsersFile = usersFile }, nil},
+		{"admin port", func(b *Broker) { b.AdminPort = "8006" }, nil},
+		{"unknown messaging and mode", func(b *Broker) { b.Messaging, b.Mode = "two", "later" },
+			[]string{`messaging should be one or multi, not "two"`, `mode should be sync or async, not "later"`}},
+		{"port out of range", func(b *Broker) { b.Server.ReadingPort = "70000" },
+			[]string{`server.reading_port should be a port number between 1 and 65535, not "70000"`}},
+		{"port used twice", func(b *Broker) { b.Clients[1].WritingPort = "8001" },
+			[]string{"clients[1].writing_port uses port 8001 that is already used by server.writing_port"}},
+		{"http port", func(b *Broker) { b.HTTPPort = "8080" }, nil},
+		{"http port used twice", func(b *Broker) { b.HTTPPort = "8001" },
+			[]string{"http_port uses port 8001 that is already used by server.writing_port"}},
+		{"admin port used twice", func(b *Broker) { b.AdminPort = "8000" },
+			[]string{"admin_port uses port 8000 that is already used by server.reading_port"}},
+		{"no clients", func(b *Broker) { b.Clients = nil }, []string{"clients should have at least one client"}},
+		{"one-way with many clients", func(b *Broker) { b.Messaging, b.Server.WritingPort = "one", "" }, nil},
+		{"queues", func(b *Broker) {
+			b.Queues = []Queue{{Capacity: 1}, {Name: "jobs", Capacity: -1}, {Name: "jobs", Overflow: "block"}}
+		}, []string{"queues[0].name is required", "queues[1].capacity should be positive, not -1",
+			`queues[2].name "jobs" is declared more than once`, `queues[2].overflow should be exit, pause or drop, not "block"`}},
+		{"durations", func(b *Broker) {
+			b.Heartbeat.Duration, b.HandshakeTimeout.Duration, b.RequestTimeout.Duration = -time.Second, 0, 0
+			b.VisibilityTimeout.Duration, b.OverflowPause.Duration = 0, 0
+		}, []string{"heartbeat should not be negative", "handshake_timeout should be positive", "request_timeout should be positive",
+			"visibility_timeout should be positive", "overflow_pause should be positive"}},
+		{"sync with many clients", func(b *Broker) { b.Mode = "sync" }, nil},
+		{"scheduling", func(b *Broker) {
+			b.Scheduling, b.Quantum = "fair", 0
+			b.Queues = []Queue{{Name: "jobs", Capacity: 1, Weight: -1}}
+		}, []string{"queues[0].weight should be positive, not -1",
+			`scheduling should be round-robin, weighted, deficit or priority, not "fair"`, "quantum should be positive, not 0"}},
+		{"rate limits", func(b *Broker) {
+			b.Clients[0].PublishLimit = RateLimit{Messages: -1, Burst: Duration{-time.Second}}
+			b.Clients[1].OverLimit = "drop"
+			b.Queues = []Queue{{Name: "jobs", Capacity: 1, DeliveryLimit: RateLimit{Bytes: -1}}}
+		}, []string{"clients[0].publish_limit rates should not be negative", "clients[0].publish_limit.burst should not be negative",
+			`clients[1].over_limit should be throttle or reject, not "drop"`, "queues[0].delivery_limit rates should not be negative"}},
+		{"http publish limit", func(b *Broker) { b.HTTPPublishLimit = RateLimit{Bytes: -1} },
+			[]string{"http_publish_limit rates should not be negative"}},
+		{"negative prefetch", func(b *Broker) { b.Prefetch = -1 }, []string{"prefetch should not be negative, not -1"}},
+		{"negative message size", func(b *Broker) { b.MaxMessageSize = -1 }, []string{"max_message_size should not be negative, not -1"}},
+		{"TLS without certificate", func(b *Broker) { b.TLS.Enabled = true },
+			[]string{"tls.cert and tls.key are required when tls is enabled"}},
+		{"client authentication without TLS", func(b *Broker) { b.TLS.ClientAuth = true },
+			[]string{"tls.client_auth requires tls to be enabled", "tls.ca is required when tls.client_auth is enabled"}},
+		{"missing file", func(b *Broker) { b.UsersFile = filepath.Join(t.TempDir(), "users.json") },
+			[]string{"users_file cannot be read"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := validBroker()
+			test.edit(&broker)
+
+			err := broker.Validate()
+			if test.problems == nil {
+				if err != nil {
+					t.Errorf("valid configuration is reported: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("configuration is valid, expected problems")
+			}
+
+			reported := strings.Split(err.Error(), "\n  ")[1:]
+			if len(reported) != len(test.problems) {
+				t.Errorf("problems = %q, expected %d", reported, len(test.problems))
+			}
+			for _, problem := range test.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("problem %q is not reported in %q", problem, reported)
+				}
+			}
+		})
+	}
+}
+
+// Function to check that reloading takes settings that can change at runtime and keeps the others,
+// reporting those that need a restart.
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name            string
+		edit            func(b *Broker)
+		restartRequired []string
+	}{
+		{"nothing changed", func(b *Broker) {}, []string{}},
+		{"runtime settings", func(b *Broker) {
+			b.Queues = []Queue{{Name: "client-0", Capacity: 3}}
+			b.Overflow = OverflowDrop
+			b.Heartbeat.Duration = time.Second
+			b.HandshakeTimeout.Duration = time.Second
+			b.OverflowPause.Duration = time.Second
+			b.VisibilityTimeout.Duration = time.Second
+			b.UsersFile = "other-users.json"
+		}, []string{}},
+		{"messaging and mode", func(b *Broker) { b.Messaging, b.Mode = "one", "sync" }, []string{"messaging", "mode"}},
+		{"ports", func(b *Broker) {
+			b.Server.WritingPort = "9001"
+			b.Clients = append(b.Clients, Client{Listener: Listener{ReadingPort: "9002", WritingPort: "9003"}})
+			b.AdminPort, b.HTTPPort = "9004", "9005"
+		}, []string{"server", "clients", "admin_port", "http_port"}},
+		{"client queue", func(b *Broker) { b.Clients[0].Queue = "jobs" }, []string{"clients"}},
+		{"publish limits", func(b *Broker) {
+			b.Clients[0].PublishLimit, b.Clients[0].OverLimit = RateLimit{Messages: 10}, OverLimitReject
+		}, []string{}},
+		{"tls", func(b *Broker) { b.TLS.ClientAuth = true }, []string{"tls"}},
+		{"users file removed", func(b *Broker) { b.UsersFile = "" }, []string{"users_file"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			current := validBroker()
+			current.UsersFile = "users.json"
+			next := validBroker()
+			next.UsersFile = "users.json"
+			next.Clients = append([]Client(nil), current.Clients...)
+			test.edit(&next)
+
+			reloaded, restartRequired := current.Reload(next)
+
+			if !reflect.DeepEqual(restartRequired, test.restartRequired) {
+				t.Errorf("restart required for %v, expected %v", restartRequired, test.restartRequired)
+			}
+
+			expects := next
+			expects.Messaging, expects.Mode, expects.Server = current.Messaging, current.Mode, current.Server
+			for _, setting := range test.restartRequired {
+				if setting == "clients" {
+					expects.Clients = current.Clients
+				}
+			}
+			expects.AdminPort, expects.HTTPPort, expects.TLS = current.AdminPort, current.HTTPPort, current.TLS
+			if next.UsersFile == "" {
+				expects.UsersFile = current.UsersFile
+			}
+			if !reflect.DeepEqual(reloaded, expects) {
+				t.Errorf("reloaded = %+v, expected %+v", reloaded, expects)
+			}
+		})
+	}
+}
@@ -0,0 +1,898 @@
+// Package consumer is a client library to consume messages from the broker with a handler function.
+// Messages are handled by a pool of workers and acknowledged when the handler succeeds. A message
+// whose handler keeps failing is rejected so the broker delivers it again. With WithMaxDeliveries
+// it is dropped once it has been delivered too many times. In multi-way messaging a consumer can reply to the
+// messages it handles on its writing connection.
+package consumer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distributed-systems-message-queue/src/protocol"
+	"distributed-systems-message-queue/src/security"
+)
+
+// Errors returned by a consumer.
+var (
+	ErrClosed         = errors.New("consumer is closed")
+	ErrNoReplies      = errors.New("consumer has no writing port to reply on")
+	ErrConnectionLost = errors.New("connection to broker is lost")
+	ErrRunning        = errors.New("consumer is already running")
+	ErrNoTransactions = errors.New("broker does not support transactions")
+	ErrFinished       = errors.New("transaction is already committed or aborted")
+)
+
+// An error returned when the broker rejects a transaction. Code tells why, as one of the error
+// codes of the protocol.
+type RejectedError struct {
+	ID     string
+	Code   string
+	Reason string
+}
+
+// Function to describe a rejected transaction.
+func (e *RejectedError) Error() string {
+	return "transaction " + e.ID + " is rejected: " + e.Reason
+}
+
+// A structure that represent a message received from the broker.
+type Message struct {
+	ID            string            // ID the broker gave the delivery, empty if the broker does not track it
+	ClientID      string            // client the message belongs to, replies are routed to it
+	CorrelationID string            // request of the client, replies carry it back
+	Key           string            // messages with the same key are handled in order, one at a time
+	Headers       map[string]string // metadata the producer gave the message
+	Body          string
+	Attempt       int // delivery attempt of the message, starting at 1, or 0 if the broker does not count them
+
+	conn  *protocol.Conn // connection the message was received on
+	acked *int32         // set when a committed transaction acknowledged the message
+}
+
+// A function that handles a message. The message is acknowledged when it returns nil.
+type Handler func(ctx context.Context, message Message) error
+
+// A structure that represent options of a consumer.
+type options struct {
+	host           string
+	clientID       string
+	username       string
+	password       string
+	token          string
+	tlsConfig      *tls.Config
+	heartbeat      time.Duration
+	reconnectDelay time.Duration
+	concurrency    int
+	retries        int
+	retryDelay     time.Duration
+	maxDeliveries  int
+	errorHandler   func(err error)
+	logger         *log.Logger
+}
+
+// A function that changes an option of a consumer created by Connect.
+type Option func(o *options)
+
+// Function to set the host name or IP address of the broker. The ports given to Connect
+// are dialed on this host, on the local machine by default.
+func WithAddress(host string) Option {
+	return func(o *options) {
+		o.host = host
+	}
+}
+
+// Function to set client ID sent in handshake. A consumer with a client certificate
+// or credentials can leave it empty, then the broker uses the certificate or user name.
+// By default it is consumer-<pid>-<random>, see defaultClientID.
+func WithClientID(clientID string) Option {
+	return func(o *options) {
+		o.clientID = clientID
+	}
+}
+
+// Function to authenticate with a user name and password.
+func WithPassword(username, password string) Option {
+	return func(o *options) {
+		o.username, o.password = username, password
+	}
+}
+
+// Function to authenticate with a bearer token.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// Function to connect with TLS. Connections use plain TCP when it is nil.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = tlsConfig
+	}
+}
+
+// Function to set heartbeat interval proposed in handshake. Zero leaves it to the broker.
+func WithHeartbeat(heartbeat time.Duration) Option {
+	return func(o *options) {
+		o.heartbeat = heartbeat
+	}
+}
+
+// Function to set how long to wait between attempts to reconnect to the broker.
+func WithReconnectDelay(delay time.Duration) Option {
+	return func(o *options) {
+		o.reconnectDelay = delay
+	}
+}
+
+// Function to set how many messages are handled at the same time. The default is one,
+// so messages are handled in the order they are received. With more workers, only messages
+// with the same key are handled in order.
+func WithConcurrency(concurrency int) Option {
+	return func(o *options) {
+		o.concurrency = concurrency
+	}
+}
+
+// Function to set how many times a failed handler is called again before the message is
+// rejected, and how long to wait before each retry.
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(o *options) {
+		o.retries, o.retryDelay = retries, delay
+	}
+}
+
+// Function to set after how many deliveries a message whose handler fails is dropped instead
+// of rejected. Zero, the default, rejects it every time, so the broker keeps delivering it
+// and no message is lost.
+func WithMaxDeliveries(maxDeliveries int) Option {
+	return func(o *options) {
+		o.maxDeliveries = maxDeliveries
+	}
+}
+
+// Function to handle errors of handlers and errors the broker sends.
+// Errors are logged when no error handler is set.
+func WithErrorHandler(handler func(err error)) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// Function to log with given logger instead of the standard logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// A structure that represent a consumer connected to the broker. It reconnects when the
+// broker is declared dead, until it is closed. It is safe to use from multiple goroutines.
+type Consumer struct {
+	counter     uint64 // used to give every transaction and commit a unique ID
+	options     options
+	readingPort string
+	writingPort string
+
+	mutex   sync.Mutex // guards reader, writer, running and commits
+	reader  *protocol.Conn
+	writer  *protocol.Conn
+	running bool
+	commits map[string]chan error // commits waiting for the broker by ID
+
+	messages  chan Message // messages read but not handled yet
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Function to create the client ID of a consumer that was not given one. The process ID
+// tells where it runs, and the random suffix keeps consumers of the same process apart, as the
+// broker rejects a client ID that is already connected.
+func defaultClientID() string {
+	bytes := make([]byte, 4)
+	rand.Read(bytes)
+	return "consumer-" + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(bytes)
+}
+
+// Function to connect to the broker. It connects to the reading port first, as the broker
+// accepts them in this order, and waits for both handshakes or until ctx is done.
+// The writing port is only needed to reply, it is empty in one-way messaging.
+func Connect(ctx context.Context, readingPort, writingPort string, opts ...Option) (*Consumer, error) {
+	c := &Consumer{
+		options: options{
+			clientID:       defaultClientID(),
+			reconnectDelay: time.Second,
+			concurrency:    1,
+			retries:        2,
+			retryDelay:     time.Second,
+			logger:         log.Default(),
+		},
+		readingPort: readingPort,
+		writingPort: writingPort,
+		messages:    make(chan Message),
+		commits:     make(map[string]chan error),
+		done:        make(chan struct{}),
+	}
+
+	for _, option := range opts {
+		option(&c.options)
+	}
+
+	if c.options.concurrency < 1 {
+		c.options.concurrency = 1
+	}
+
+	reader, err := c.dial(ctx, readingPort)
+	if err != nil {
+		return nil, err
+	}
+	c.reader = reader
+
+	// Both connections have to use the same identity, the one the broker gave the first.
+	c.options.clientID = reader.ClientID()
+
+	c.wg.Add(1)
+	go c.read(reader)
+
+	if writingPort != "" {
+		writer, err := c.dial(ctx, writingPort)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.writer = writer
+
+		c.wg.Add(1)
+		go c.watch(writer)
+	}
+
+	return c, nil
+}
+
+// Function to get client ID the broker knows the consumer by.
+func (c *Consumer) ClientID() string {
+	return c.options.clientID
+}
+
+// Function to dial the broker and do handshake as a consumer. The connection is closed if ctx is done first.
+func (c *Consumer) dial(ctx context.Context, port string) (*protocol.Conn, error) {
+	netConn, err := security.Dial(net.JoinHostPort(c.options.host, port), c.options.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := protocol.NewConn(netConn)
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-c.done:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	hello := protocol.Frame{ClientID: c.options.clientID, Role: protocol.RoleConsumer, Capabilities: protocol.Capabilities,
+		Username: c.options.username, Password: c.options.password, Token: c.options.token}
+
+	_, err = conn.Handshake(hello, c.options.heartbeat)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Function to dial a port again after its connection failed. It keeps dialing until it
+// succeeds or the consumer is closed, then it returns nil.
+func (c *Consumer) redial(port string, old *protocol.Conn, reason error) *protocol.Conn {
+	old.Close()
+	if c.closed() {
+		return nil
+	}
+	c.options.logger.Println("ERROR:", "lost connection to broker:", reason)
+
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(c.options.reconnectDelay):
+		}
+
+		conn, err := c.dial(context.Background(), port)
+		if err == nil {
+			c.options.logger.Println("LOG:", "reconnected to broker on port "+port)
+			return conn
+		}
+		if c.closed() {
+			return nil
+		}
+		c.options.logger.Println("ERROR:", err)
+	}
+}
+
+// Function to watch the writing connection for results of commits and errors the broker sends,
+// and reconnect when it is lost. Commits that wait for the broker then fail with ErrConnectionLost.
+func (c *Consumer) watch(conn *protocol.Conn) {
+	defer c.wg.Done()
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			c.failCommits()
+			if conn = c.redial(c.writingPort, conn, err); conn == nil {
+				return
+			}
+			c.mutex.Lock()
+			c.writer = conn
+			c.mutex.Unlock()
+			continue
+		}
+
+		switch frame.Type {
+		case protocol.AckFrame:
+			c.finishCommit(frame.ID, nil)
+		case protocol.ErrorFrame:
+			if frame.ID == "" || !c.finishCommit(frame.ID, &RejectedError{ID: frame.ID, Code: frame.Code, Reason: frame.Reason}) {
+				c.handleError(errors.New("broker: " + frame.Reason))
+			}
+		}
+	}
+}
+
+// Function to pass the result of a commit to the transaction that waits for it.
+// It returns false if no commit has the ID.
+func (c *Consumer) finishCommit(id string, err error) bool {
+	c.mutex.Lock()
+	result, ok := c.commits[id]
+	delete(c.commits, id)
+	c.mutex.Unlock()
+
+	if ok {
+		result <- err
+	}
+	return ok
+}
+
+// Function to fail all commits that wait for the broker.
+func (c *Consumer) failCommits() {
+	c.mutex.Lock()
+	commits := c.commits
+	c.commits = make(map[string]chan error)
+	c.mutex.Unlock()
+
+	for _, result := range commits {
+		result <- ErrConnectionLost
+	}
+}
+
+// Function to handle an error of a handler or the broker.
+func (c *Consumer) handleError(err error) {
+	if c.options.errorHandler != nil {
+		c.options.errorHandler(err)
+	} else {
+		c.options.logger.Println("ERROR:", err)
+	}
+}
+
+// Function to receive messages and handle them with handler until ctx is done or the consumer
+// is closed. When ctx is done, no new message is handled and it waits for running handlers
+// to finish before it returns. Handlers get a context that is only done when the consumer is closed.
+func (c *Consumer) Run(ctx context.Context, handler Handler) error {
+	c.mutex.Lock()
+	if c.running {
+		c.mutex.Unlock()
+		return ErrRunning
+	}
+	c.running = true
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		c.running = false
+		c.mutex.Unlock()
+	}()
+
+	if c.closed() {
+		return ErrClosed
+	}
+
+	handlerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-handlerCtx.Done():
+		}
+	}()
+
+	// Messages with a key always go to the same worker, so they are handled in order.
+	messages := make(chan Message)
+	keyed := make([]*mailbox, c.options.concurrency)
+	var workers sync.WaitGroup
+	for i := range keyed {
+		keyed[i] = newMailbox()
+		workers.Add(1)
+		go func(own *mailbox) {
+			defer workers.Done()
+			c.work(handlerCtx, handler, messages, own)
+		}(keyed[i])
+	}
+
+	err := c.receive(ctx, messages, keyed)
+	close(messages)
+	for _, own := range keyed {
+		for _, message := range own.close() {
+			c.reject(message, "consumer is stopping")
+		}
+	}
+	workers.Wait()
+
+	return err
+}
+
+// Number of messages that can be parked for one worker. When a mailbox is full, the receive loop
+// waits for its worker, so no more messages are read until it takes one.
+const mailboxSize = 100
+
+// A structure that represent the messages with a key that wait for their worker. The receive
+// loop parks them here instead of waiting while the worker is busy, so messages with other keys
+// and without a key keep going to the other workers. At most mailboxSize messages are parked.
+type mailbox struct {
+	mutex    sync.Mutex // guards messages and closed
+	messages []Message
+	closed   bool
+	ready    chan struct{} // has a value when a message was parked or the mailbox was closed
+	room     chan struct{} // has a value when a message was taken
+}
+
+// Function to create an empty mailbox.
+func newMailbox() *mailbox {
+	return &mailbox{ready: make(chan struct{}, 1), room: make(chan struct{}, 1)}
+}
+
+// Function to park a message for the worker. It returns false if the mailbox is full,
+// then the caller waits for room.
+func (m *mailbox) put(message Message) bool {
+	m.mutex.Lock()
+	if len(m.messages) >= mailboxSize {
+		m.mutex.Unlock()
+		return false
+	}
+	m.messages = append(m.messages, message)
+	m.mutex.Unlock()
+
+	m.signal()
+	return true
+}
+
+// Function to take the first parked message. It returns false if there is none, and whether
+// the mailbox is closed.
+func (m *mailbox) take() (Message, bool, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.messages) == 0 {
+		return Message{}, false, m.closed
+	}
+	message := m.messages[0]
+	m.messages[0] = Message{}
+	m.messages = m.messages[1:]
+
+	select {
+	case m.room <- struct{}{}:
+	default:
+	}
+	return message, true, m.closed
+}
+
+// Function to close the mailbox. It returns the messages that are still parked, the worker
+// does not get them anymore.
+func (m *mailbox) close() []Message {
+	m.mutex.Lock()
+	messages := m.messages
+	m.messages = nil
+	m.closed = true
+	m.mutex.Unlock()
+
+	m.signal()
+	return messages
+}
+
+// Function to wake the worker of the mailbox up.
+func (m *mailbox) signal() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Function to handle messages of a worker. A worker takes messages without a key from the
+// shared channel and messages whose key belongs to it from its own mailbox, until both are closed.
+func (c *Consumer) work(ctx context.Context, handler Handler, shared <-chan Message, own *mailbox) {
+	ready := own.ready
+	for shared != nil || ready != nil {
+		select {
+		case message, ok := <-shared:
+			if !ok {
+				shared = nil
+				continue
+			}
+			c.handle(ctx, handler, message)
+		case <-ready:
+			for {
+				message, ok, closed := own.take()
+				if closed {
+					ready = nil
+				}
+				if !ok {
+					break
+				}
+				c.handle(ctx, handler, message)
+			}
+		}
+	}
+}
+
+// Function to pass received messages to workers until ctx is done or the consumer is closed.
+// Messages without a key go to any free worker, a message with a key is parked for the worker
+// of its key, so a busy worker does not hold up the others. When the mailbox of the worker is full,
+// it waits for the worker like for a free worker.
+func (c *Consumer) receive(ctx context.Context, messages chan<- Message, keyed []*mailbox) error {
+	for {
+		select {
+		case message := <-c.messages:
+			if message.Key != "" {
+				own := keyed[worker(message.Key, len(keyed))]
+				for !own.put(message) {
+					select {
+					case <-own.room:
+					case <-ctx.Done():
+						c.reject(message, "consumer is stopping")
+						return nil
+					case <-c.done:
+						return ErrClosed
+					}
+				}
+				continue
+			}
+
+			select {
+			case messages <- message:
+			case <-ctx.Done():
+				c.reject(message, "consumer is stopping")
+				return nil
+			case <-c.done:
+				return ErrClosed
+			}
+		case <-ctx.Done():
+			return nil
+		case <-c.done:
+			return ErrClosed
+		}
+	}
+}
+
+// Function to get index of the worker that handles messages with given key.
+func worker(key string, workers int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(workers))
+}
+
+// Function to read messages from the reading connection until the consumer is closed.
+// A message waits until Run takes it, so nothing more is read while the consumer is not running.
+// It reconnects when the connection is lost.
+func (c *Consumer) read(conn *protocol.Conn) {
+	defer c.wg.Done()
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			if conn = c.redial(c.readingPort, conn, err); conn == nil {
+				return
+			}
+			c.mutex.Lock()
+			c.reader = conn
+			c.mutex.Unlock()
+			continue
+		}
+
+		switch frame.Type {
+		case protocol.MessageFrame:
+			message := Message{ID: frame.ID, ClientID: frame.ClientID, CorrelationID: frame.CorrelationID,
+				Key: frame.Key, Headers: frame.Headers, Body: frame.Body, Attempt: frame.Attempt, conn: conn, acked: new(int32)}
+			select {
+			case c.messages <- message:
+			case <-c.done:
+				return
+			}
+		case protocol.ErrorFrame:
+			c.handleError(errors.New("broker: " + frame.Reason))
+		}
+	}
+}
+
+// Function to handle a message. The handler is retried when it fails, then the message is
+// rejected or, when it has been delivered too many times, dropped. Messages that the broker
+// does not track are dropped after the last retry.
+func (c *Consumer) handle(ctx context.Context, handler Handler, message Message) {
+	err := handler(ctx, message)
+	for retry := 0; err != nil && retry < c.options.retries; retry++ {
+		select {
+		case <-ctx.Done():
+			c.reject(message, "consumer is closed")
+			return
+		case <-time.After(c.options.retryDelay):
+		}
+		err = handler(ctx, message)
+	}
+
+	if err == nil {
+		if message.acked == nil || atomic.LoadInt32(message.acked) == 0 {
+			c.acknowledge(message)
+		}
+		return
+	}
+
+	c.handleError(errors.New("message " + message.ID + " failed: " + err.Error()))
+
+	if message.ID == "" {
+		return
+	}
+
+	if c.options.maxDeliveries > 0 && message.Attempt >= c.options.maxDeliveries {
+		c.handleError(errors.New("message " + message.ID + " is dropped after " + strconv.Itoa(message.Attempt) + " deliveries"))
+		c.acknowledge(message)
+		return
+	}
+
+	c.reject(message, err.Error())
+}
+
+// Function to acknowledge a message on the connection it was received on. Nothing is sent
+// if that connection is lost, as the broker delivers the message again anyway.
+func (c *Consumer) acknowledge(message Message) {
+	if message.ID == "" || message.conn == nil {
+		return
+	}
+
+	err := message.conn.Ack(message.ID)
+	if err != nil && !c.closed() {
+		c.options.logger.Println("ERROR:", "could not acknowledge message:", err)
+	}
+}
+
+// Function to reject a message so the broker delivers it again. Brokers that do not support
+// rejections deliver it again only when the connection is lost.
+func (c *Consumer) reject(message Message, reason string) {
+	if message.ID == "" || message.conn == nil || !message.conn.HasCapability(protocol.NackCapability) {
+		return
+	}
+
+	err := message.conn.Nack(message.ID, reason)
+	if err != nil && !c.closed() {
+		c.options.logger.Println("ERROR:", "could not reject message:", err)
+	}
+}
+
+// Function to reply to a message on the writing connection. The reply goes to the client
+// of the message and carries its correlation ID.
+func (c *Consumer) Reply(message Message, body string) error {
+	if c.writingPort == "" {
+		return ErrNoReplies
+	}
+	if c.closed() {
+		return ErrClosed
+	}
+
+	c.mutex.Lock()
+	writer := c.writer
+	c.mutex.Unlock()
+
+	err := writer.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ClientID: message.ClientID,
+		CorrelationID: message.CorrelationID, Body: body})
+	if err != nil {
+		return ErrConnectionLost
+	}
+	return nil
+}
+
+// A structure that represent a transaction of a consumer. Messages published and acknowledgments
+// made in it are applied by the broker when it is committed, all of them or none, and dropped when
+// it is aborted. A handler can so consume a message and publish its result in one step.
+// The broker aborts the transaction when the writing connection is lost.
+type Transaction struct {
+	ID       string
+	consumer *Consumer
+	conn     *protocol.Conn // writing connection the transaction was started on
+
+	mutex    sync.Mutex // guards finished and acked
+	finished bool
+	acked    []Message
+}
+
+// Function to start a transaction on the writing connection.
+func (c *Consumer) Begin() (*Transaction, error) {
+	if c.writingPort == "" {
+		return nil, ErrNoReplies
+	}
+	if c.closed() {
+		return nil, ErrClosed
+	}
+
+	c.mutex.Lock()
+	conn := c.writer
+	c.mutex.Unlock()
+
+	if !conn.HasCapability(protocol.TransactionCapability) || !conn.HasCapability(protocol.ConfirmCapability) {
+		return nil, ErrNoTransactions
+	}
+
+	t := &Transaction{ID: strconv.FormatUint(atomic.AddUint64(&c.counter, 1), 10), consumer: c, conn: conn}
+	if err := conn.WriteFrame(protocol.Frame{Type: protocol.BeginFrame, Transaction: t.ID}); err != nil {
+		return nil, ErrConnectionLost
+	}
+	return t, nil
+}
+
+// Function to write a frame of the transaction unless it is finished.
+func (t *Transaction) write(frame protocol.Frame) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.finished {
+		return ErrFinished
+	}
+
+	frame.Transaction = t.ID
+	if err := t.conn.WriteFrame(frame); err != nil {
+		return ErrConnectionLost
+	}
+	return nil
+}
+
+// Function to publish a message to a queue in the transaction. An empty queue is the queue
+// the consumer replies to, any other queue has to exist.
+func (t *Transaction) Publish(queue, body string) error {
+	return t.write(protocol.Frame{Type: protocol.MessageFrame, Queue: queue, Body: body})
+}
+
+// Function to reply to a message in the transaction. The reply goes to the client of the message
+// when the transaction is committed.
+func (t *Transaction) Reply(message Message, body string) error {
+	return t.write(protocol.Frame{Type: protocol.MessageFrame, ClientID: message.ClientID,
+		CorrelationID: message.CorrelationID, Body: body})
+}
+
+// Function to acknowledge a message in the transaction. The broker forgets the message when the
+// transaction is committed, and then the handler of the message does not acknowledge it again.
+// Messages the broker does not track need no acknowledgment.
+func (t *Transaction) Ack(message Message) error {
+	if message.ID == "" {
+		return nil
+	}
+
+	err := t.write(protocol.Frame{Type: protocol.AckFrame, ID: message.ID})
+	if err == nil {
+		t.mutex.Lock()
+		t.acked = append(t.acked, message)
+		t.mutex.Unlock()
+	}
+	return err
+}
+
+// Function to commit the transaction and wait until the broker applied it or ctx is done.
+// If anything in it cannot be applied, for example a queue is full or an acknowledged message
+// was delivered again meanwhile, nothing is and it fails with a *RejectedError.
+func (t *Transaction) Commit(ctx context.Context) error {
+	c := t.consumer
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.finished {
+		return ErrFinished
+	}
+	t.finished = true
+
+	frame := protocol.Frame{Type: protocol.CommitFrame, ID: strconv.FormatUint(atomic.AddUint64(&c.counter, 1), 10), Transaction: t.ID}
+	result := make(chan error, 1)
+
+	c.mutex.Lock()
+	if c.writer != t.conn {
+		c.mutex.Unlock()
+		return ErrConnectionLost
+	}
+	c.commits[frame.ID] = result
+	c.mutex.Unlock()
+
+	if err := t.conn.WriteFrame(frame); err != nil {
+		c.finishCommit(frame.ID, ErrConnectionLost)
+	}
+
+	select {
+	case err := <-result:
+		if err == nil {
+			for _, message := range t.acked {
+				if message.acked != nil {
+					atomic.StoreInt32(message.acked, 1)
+				}
+			}
+		}
+		return err
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(c.commits, frame.ID)
+		c.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Function to abort the transaction, so nothing of it is applied. Messages it acknowledged
+// stay in flight and are acknowledged or rejected by their handlers as usual.
+func (t *Transaction) Abort() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.finished {
+		return ErrFinished
+	}
+	t.finished = true
+
+	// The broker aborts the transaction anyway if the connection is lost.
+	t.conn.WriteFrame(protocol.Frame{Type: protocol.AbortFrame, Transaction: t.ID})
+	return nil
+}
+
+// Function to check whether the consumer is closed.
+func (c *Consumer) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Function to close the consumer. Running handlers get a done context and messages that are
+// not acknowledged yet are delivered again by the broker.
+func (c *Consumer) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.mutex.Lock()
+		reader, writer := c.reader, c.writer
+		c.mutex.Unlock()
+
+		reader.Close()
+		if writer != nil {
+			writer.Close()
+		}
+	})
+
+	c.wg.Wait()
+
+	return nil
+}
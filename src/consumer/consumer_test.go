@@ -0,0 +1,451 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/protocol"
+)
+
+// Function to listen on a free port like the broker does and pass every connection that
+// completes handshake to the returned channel. Listener and connections are closed when the test ends.
+func listen(t *testing.T) (string, <-chan *protocol.Conn) {
+	t.Helper()
+
+	return listenOn(t, "")
+}
+
+// Function to listen like listen does, on the given host only.
+func listenOn(t *testing.T, host string) (string, <-chan *protocol.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make(chan *protocol.Conn, 10)
+	var mutex sync.Mutex
+	accepted := make([]*protocol.Conn, 0)
+	t.Cleanup(func() {
+		listener.Close()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range accepted {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn := protocol.NewConn(netConn)
+			if _, err := conn.AcceptHandshake(0, nil); err != nil {
+				conn.Close()
+				continue
+			}
+			mutex.Lock()
+			accepted = append(accepted, conn)
+			mutex.Unlock()
+			conns <- conn
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port, conns
+}
+
+// Function to connect a consumer that only reads and get the connection the broker accepted.
+func connectReader(t *testing.T, opts ...Option) (*Consumer, *protocol.Conn) {
+	t.Helper()
+
+	port, conns := listen(t)
+
+	opts = append([]Option{WithClientID("consumer-test"), WithRetries(0, 0), WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	c, err := Connect(context.Background(), port, "", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c, <-conns
+}
+
+// Function to run a consumer in the background until the test ends.
+func run(t *testing.T, c *Consumer, handler Handler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		c.Run(ctx, handler)
+		close(finished)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-finished
+	})
+}
+
+// Function to check which frame the consumer answers a delivery with, depending on how
+// its handler does and on the delivery attempt.
+func TestHandle(t *testing.T) {
+	failing := errors.New("handler failed")
+
+	tests := []struct {
+		name     string
+		options  []Option
+		attempt  int
+		failures int // number of calls of the handler that fail before it succeeds
+		expects  protocol.Frame
+		calls    int
+	}{
+		{"handled", nil, 1, 0, protocol.Frame{Type: protocol.AckFrame, ID: "1"}, 1},
+		{"failed", nil, 1, 10, protocol.Frame{Type: protocol.NackFrame, ID: "1", Reason: "handler failed"}, 1},
+		{"handled on retry", []Option{WithRetries(2, time.Millisecond)}, 1, 1, protocol.Frame{Type: protocol.AckFrame, ID: "1"}, 2},
+		{"failed every retry", []Option{WithRetries(2, time.Millisecond)}, 1, 10,
+			protocol.Frame{Type: protocol.NackFrame, ID: "1", Reason: "handler failed"}, 3},
+		{"failed often without max deliveries", nil, 10, 10,
+			protocol.Frame{Type: protocol.NackFrame, ID: "1", Reason: "handler failed"}, 1},
+		{"failed before max deliveries", []Option{WithMaxDeliveries(2)}, 1, 10,
+			protocol.Frame{Type: protocol.NackFrame, ID: "1", Reason: "handler failed"}, 1},
+		{"failed at max deliveries", []Option{WithMaxDeliveries(2)}, 2, 10, protocol.Frame{Type: protocol.AckFrame, ID: "1"}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := make(chan error, 10)
+			c, conn := connectReader(t, append(test.options, WithErrorHandler(func(err error) { errs <- err }))...)
+
+			var calls int32
+			run(t, c, func(ctx context.Context, message Message) error {
+				call := atomic.AddInt32(&calls, 1)
+				if message.Attempt != test.attempt || message.Body != "hello" {
+					t.Errorf("message = %+v", message)
+				}
+				if int(call) <= test.failures {
+					return failing
+				}
+				return nil
+			})
+
+			conn.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ID: "1", Body: "hello", Attempt: test.attempt})
+
+			frame, err := conn.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(frame, test.expects) {
+				t.Errorf("frame = %+v, expected %+v", frame, test.expects)
+			}
+			if calls := int(atomic.LoadInt32(&calls)); calls != test.calls {
+				t.Errorf("handler is called %d times, expected %d", calls, test.calls)
+			}
+			if test.failures >= test.calls && len(errs) == 0 {
+				t.Error("failure is not reported to the error handler")
+			}
+		})
+	}
+}
+
+// Function to check that messages are handled one after another in the order they are received
+// without concurrency, and that concurrent workers handle them at the same time.
+func TestConcurrency(t *testing.T) {
+	tests := []struct {
+		concurrency int
+		expects     int // highest number of handlers running at the same time
+	}{
+		{1, 1},
+		{3, 3},
+	}
+
+	for _, test := range tests {
+		c, conn := connectReader(t, WithConcurrency(test.concurrency))
+
+		var mutex sync.Mutex
+		running, highest := 0, 0
+		order := make([]string, 0)
+		run(t, c, func(ctx context.Context, message Message) error {
+			mutex.Lock()
+			running++
+			if running > highest {
+				highest = running
+			}
+			order = append(order, message.ID)
+			mutex.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			return nil
+		})
+
+		for _, id := range []string{"1", "2", "3"} {
+			conn.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ID: id, Body: "hello"})
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := conn.ReadFrame(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		mutex.Lock()
+		if highest != test.expects {
+			t.Errorf("concurrency %d: %d handlers run at the same time, expected %d", test.concurrency, highest, test.expects)
+		}
+		if test.concurrency == 1 && (order[0] != "1" || order[1] != "2" || order[2] != "3") {
+			t.Errorf("messages are handled in order %v", order)
+		}
+		mutex.Unlock()
+	}
+}
+
+// Function to check that a reply is written on the writing connection to the client of the
+// message, and that a consumer without writing port cannot reply.
+func TestReply(t *testing.T) {
+	readingPort, readers := listen(t)
+	writingPort, writers := listen(t)
+
+	c, err := Connect(context.Background(), readingPort, writingPort, WithClientID("server"), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-readers
+	writer := <-writers
+
+	err = c.Reply(Message{ID: "4", ClientID: "client-0", CorrelationID: "7", Body: "question"}, "answer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := writer.ReadFrame()
+	expects := protocol.Frame{Type: protocol.MessageFrame, ClientID: "client-0", CorrelationID: "7", Body: "answer"}
+	if err != nil || !reflect.DeepEqual(frame, expects) {
+		t.Errorf("reply = %+v, %v, expected %+v", frame, err, expects)
+	}
+
+	oneWay, _ := connectReader(t)
+	if err := oneWay.Reply(Message{ClientID: "client-0"}, "answer"); err != ErrNoReplies {
+		t.Errorf("err = %v, expected ErrNoReplies", err)
+	}
+}
+
+// Function to check that a consumer runs only once at a time and not after it is closed.
+func TestRun(t *testing.T) {
+	c, _ := connectReader(t)
+	handler := func(ctx context.Context, message Message) error { return nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan error, 1)
+	go func() { finished <- c.Run(ctx, handler) }()
+
+	time.Sleep(20 * time.Millisecond)
+	if err := c.Run(context.Background(), handler); err != ErrRunning {
+		t.Errorf("second run err = %v, expected ErrRunning", err)
+	}
+
+	cancel()
+	if err := <-finished; err != nil {
+		t.Errorf("run err = %v after its context is done", err)
+	}
+
+	c.Close()
+	if err := c.Run(context.Background(), handler); err != ErrClosed {
+		t.Errorf("run after close err = %v, expected ErrClosed", err)
+	}
+}
+
+// Function to check that concurrent workers handle messages with the same key one at a time
+// in the order they are received.
+func TestKeyedOrder(t *testing.T) {
+	c, conn := connectReader(t, WithConcurrency(4))
+
+	var mutex sync.Mutex
+	running := make(map[string]bool)
+	order := make(map[string][]string)
+	run(t, c, func(ctx context.Context, message Message) error {
+		mutex.Lock()
+		if running[message.Key] {
+			t.Errorf("two messages with key %s are handled at the same time", message.Key)
+		}
+		running[message.Key] = true
+		order[message.Key] = append(order[message.Key], message.Body)
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		running[message.Key] = false
+		mutex.Unlock()
+		return nil
+	})
+
+	bodies := []string{"1", "2", "3", "4", "5"}
+	for _, body := range bodies {
+		for _, key := range []string{"a", "b"} {
+			conn.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ID: key + body, Key: key, Body: body})
+		}
+	}
+	for i := 0; i < 2*len(bodies); i++ {
+		if _, err := conn.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, key := range []string{"a", "b"} {
+		if !reflect.DeepEqual(order[key], bodies) {
+			t.Errorf("messages with key %s are handled in order %v", key, order[key])
+		}
+	}
+}
+
+// Function to check that messages waiting for a busy key do not hold up messages with other keys.
+func TestBusyKey(t *testing.T) {
+	c, conn := connectReader(t, WithConcurrency(2))
+
+	release := make(chan struct{})
+	handled := make(chan string, 10)
+	run(t, c, func(ctx context.Context, message Message) error {
+		if message.Key == "busy" {
+			<-release
+		}
+		handled <- message.Key + message.Body
+		return nil
+	})
+
+	for _, body := range []string{"1", "2", "3"} {
+		conn.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ID: "busy" + body, Key: "busy", Body: body})
+	}
+	conn.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ID: "other", Key: "other", Body: "1"})
+
+	select {
+	case key := <-handled:
+		if key != "other1" {
+			t.Errorf("%s is handled first, expected other1", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message with another key waits for the busy key")
+	}
+
+	close(release)
+	for _, expects := range []string{"busy1", "busy2", "busy3"} {
+		if key := <-handled; key != expects {
+			t.Errorf("%s is handled, expected %s", key, expects)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := conn.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Function to check that messages are parked for a busy worker only until its mailbox is full,
+// then no more messages are taken until the worker takes one.
+func TestFullMailbox(t *testing.T) {
+	c := &Consumer{messages: make(chan Message), done: make(chan struct{})}
+	own := newMailbox()
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan error, 1)
+	go func() { received <- c.receive(ctx, nil, []*mailbox{own}) }()
+
+	for i := 0; i < mailboxSize; i++ {
+		select {
+		case c.messages <- Message{Key: "busy", Body: strconv.Itoa(i)}:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d is not taken while the mailbox has room", i)
+		}
+	}
+
+	// The next message is taken, and held until there is room for it.
+	select {
+	case c.messages <- Message{Key: "busy", Body: "held"}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiving stops before the mailbox is full")
+	}
+	select {
+	case c.messages <- Message{Key: "busy", Body: "over"}:
+		t.Fatal("message is taken while the mailbox is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if message, ok, _ := own.take(); !ok || message.Body != "0" {
+		t.Fatalf("worker takes %+v, expected the first message", message)
+	}
+	select {
+	case c.messages <- Message{Key: "busy", Body: "over"}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not taken after the worker took one")
+	}
+
+	cancel()
+	if err := <-received; err != nil {
+		t.Errorf("receiving ends with %v", err)
+	}
+	if parked := own.close(); len(parked) != mailboxSize || parked[mailboxSize-1].Body != "held" {
+		t.Errorf("%d messages are parked, the last is %+v, expected %d with the held one last",
+			len(parked), parked[len(parked)-1], mailboxSize)
+	}
+}
+
+// Function to check that two consumers of one process without a client ID are told apart by the broker.
+func TestDefaultClientID(t *testing.T) {
+	port, conns := listen(t)
+
+	prefix := "consumer-" + strconv.Itoa(os.Getpid()) + "-"
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		c, err := Connect(context.Background(), port, "", WithLogger(log.New(io.Discard, "", 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		clientID := (<-conns).ClientID()
+		if !strings.HasPrefix(clientID, prefix) || len(clientID) != len(prefix)+8 || seen[clientID] {
+			t.Errorf("consumer %d has client ID %s, expected a new one like %s<random>", i, clientID, prefix)
+		}
+		seen[clientID] = true
+	}
+}
+
+// Function to check that a consumer dials its ports on the host given with WithAddress,
+// and on the local machine without it.
+func TestAddress(t *testing.T) {
+	port, conns := listenOn(t, "127.0.0.2")
+	logger := WithLogger(log.New(io.Discard, "", 0))
+
+	if _, err := Connect(context.Background(), port, "", logger); err == nil {
+		t.Fatal("consumer without address connects to a broker on another host")
+	}
+
+	c, err := Connect(context.Background(), port, "", WithAddress("127.0.0.2"), WithRetries(0, 0), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := <-conns
+
+	run(t, c, func(ctx context.Context, message Message) error { return nil })
+	conn.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ID: "1", Body: "hello", Attempt: 1})
+	if frame, err := conn.ReadFrame(); err != nil || frame.Type != protocol.AckFrame {
+		t.Errorf("broker received %+v, %v, expected ack", frame, err)
+	}
+}
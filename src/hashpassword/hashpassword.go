@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"distributed-systems-message-queue/src/auth"
+)
+
+// Function to get a secret from standard input.
+func getSecret(kind string) string {
+	fmt.Print("Enter " + kind + ": ")
+	secret, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	return strings.TrimSpace(secret)
+}
+
+// Function to hash a secret for the users file based on its kind that can be password or token.
+func hashSecret(kind, secret string) (string, error) {
+	switch kind {
+	case "password":
+		return auth.HashPassword(secret)
+	case "token":
+		return auth.HashToken(secret), nil
+	default:
+		return "", errors.New("error: kind does not exist. please provide <password|token>")
+	}
+}
+
+// Function to handle error.
+// If there is an error it will be logged.
+func handleError(err error) {
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Function to check number of command line arguments.
+func checkCommandLineArguments() error {
+	arguments := os.Args
+
+	if len(arguments) < 2 {
+		return errors.New(`error: too few arguments. please provide <password|token>`)
+	} else if len(arguments) > 2 {
+		return errors.New(`error: too many arguments. please provide <password|token>`)
+	} else if arguments[1] != "password" && arguments[1] != "token" {
+		return errors.New(`error: kind does not exist. please provide <password|token>`)
+	}
+
+	return nil
+}
+
+func main() {
+	err := checkCommandLineArguments()
+
+	handleError(err)
+
+	kind := os.Args[1]
+
+	hashed, err := hashSecret(kind, getSecret(kind))
+
+	handleError(err)
+
+	fmt.Println(hashed)
+}
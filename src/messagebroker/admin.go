@@ -0,0 +1,84 @@
+package messagebroker
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/protocol"
+)
+
+// Function to serve admin peers. Each admin peer can send commands until it closes its connection.
+func (b *Broker) serveAdmin(listener net.Listener) {
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			if b.stopped() {
+				return
+			}
+			b.logger.Println("ERROR:", "admin:", err)
+			continue
+		}
+
+		b.spawn(func() { b.handleAdmin(netConn) })
+	}
+}
+
+// Function to handle commands of an admin peer. When authentication is enabled, the user
+// needs the admin action on every queue, that is a permission for the queue pattern "*".
+func (b *Broker) handleAdmin(netConn net.Conn) {
+	conn, err := b.handshake(netConn, protocol.RoleAdmin, nil)
+	if err != nil {
+		b.logger.Println("ERROR:", "admin:", err)
+		return
+	}
+	defer conn.Close()
+
+	stop := b.closeOnStop(conn)
+	defer stop()
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			return
+		}
+		if frame.Type != protocol.CommandFrame {
+			continue
+		}
+
+		result, err := b.runCommand(conn, frame.Body)
+		if err != nil {
+			b.logger.Println("ERROR:", "admin "+conn.ClientID()+":", err)
+			err = conn.WriteFrame(protocol.Frame{Type: protocol.ErrorFrame, ID: frame.ID, Reason: err.Error()})
+		} else {
+			err = conn.WriteFrame(protocol.Frame{Type: protocol.ResultFrame, ID: frame.ID, Body: result})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Function to run an admin command and get its result.
+func (b *Broker) runCommand(conn *protocol.Conn, command string) (string, error) {
+	if b.users != nil && !b.users.Allowed(conn.Username(), auth.Admin, "*") {
+		return "", errors.New("user " + conn.Username() + " is not permitted to run admin commands")
+	}
+
+	b.logger.Println("LOG:", "admin "+conn.ClientID()+" runs "+command)
+
+	switch command {
+	case "reload":
+		restartRequired, err := b.Reload()
+		if err != nil {
+			return "", err
+		}
+		if len(restartRequired) > 0 {
+			return "configuration is reloaded, restart is required for " + strings.Join(restartRequired, ", "), nil
+		}
+		return "configuration is reloaded", nil
+	default:
+		return "", errors.New("command " + command + " does not exist")
+	}
+}
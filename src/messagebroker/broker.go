@@ -0,0 +1,585 @@
+// Package messagebroker is the message broker as a library, so a broker can be started inside
+// other programs and integration tests. The broker binary in src/broker is a thin wrapper around it.
+package messagebroker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+	"distributed-systems-message-queue/src/security"
+)
+
+// Name of the queue responses of the server are enqueued to in multi-way messaging.
+const responsesQueue = "responses"
+
+// Errors returned by the broker.
+var (
+	ErrStopped        = errors.New("broker is stopped")
+	ErrAlreadyStarted = errors.New("broker is already started")
+	ErrQueueExists    = errors.New("queue already exists")
+	ErrQueueNotFound  = errors.New("queue does not exist")
+	ErrQueueInUse     = errors.New("queue is used by clients or server")
+)
+
+// A function that changes an option of a broker created by New.
+type Option func(b *Broker)
+
+// Function to log with given logger instead of the standard logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(b *Broker) {
+		b.logger = logger
+	}
+}
+
+// Function to use given TLS configuration for listeners instead of the one in configuration.
+// Listeners use plain TCP when it is nil.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(b *Broker) {
+		b.tlsConfig = tlsConfig
+	}
+}
+
+// Function to use given users instead of the users file in configuration.
+// Authentication is disabled when it is nil.
+func WithUsers(users *auth.Users) Option {
+	return func(b *Broker) {
+		b.users = users
+	}
+}
+
+// Function to set how configuration is loaded again when the broker is reloaded.
+// Without it, the broker cannot be reloaded.
+func WithConfigLoader(load func() (config.Broker, error)) Option {
+	return func(b *Broker) {
+		b.loadSettings = load
+	}
+}
+
+// A structure that represent state of a queue.
+type QueueInfo struct {
+	Name     string `json:"name"`
+	Size     int    `json:"size"`
+	Capacity int    `json:"capacity"`
+}
+
+// A structure that represent a message broker. It is created by New, runs from Start
+// until Shutdown is called, the context given to Start is done or a queue overflows
+// with the exit policy.
+type Broker struct {
+	deliveryCounter uint64 // used to give every delivered message a unique ID
+
+	settingsMutex sync.RWMutex
+	settings      config.Broker
+	loadSettings  func() (config.Broker, error)
+
+	queuesMutex sync.Mutex
+	queues      map[string]*queueingSystem.Queue // clients that are configured with the same queue share it
+
+	tlsConfig      *tls.Config // listeners use plain TCP when it is nil
+	users          *auth.Users // authentication is disabled when it is nil
+	logger         *log.Logger
+	clients        *registry
+	keys           *keyLocks
+	dedup          *deduplicator
+	requests       *requests
+	leases         *leases
+	dispatcher     *dispatcher
+	deliveryLimits *deliveryLimits
+	gatewayLimits  *gatewayLimits
+
+	stateMutex       sync.Mutex // guards started, err and listeners
+	started          bool
+	err              error
+	links            []*link
+	serverReadLink   *link
+	serverWriteLink  *link
+	clientReadLinks  []*link
+	clientWriteLinks []*link
+	adminListener    net.Listener
+	httpServer       *http.Server
+
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Function to create a broker from configuration. The configuration is validated, and TLS
+// configuration and users are loaded from it unless options give them. Declared queues are created.
+func New(settings config.Broker, options ...Option) (*Broker, error) {
+	err := settings.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broker{
+		settings:       settings,
+		queues:         make(map[string]*queueingSystem.Queue),
+		logger:         log.Default(),
+		clients:        newRegistry(),
+		keys:           newKeyLocks(),
+		dedup:          newDeduplicator(),
+		requests:       newRequests(),
+		leases:         newLeases(),
+		deliveryLimits: newDeliveryLimits(),
+		gatewayLimits:  newGatewayLimits(),
+		done:           make(chan struct{}),
+	}
+
+	b.tlsConfig, err = loadTLSConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	b.users, err = loadUsers(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	b.dispatcher = newDispatcher(b.Settings)
+
+	for _, option := range options {
+		option(b)
+	}
+
+	b.createQueues()
+
+	return b, nil
+}
+
+// Function to start the broker. Listeners of server, clients, admin port and HTTP port are created before
+// it returns, so a port that cannot be used is reported here. Peers are accepted and messages
+// are passed in the background until the broker is stopped.
+func (b *Broker) Start(ctx context.Context) error {
+	b.stateMutex.Lock()
+	if b.started {
+		b.stateMutex.Unlock()
+		return ErrAlreadyStarted
+	}
+	b.started = true
+	b.stateMutex.Unlock()
+
+	if b.stopped() {
+		return ErrStopped
+	}
+
+	err := b.createListeners()
+	if err != nil {
+		b.stop(nil)
+		return err
+	}
+
+	b.spawn(b.handleMessagePassing)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.stop(nil)
+		case <-b.done:
+		}
+	}()
+
+	return nil
+}
+
+// Function to create listeners of all links, of the admin port and of the HTTP port.
+func (b *Broker) createListeners() error {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+
+	current := b.Settings()
+
+	var err error
+	b.serverReadLink, err = b.listen("server", protocol.RoleConsumer, true, current.Server.ReadingPort)
+	if err != nil {
+		return err
+	}
+
+	if current.Messaging == "multi" {
+		b.serverWriteLink, err = b.listen("server", protocol.RoleConsumer, false, current.Server.WritingPort)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, client := range current.Clients {
+		peer := "client"
+		if current.Messaging == "multi" && current.Mode == "async" {
+			peer = "client " + strconv.Itoa(i)
+		}
+
+		readLink, err := b.listen(peer, protocol.RoleProducer, true, client.ReadingPort)
+		if err != nil {
+			return err
+		}
+		b.clientReadLinks = append(b.clientReadLinks, readLink)
+
+		writeLink, err := b.listen(peer, protocol.RoleProducer, false, client.WritingPort)
+		if err != nil {
+			return err
+		}
+		writeLink.client = i
+		b.clientWriteLinks = append(b.clientWriteLinks, writeLink)
+	}
+
+	if current.AdminPort != "" {
+		b.adminListener, err = security.Listen(current.AdminPort, b.tlsConfig)
+		if err != nil {
+			return err
+		}
+		listener := b.adminListener
+		b.spawn(func() { b.serveAdmin(listener) })
+	}
+
+	if current.HTTPPort != "" {
+		listener, err := security.Listen(current.HTTPPort, b.tlsConfig)
+		if err != nil {
+			return err
+		}
+		b.httpServer = &http.Server{Handler: b.gateway(), ErrorLog: b.logger}
+		server := b.httpServer
+		b.spawn(func() { b.serveHTTP(server, listener) })
+	}
+
+	return nil
+}
+
+// Function to stop the broker and wait until its goroutines finish or ctx is done.
+// Listeners and connections are closed, messages in queues are kept.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.stop(nil)
+
+	finished := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Function to get a channel that is closed when the broker stops.
+func (b *Broker) Done() <-chan struct{} {
+	return b.done
+}
+
+// Function to get the error that stopped the broker, if it did not stop normally.
+func (b *Broker) Err() error {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+
+	return b.err
+}
+
+// Function to stop the broker with an error.
+func (b *Broker) fail(err error) {
+	if err == ErrStopped || b.stopped() {
+		return
+	}
+
+	b.logger.Println("ERROR:", err)
+	b.stop(err)
+}
+
+// Function to mark the broker as stopped and close all listeners and connections, only once.
+func (b *Broker) stop(err error) {
+	b.stopOnce.Do(func() {
+		close(b.done)
+
+		b.stateMutex.Lock()
+		defer b.stateMutex.Unlock()
+
+		b.err = err
+		for _, l := range b.links {
+			l.close()
+		}
+		if b.adminListener != nil {
+			b.adminListener.Close()
+		}
+		if b.httpServer != nil {
+			b.httpServer.Close()
+		}
+	})
+}
+
+// Function to check whether the broker is stopped.
+func (b *Broker) stopped() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Function to wait for a duration. It returns false if the broker stopped first.
+func (b *Broker) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-b.done:
+		return false
+	}
+}
+
+// Function to run a function in a goroutine that Shutdown waits for.
+func (b *Broker) spawn(function func()) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		function()
+	}()
+}
+
+// Function to close a connection when the broker stops. The returned function stops watching.
+func (b *Broker) closeOnStop(closer io.Closer) func() {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-b.done:
+			closer.Close()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+// Function to get current configuration.
+func (b *Broker) Settings() config.Broker {
+	b.settingsMutex.RLock()
+	defer b.settingsMutex.RUnlock()
+
+	return b.settings
+}
+
+// Function to reload configuration with the config loader. Users are loaded first, so nothing
+// is changed if the users file is not valid. Then queues are created and queues whose configured
+// capacity changed are resized, and new overflow policies, timeouts and prefetch limit are used. Connections and
+// queued messages are kept. It returns settings that have changed but need a restart, those keep
+// their current values.
+func (b *Broker) Reload() ([]string, error) {
+	if b.loadSettings == nil {
+		return nil, errors.New("broker was not started with a config file")
+	}
+
+	next, err := b.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	current := b.Settings()
+	next, restartRequired := current.Reload(next)
+
+	if b.users != nil && next.UsersFile != "" {
+		err = b.users.Load(next.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.settingsMutex.Lock()
+	b.settings = next
+	b.settingsMutex.Unlock()
+
+	b.createQueues()
+
+	b.queuesMutex.Lock()
+	for name, queue := range b.queues {
+		capacity := next.Queue(name).Capacity
+		if capacity != current.Queue(name).Capacity {
+			queue.SetCapacity(capacity)
+			b.logger.Println("LOG:", "queue "+name+" capacity is changed to", capacity)
+		}
+	}
+	b.queuesMutex.Unlock()
+
+	// Permissions and the prefetch limit may have changed, so delivery loops look again.
+	b.stateMutex.Lock()
+	for _, l := range b.links {
+		l.freed()
+	}
+	b.stateMutex.Unlock()
+	b.dispatcher.notifyAll()
+
+	for _, setting := range restartRequired {
+		b.logger.Println("LOG:", setting+" has changed and requires a restart")
+	}
+	b.logger.Println("LOG:", "configuration is reloaded")
+
+	return restartRequired, nil
+}
+
+// Function to create queues that are declared in configuration but do not exist yet.
+func (b *Broker) createQueues() {
+	for _, queue := range b.Settings().Queues {
+		b.getQueue(queue.Name)
+	}
+}
+
+// Function to get a queue by name. The queue is created with its configured capacity the first time.
+func (b *Broker) getQueue(name string) *queueingSystem.Queue {
+	b.queuesMutex.Lock()
+	defer b.queuesMutex.Unlock()
+
+	queue, ok := b.queues[name]
+	if !ok {
+		queue = queueingSystem.CreateQueue(name, b.Settings().Queue(name).Capacity)
+		b.queues[name] = queue
+	}
+	return queue
+}
+
+// Function to get a queue by name if it exists.
+func (b *Broker) findQueue(name string) (*queueingSystem.Queue, bool) {
+	b.queuesMutex.Lock()
+	defer b.queuesMutex.Unlock()
+
+	queue, ok := b.queues[name]
+	return queue, ok
+}
+
+// Function to check whether clients or server of current messaging mode use a queue.
+func (b *Broker) queueInUse(name string) bool {
+	current := b.Settings()
+
+	if current.Messaging == "multi" && name == responsesQueue {
+		return true
+	}
+	for i := range current.Clients {
+		if current.ClientQueue(i) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to create a queue with given capacity.
+func (b *Broker) CreateQueue(name string, capacity int) error {
+	if name == "" {
+		return errors.New("queue name is required")
+	}
+	if capacity <= 0 {
+		return errors.New("queue capacity should be positive")
+	}
+
+	b.queuesMutex.Lock()
+	defer b.queuesMutex.Unlock()
+
+	if _, ok := b.queues[name]; ok {
+		return ErrQueueExists
+	}
+
+	b.queues[name] = queueingSystem.CreateQueue(name, capacity)
+	b.logger.Println("LOG:", "queue "+name+" is created")
+	return nil
+}
+
+// Function to delete a queue with the messages in it. Queues used by clients or server cannot be deleted.
+func (b *Broker) DeleteQueue(name string) error {
+	if b.queueInUse(name) {
+		return ErrQueueInUse
+	}
+
+	b.queuesMutex.Lock()
+	defer b.queuesMutex.Unlock()
+
+	queue, ok := b.queues[name]
+	if !ok {
+		return ErrQueueNotFound
+	}
+
+	delete(b.queues, name)
+	b.forgetDedup(queue)
+	b.deliveryLimits.forget(queue)
+	b.logger.Println("LOG:", "queue "+name+" is deleted")
+	return nil
+}
+
+// Function to change capacity of a queue. Messages in the queue are kept.
+func (b *Broker) SetQueueCapacity(name string, capacity int) error {
+	if capacity <= 0 {
+		return errors.New("queue capacity should be positive")
+	}
+
+	b.queuesMutex.Lock()
+	defer b.queuesMutex.Unlock()
+
+	queue, ok := b.queues[name]
+	if !ok {
+		return ErrQueueNotFound
+	}
+
+	queue.SetCapacity(capacity)
+	b.logger.Println("LOG:", "queue "+name+" capacity is changed to", capacity)
+	return nil
+}
+
+// Function to get state of a queue.
+func (b *Broker) Queue(name string) (QueueInfo, error) {
+	b.queuesMutex.Lock()
+	defer b.queuesMutex.Unlock()
+
+	queue, ok := b.queues[name]
+	if !ok {
+		return QueueInfo{}, ErrQueueNotFound
+	}
+
+	return QueueInfo{Name: name, Size: queue.GetSize(), Capacity: queue.GetCapacity()}, nil
+}
+
+// Function to get state of all queues sorted by name.
+func (b *Broker) Queues() []QueueInfo {
+	b.queuesMutex.Lock()
+	defer b.queuesMutex.Unlock()
+
+	result := make([]QueueInfo, 0, len(b.queues))
+	for name, queue := range b.queues {
+		result = append(result, QueueInfo{Name: name, Size: queue.GetSize(), Capacity: queue.GetCapacity()})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Function to load TLS configuration of the listeners.
+func loadTLSConfig(settings config.Broker) (*tls.Config, error) {
+	tlsSettings := security.TLSSettings{
+		Enabled:    settings.TLS.Enabled,
+		CertFile:   settings.TLS.Cert,
+		KeyFile:    settings.TLS.Key,
+		CAFile:     settings.TLS.CA,
+		ClientAuth: settings.TLS.ClientAuth,
+	}
+
+	return tlsSettings.ServerConfig()
+}
+
+// Function to load users from the configured users file.
+// It returns nil when no users file is configured.
+func loadUsers(settings config.Broker) (*auth.Users, error) {
+	if settings.UsersFile == "" {
+		return nil, nil
+	}
+
+	return auth.LoadUsers(settings.UsersFile)
+}
@@ -0,0 +1,284 @@
+package messagebroker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/protocol"
+	"distributed-systems-message-queue/src/security"
+)
+
+// Function to create a broker for one-way messaging that is not started, with settings changed by edit.
+func newTestBroker(t *testing.T, edit func(settings *config.Broker)) *Broker {
+	t.Helper()
+
+	settings := config.Default()
+	settings.Messaging = "one"
+	settings.Server = config.Listener{ReadingPort: "9001"}
+	settings.Clients = []config.Client{{Listener: config.Listener{ReadingPort: "9003", WritingPort: "9004"}}}
+	if edit != nil {
+		edit(&settings)
+	}
+
+	b, err := New(settings, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Function to get a port no one listens on.
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Function to create a broker on free ports and start it. It is shut down when the test ends.
+func startTestBroker(t *testing.T, edit func(settings *config.Broker), options ...Option) *Broker {
+	t.Helper()
+
+	b := newTestBroker(t, func(settings *config.Broker) {
+		settings.Server.ReadingPort = freePort(t)
+		settings.Clients[0].ReadingPort, settings.Clients[0].WritingPort = freePort(t), freePort(t)
+		if edit != nil {
+			edit(settings)
+		}
+	})
+	for _, option := range options {
+		option(b)
+	}
+
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.Shutdown(ctx); err != nil {
+			t.Error("broker does not shut down:", err)
+		}
+	})
+	return b
+}
+
+// Function to check that a broker is not created from a configuration that is not valid.
+func TestNewInvalid(t *testing.T) {
+	settings := config.Default()
+	settings.Messaging = "two"
+
+	if _, err := New(settings); err == nil {
+		t.Error("broker is created from configuration that is not valid")
+	}
+}
+
+// Function to check that queues are created, resized and deleted, and that queues used by clients
+// or server cannot be deleted.
+func TestQueueManagement(t *testing.T) {
+	b := newTestBroker(t, func(settings *config.Broker) {
+		settings.Queues = []config.Queue{{Name: "declared", Capacity: 3}}
+	})
+
+	steps := []struct {
+		name    string
+		run     func() error
+		expects error
+	}{
+		{"create", func() error { return b.CreateQueue("jobs", 5) }, nil},
+		{"create again", func() error { return b.CreateQueue("jobs", 5) }, ErrQueueExists},
+		{"create declared", func() error { return b.CreateQueue("declared", 5) }, ErrQueueExists},
+		{"resize", func() error { return b.SetQueueCapacity("jobs", 2) }, nil},
+		{"resize missing", func() error { return b.SetQueueCapacity("missing", 2) }, ErrQueueNotFound},
+		{"delete used by client", func() error { return b.DeleteQueue("requests") }, ErrQueueInUse},
+		{"delete declared", func() error { return b.DeleteQueue("declared") }, nil},
+		{"delete missing", func() error { return b.DeleteQueue("declared") }, ErrQueueNotFound},
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != step.expects {
+			t.Fatalf("%s: err = %v, expected %v", step.name, err, step.expects)
+		}
+	}
+
+	if err := b.CreateQueue("", 1); err == nil {
+		t.Error("queue without name is created")
+	}
+	if err := b.CreateQueue("empty", 0); err == nil {
+		t.Error("queue without capacity is created")
+	}
+
+	expects := []QueueInfo{{Name: "jobs", Capacity: 2}}
+	if queues := b.Queues(); !reflect.DeepEqual(queues, expects) {
+		t.Errorf("queues = %+v, expected %+v", queues, expects)
+	}
+	if _, err := b.Queue("declared"); err != ErrQueueNotFound {
+		t.Errorf("deleted queue is found: %v", err)
+	}
+}
+
+// Function to check that a broker starts only once, stops on Shutdown and on its context.
+func TestStartShutdown(t *testing.T) {
+	b := startTestBroker(t, nil)
+
+	if err := b.Start(context.Background()); err != ErrAlreadyStarted {
+		t.Errorf("second start err = %v, expected ErrAlreadyStarted", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	other := newTestBroker(t, func(settings *config.Broker) {
+		settings.Server.ReadingPort = freePort(t)
+		settings.Clients[0].ReadingPort, settings.Clients[0].WritingPort = freePort(t), freePort(t)
+	})
+	if err := other.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case <-other.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker does not stop when its context is done")
+	}
+	if other.Err() != nil {
+		t.Errorf("broker stopped with %v", other.Err())
+	}
+	if err := other.Start(context.Background()); err != ErrAlreadyStarted {
+		t.Errorf("start after stop err = %v, expected ErrAlreadyStarted", err)
+	}
+
+	shutdown, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := b.Shutdown(shutdown); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", ":"+b.Settings().Server.ReadingPort); err == nil {
+		t.Error("listener is open after shutdown")
+	}
+}
+
+// Function to check that a port that is already used is reported by Start.
+func TestStartPortInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	b := newTestBroker(t, func(settings *config.Broker) { settings.Clients[0].WritingPort = port })
+
+	if err := b.Start(context.Background()); err == nil {
+		t.Error("broker starts on a port that is already used")
+	}
+	if _, err := net.Dial("tcp", ":9001"); err == nil {
+		t.Error("listeners created before the failure are still open")
+	}
+}
+
+// Function to check that reload resizes queues, keeps settings that need a restart and keeps
+// everything when the configuration cannot be loaded.
+func TestReload(t *testing.T) {
+	b := newTestBroker(t, func(settings *config.Broker) {
+		settings.Queues = []config.Queue{{Name: "jobs", Capacity: 3}}
+	})
+
+	if _, err := b.Reload(); err == nil {
+		t.Error("broker without config loader is reloaded")
+	}
+
+	next := b.Settings()
+	next.Queues = []config.Queue{{Name: "jobs", Capacity: 5}, {Name: "audit", Capacity: 2}}
+	next.Mode = "sync"
+	next.Overflow = config.OverflowDrop
+	WithConfigLoader(func() (config.Broker, error) { return next, nil })(b)
+
+	restartRequired, err := b.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restartRequired, []string{"mode"}) {
+		t.Errorf("restart required for %v, expected mode", restartRequired)
+	}
+
+	expects := []QueueInfo{{Name: "audit", Capacity: 2}, {Name: "jobs", Capacity: 5}}
+	if queues := b.Queues(); !reflect.DeepEqual(queues, expects) {
+		t.Errorf("queues = %+v, expected %+v", queues, expects)
+	}
+	if settings := b.Settings(); settings.Mode != "async" || settings.Overflow != config.OverflowDrop {
+		t.Errorf("settings after reload have mode %s and overflow %s", settings.Mode, settings.Overflow)
+	}
+
+	WithConfigLoader(func() (config.Broker, error) { return config.Broker{}, errors.New("file is broken") })(b)
+	if _, err := b.Reload(); err == nil {
+		t.Error("broken configuration is reloaded")
+	}
+	if queues := b.Queues(); !reflect.DeepEqual(queues, expects) {
+		t.Errorf("queues after failed reload = %+v", queues)
+	}
+}
+
+// Function to run an admin command on the admin port of a broker.
+func adminCommand(t *testing.T, port, command string) protocol.Frame {
+	t.Helper()
+
+	netConn, err := security.Dial(":"+port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := protocol.NewConn(netConn)
+	defer conn.Close()
+
+	_, err = conn.Handshake(protocol.Frame{ClientID: "admin-test", Role: protocol.RoleAdmin}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteFrame(protocol.Frame{Type: protocol.CommandFrame, ID: "1", Body: command}); err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// Function to check the results of admin commands sent to the admin port.
+func TestAdminCommands(t *testing.T) {
+	b := startTestBroker(t, func(settings *config.Broker) { settings.AdminPort = freePort(t) })
+	next := b.Settings()
+	next.Queues = []config.Queue{{Name: "jobs", Capacity: 4}}
+	WithConfigLoader(func() (config.Broker, error) { return next, nil })(b)
+
+	tests := []struct {
+		command string
+		result  protocol.Frame
+	}{
+		{"reload", protocol.Frame{Type: protocol.ResultFrame, ID: "1", Body: "configuration is reloaded"}},
+		{"restart", protocol.Frame{Type: protocol.ErrorFrame, ID: "1", Reason: "command restart does not exist"}},
+	}
+
+	for _, test := range tests {
+		if frame := adminCommand(t, b.Settings().AdminPort, test.command); !reflect.DeepEqual(frame, test.result) {
+			t.Errorf("%s: result = %+v, expected %+v", test.command, frame, test.result)
+		}
+	}
+
+	if queue, err := b.Queue("jobs"); err != nil || queue.Capacity != 4 {
+		t.Errorf("queue after reload command = %+v, %v", queue, err)
+	}
+}
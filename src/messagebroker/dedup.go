@@ -0,0 +1,160 @@
+package messagebroker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// A structure that represent an ID of an enqueued message and when it was enqueued.
+type seenID struct {
+	id string
+	at time.Time
+}
+
+// A structure that remembers IDs of messages enqueued to a queue, oldest first.
+type dedupWindow struct {
+	ids   map[string]time.Time
+	order []seenID
+}
+
+// A structure that remembers IDs of enqueued messages for a while, so a message that is
+// published again, for example after a reconnect, is dropped instead of enqueued twice.
+type deduplicator struct {
+	mutex   sync.Mutex // guards windows and makes checking and enqueueing one step
+	windows map[*queueingSystem.Queue]*dedupWindow
+}
+
+// Function to create a deduplicator that remembers nothing yet.
+func newDeduplicator() *deduplicator {
+	return &deduplicator{windows: make(map[*queueingSystem.Queue]*dedupWindow)}
+}
+
+// Function to get the ID a message frame is deduplicated by. It is the dedup ID if the frame
+// has one, otherwise the producer ID with the sequence number. Frames without either are not deduplicated.
+func dedupID(frame protocol.Frame) string {
+	if frame.DedupID != "" {
+		return "id:" + frame.DedupID
+	}
+	if frame.ProducerID != "" {
+		return "producer:" + frame.ProducerID + ":" + strconv.FormatUint(frame.Sequence, 10)
+	}
+	return ""
+}
+
+// Function to forget IDs that are older than the window or above the size of the window.
+func (w *dedupWindow) prune(now time.Time, window time.Duration, size int) {
+	drop := 0
+	for drop < len(w.order) && (now.Sub(w.order[drop].at) > window || len(w.order)-drop > size) {
+		seen := w.order[drop]
+		if w.ids[seen.id] == seen.at {
+			delete(w.ids, seen.id)
+		}
+		drop++
+	}
+	w.order = w.order[drop:]
+}
+
+// A structure that represent messages to enqueue to a queue and the IDs they are deduplicated by.
+// An empty ID means the message is not deduplicated.
+type publication struct {
+	queue    *queueingSystem.Queue
+	messages []queueingSystem.Message
+	ids      []string
+}
+
+// Function to enqueue messages to a queue, except the ones whose ID was enqueued within the
+// dedup window of the queue, or appears earlier in the same messages. The rest are enqueued
+// together as a batch. It returns for every message whether it was dropped as a duplicate.
+func (b *Broker) enqueue(q *queueingSystem.Queue, messages []queueingSystem.Message, ids []string) ([]bool, error) {
+	duplicates, err := b.enqueueEach([]publication{{queue: q, messages: messages, ids: ids}})
+	return duplicates[0], err
+}
+
+// Function to enqueue messages to several queues at once, either all of them or none.
+// Duplicates are dropped like enqueue does, for each queue by its own dedup window.
+// Delivery loops of the queues are notified about the new messages.
+func (b *Broker) enqueueEach(publications []publication) ([][]bool, error) {
+	d := b.dedup
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	duplicates := make([][]bool, len(publications))
+	items := make(map[*queueingSystem.Queue][]queueingSystem.Message)
+	windows := make([]*dedupWindow, len(publications))
+	seen := make(map[*queueingSystem.Queue]map[string]bool)
+
+	for i, p := range publications {
+		duplicates[i] = make([]bool, len(p.messages))
+		if _, ok := items[p.queue]; !ok {
+			items[p.queue] = make([]queueingSystem.Message, 0, len(p.messages))
+		}
+
+		settings := b.Settings().Queue(p.queue.GetName())
+		if settings.DedupWindow.Duration > 0 && settings.DedupSize > 0 {
+			w, ok := d.windows[p.queue]
+			if !ok {
+				w = &dedupWindow{ids: make(map[string]time.Time)}
+				d.windows[p.queue] = w
+			}
+			w.prune(now, settings.DedupWindow.Duration, settings.DedupSize)
+			windows[i] = w
+		}
+
+		if seen[p.queue] == nil {
+			seen[p.queue] = make(map[string]bool)
+		}
+
+		for j, message := range p.messages {
+			id := p.ids[j]
+			if windows[i] != nil && id != "" {
+				if _, ok := windows[i].ids[id]; ok || seen[p.queue][id] {
+					duplicates[i][j] = true
+					continue
+				}
+				seen[p.queue][id] = true
+			}
+			items[p.queue] = append(items[p.queue], message)
+		}
+	}
+
+	err := queueingSystem.EnqueueEach(items)
+	if err != nil {
+		return duplicates, err
+	}
+
+	for queue, messages := range items {
+		if len(messages) > 0 {
+			b.dispatcher.notify(queue)
+		}
+	}
+
+	for i, p := range publications {
+		w := windows[i]
+		if w == nil {
+			continue
+		}
+		for j, id := range p.ids {
+			if id != "" && !duplicates[i][j] {
+				w.ids[id] = now
+				w.order = append(w.order, seenID{id: id, at: now})
+			}
+		}
+		settings := b.Settings().Queue(p.queue.GetName())
+		w.prune(now, settings.DedupWindow.Duration, settings.DedupSize)
+	}
+
+	return duplicates, nil
+}
+
+// Function to forget IDs of a deleted queue.
+func (b *Broker) forgetDedup(q *queueingSystem.Queue) {
+	b.dedup.mutex.Lock()
+	defer b.dedup.mutex.Unlock()
+
+	delete(b.dedup.windows, q)
+}
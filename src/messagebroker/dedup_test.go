@@ -0,0 +1,123 @@
+package messagebroker
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// Function to check the ID a frame is deduplicated by.
+func TestDedupID(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   protocol.Frame
+		expects string
+	}{
+		{"no ID", protocol.Frame{ID: "1"}, ""},
+		{"dedup ID", protocol.Frame{DedupID: "order-1"}, "id:order-1"},
+		{"producer sequence", protocol.Frame{ProducerID: "p", Sequence: 7}, "producer:p:7"},
+		{"dedup ID before producer sequence", protocol.Frame{DedupID: "order-1", ProducerID: "p", Sequence: 7}, "id:order-1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if id := dedupID(test.frame); id != test.expects {
+				t.Errorf("dedupID = %q, expected %q", id, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that a window forgets IDs older than the window and the oldest IDs above its size.
+func TestDedupWindowPrune(t *testing.T) {
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	tests := []struct {
+		name    string
+		order   []seenID
+		now     time.Time
+		window  time.Duration
+		size    int
+		expects []string
+	}{
+		{"nothing to forget", []seenID{{"a", at(0)}, {"b", at(1)}}, at(2), time.Minute, 10, []string{"a", "b"}},
+		{"older than window", []seenID{{"a", at(0)}, {"b", at(5)}, {"c", at(9)}}, at(10), 6 * time.Second, 10, []string{"b", "c"}},
+		{"exactly window old is kept", []seenID{{"a", at(0)}}, at(5), 5 * time.Second, 10, []string{"a"}},
+		{"above size", []seenID{{"a", at(0)}, {"b", at(1)}, {"c", at(2)}}, at(3), time.Minute, 2, []string{"b", "c"}},
+		{"window and size", []seenID{{"a", at(0)}, {"b", at(8)}, {"c", at(9)}, {"d", at(9)}}, at(10), 5 * time.Second, 2,
+			[]string{"c", "d"}},
+		{"ID seen again later is kept", []seenID{{"a", at(0)}, {"b", at(1)}, {"a", at(9)}}, at(10), 5 * time.Second, 10,
+			[]string{"a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &dedupWindow{ids: make(map[string]time.Time)}
+			for _, seen := range test.order {
+				w.ids[seen.id] = seen.at
+				w.order = append(w.order, seen)
+			}
+
+			w.prune(test.now, test.window, test.size)
+
+			ids := make([]string, 0, len(w.ids))
+			for id := range w.ids {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+
+			if !reflect.DeepEqual(ids, test.expects) {
+				t.Errorf("remembered IDs = %v, expected %v", ids, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check which published messages are dropped as duplicates, for publishes one after another.
+func TestEnqueueDuplicates(t *testing.T) {
+	tests := []struct {
+		name      string
+		window    time.Duration
+		capacity  int
+		publishes [][]string // dedup IDs of the messages of every publish
+		expects   [][]bool   // whether every message is a duplicate
+		size      int        // messages in the queue at the end
+	}{
+		{"different IDs", time.Minute, 10, [][]string{{"id:a"}, {"id:b"}}, [][]bool{{false}, {false}}, 2},
+		{"same ID again", time.Minute, 10, [][]string{{"id:a"}, {"id:a"}}, [][]bool{{false}, {true}}, 1},
+		{"same ID in one batch", time.Minute, 10, [][]string{{"id:a", "id:a", "id:b"}}, [][]bool{{false, true, false}}, 2},
+		{"messages without ID", time.Minute, 10, [][]string{{"", ""}, {""}}, [][]bool{{false, false}, {false}}, 3},
+		{"dedup disabled", 0, 10, [][]string{{"id:a"}, {"id:a"}}, [][]bool{{false}, {false}}, 2},
+		{"full queue does not remember IDs", time.Minute, 1, [][]string{{"id:a", "id:b"}, {"id:a"}},
+			[][]bool{{false, false}, {false}}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBroker(t, func(settings *config.Broker) {
+				settings.DedupWindow = config.Duration{Duration: test.window}
+				settings.Queues = []config.Queue{{Name: "jobs", Capacity: test.capacity}}
+			})
+			queue := b.getQueue("jobs")
+
+			for i, ids := range test.publishes {
+				messages := make([]queueingSystem.Message, len(ids))
+				duplicates, _ := b.enqueue(queue, messages, ids)
+
+				if !reflect.DeepEqual(duplicates, test.expects[i]) {
+					t.Errorf("publish %d duplicates = %v, expected %v", i, duplicates, test.expects[i])
+				}
+			}
+
+			if size := queue.GetSize(); size != test.size {
+				t.Errorf("queue has %d messages, expected %d", size, test.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package messagebroker
+
+import (
+	"sync"
+
+	"distributed-systems-message-queue/src/config"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// A structure that tells delivery loops which of their queues may have a message to deliver,
+// so they wait instead of polling empty queues. A queue is notified when messages are enqueued
+// to it or put back to it, when one of its keys is released and when configuration is reloaded.
+type dispatcher struct {
+	settings      func() config.Broker // scheduling policy and weights are read at every turn, so they can be reloaded
+	mutex         sync.Mutex
+	subscriptions map[*queueingSystem.Queue][]*subscription
+}
+
+// A structure that represent a delivery loop waiting for its queues. Notified queues wait in the
+// order they were notified, each at most once, and the scheduling policy decides which of them
+// the loop takes the next message from.
+type subscription struct {
+	queues   []*queueingSystem.Queue
+	settings func() config.Broker
+
+	mutex    sync.Mutex // guards ready, queued, turn and deficits
+	ready    []*queueingSystem.Queue
+	queued   map[*queueingSystem.Queue]bool
+	turn     *queueingSystem.Queue         // queue whose turn it is, it stays first in ready until its share is used
+	deficits map[*queueingSystem.Queue]int // share of the turn a queue has left, in messages or bytes
+	signal   chan struct{}                 // has a value when ready may have queues
+}
+
+// Function to create a dispatcher without subscriptions.
+func newDispatcher(settings func() config.Broker) *dispatcher {
+	return &dispatcher{settings: settings, subscriptions: make(map[*queueingSystem.Queue][]*subscription)}
+}
+
+// Function to subscribe a delivery loop to queues. All of the queues are ready at first,
+// as they may have messages from before the loop started.
+func (d *dispatcher) subscribe(queues []*queueingSystem.Queue) *subscription {
+	s := &subscription{queues: queues, settings: d.settings, queued: make(map[*queueingSystem.Queue]bool),
+		deficits: make(map[*queueingSystem.Queue]int), signal: make(chan struct{}, 1)}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, queue := range queues {
+		d.subscriptions[queue] = append(d.subscriptions[queue], s)
+		s.push(queue)
+	}
+	return s
+}
+
+// Function to add a queue to a subscription. Like the queues given to subscribe, it is ready at first.
+func (d *dispatcher) extend(s *subscription, queue *queueingSystem.Queue) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	s.queues = append(s.queues, queue)
+	d.subscriptions[queue] = append(d.subscriptions[queue], s)
+	s.push(queue)
+}
+
+// Function to remove a subscription after its delivery loop ended.
+func (d *dispatcher) unsubscribe(s *subscription) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, queue := range s.queues {
+		subscriptions := d.subscriptions[queue]
+		for i, other := range subscriptions {
+			if other == s {
+				subscriptions = append(subscriptions[:i], subscriptions[i+1:]...)
+				break
+			}
+		}
+		if len(subscriptions) == 0 {
+			delete(d.subscriptions, queue)
+		} else {
+			d.subscriptions[queue] = subscriptions
+		}
+	}
+}
+
+// Function to tell delivery loops of a queue that it may have a message to deliver.
+func (d *dispatcher) notify(queue *queueingSystem.Queue) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, s := range d.subscriptions[queue] {
+		s.push(queue)
+	}
+}
+
+// Function to tell all delivery loops to look at all of their queues again, for example
+// after permissions changed.
+func (d *dispatcher) notifyAll() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for queue, subscriptions := range d.subscriptions {
+		for _, s := range subscriptions {
+			s.push(queue)
+		}
+	}
+}
+
+// Function to mark a queue of a subscription ready, after the queues that are ready already.
+func (s *subscription) push(queue *queueingSystem.Queue) {
+	s.mutex.Lock()
+	if !s.queued[queue] {
+		s.queued[queue] = true
+		s.ready = append(s.ready, queue)
+	}
+	s.mutex.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Function to take the next ready queue. It is the first one, or with priority scheduling the first
+// one with the highest priority. It waits until a queue is notified, and returns false if done is
+// closed first. The queue is not ready anymore until it is notified again or dequeued is called.
+func (s *subscription) next(done <-chan struct{}) (*queueingSystem.Queue, bool) {
+	for {
+		settings := s.settings()
+
+		s.mutex.Lock()
+		if len(s.ready) > 0 {
+			chosen := 0
+			if settings.Scheduling == config.SchedulingPriority {
+				for i, queue := range s.ready {
+					if settings.Queue(queue.GetName()).Priority > settings.Queue(s.ready[chosen].GetName()).Priority {
+						chosen = i
+					}
+				}
+			}
+
+			queue := s.ready[chosen]
+			s.ready = append(s.ready[:chosen], s.ready[chosen+1:]...)
+			delete(s.queued, queue)
+			s.mutex.Unlock()
+			return queue, true
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-s.signal:
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+// Function to charge a message dequeued from a queue to its turn and make the queue ready again,
+// as it may have more messages. A turn is one message with round-robin and priority scheduling,
+// weight messages with weighted scheduling and weight times quantum bytes with deficit scheduling.
+// The queue keeps its turn while it has share left, then it waits after the other ready queues.
+// A message that costs more than the share left is charged to the next turn of the queue.
+func (s *subscription) dequeued(queue *queueingSystem.Queue, message queueingSystem.Message) {
+	settings := s.settings()
+	weight := settings.Queue(queue.GetName()).Weight
+
+	cost, share := 1, 1
+	switch settings.Scheduling {
+	case config.SchedulingWeighted:
+		share = weight
+	case config.SchedulingDeficit:
+		cost, share = len(message.Body), weight*settings.Quantum
+		if cost == 0 {
+			cost = 1
+		}
+	}
+
+	s.mutex.Lock()
+	if s.turn != queue {
+		s.turn = queue
+		s.deficits[queue] += share
+	}
+	s.deficits[queue] -= cost
+
+	if s.queued[queue] {
+		for i, other := range s.ready {
+			if other == queue {
+				s.ready = append(s.ready[:i], s.ready[i+1:]...)
+				break
+			}
+		}
+	}
+	s.queued[queue] = true
+
+	if s.deficits[queue] > 0 {
+		s.ready = append([]*queueingSystem.Queue{queue}, s.ready...)
+	} else {
+		s.turn = nil
+		s.ready = append(s.ready, queue)
+	}
+	s.mutex.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Function to end the turn of a queue that had no message to deliver. Its share left is dropped,
+// so a queue cannot save up share while it is empty.
+func (s *subscription) idle(queue *queueingSystem.Queue) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.turn == queue {
+		s.turn = nil
+	}
+	if s.deficits[queue] > 0 {
+		s.deficits[queue] = 0
+	}
+}
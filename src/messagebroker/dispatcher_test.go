@@ -0,0 +1,200 @@
+package messagebroker
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// Function to get settings for a dispatcher with given scheduling, quantum and declared queues.
+func schedulingSettings(scheduling string, quantum int, queues ...config.Queue) func() config.Broker {
+	settings := config.Default()
+	settings.Scheduling = scheduling
+	settings.Quantum = quantum
+	settings.Queues = queues
+	return func() config.Broker { return settings }
+}
+
+// Function to check the order a delivery loop takes messages from queues that always have messages,
+// for every scheduling policy.
+func TestSchedulingOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings func() config.Broker
+		bodies   map[string]string // body of every message of a queue
+		expects  string            // names of the queues messages are taken from, in order
+	}{
+		{"round-robin", schedulingSettings(config.SchedulingRoundRobin, 0),
+			map[string]string{"a": "x", "b": "x", "c": "x"}, "abcabcabc"},
+		{"round-robin ignores weights", schedulingSettings(config.SchedulingRoundRobin, 0, config.Queue{Name: "a", Weight: 3}),
+			map[string]string{"a": "x", "b": "x"}, "ababab"},
+		{"weighted", schedulingSettings(config.SchedulingWeighted, 0, config.Queue{Name: "a", Weight: 3}),
+			map[string]string{"a": "x", "b": "x"}, "aaabaaab"},
+		{"weighted with default weight", schedulingSettings(config.SchedulingWeighted, 0, config.Queue{Name: "b", Weight: 2}),
+			map[string]string{"a": "x", "b": "x", "c": "x"}, "abbcabbc"},
+		{"deficit shares bytes", schedulingSettings(config.SchedulingDeficit, 10),
+			map[string]string{"a": "12345", "b": "1234567890"}, "aabaabaab"},
+		{"deficit carries cost over to the next turn", schedulingSettings(config.SchedulingDeficit, 10),
+			map[string]string{"a": "1234", "b": "1234567890"}, "aaabaabaaab"},
+		{"deficit with weight", schedulingSettings(config.SchedulingDeficit, 10, config.Queue{Name: "b", Weight: 2}),
+			map[string]string{"a": "1234567890", "b": "1234567890"}, "abbabbabb"},
+		{"deficit with empty bodies", schedulingSettings(config.SchedulingDeficit, 2),
+			map[string]string{"a": "", "b": ""}, "aabbaabb"},
+		{"priority", schedulingSettings(config.SchedulingPriority, 0, config.Queue{Name: "b", Priority: 5}),
+			map[string]string{"a": "x", "b": "x", "c": "x"}, "bbbbbb"},
+		{"priority takes turns on equal priority", schedulingSettings(config.SchedulingPriority, 0,
+			config.Queue{Name: "a", Priority: 5}, config.Queue{Name: "c", Priority: 5}),
+			map[string]string{"a": "x", "b": "x", "c": "x"}, "acacac"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names := []string{"a", "b", "c"}[:len(test.bodies)]
+			queues := make([]*queueingSystem.Queue, len(names))
+			for i, name := range names {
+				queues[i] = queueingSystem.CreateQueue(name, 10)
+			}
+
+			s := newDispatcher(test.settings).subscribe(queues)
+			done := make(chan struct{})
+			order := ""
+			for len(order) < len(test.expects) {
+				queue, ok := s.next(done)
+				if !ok {
+					t.Fatal("no queue is ready")
+				}
+				s.dequeued(queue, queueingSystem.Message{Body: test.bodies[queue.GetName()]})
+				order += queue.GetName()
+			}
+
+			if order != test.expects {
+				t.Errorf("order = %s, expected %s", order, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that a queue that had no message loses the share of its turn.
+func TestSchedulingIdle(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings func() config.Broker
+		body     string
+	}{
+		{"weighted", schedulingSettings(config.SchedulingWeighted, 0, config.Queue{Name: "a", Weight: 3}), "x"},
+		{"deficit", schedulingSettings(config.SchedulingDeficit, 10, config.Queue{Name: "a", Weight: 3}), "12345"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := queueingSystem.CreateQueue("a", 10), queueingSystem.CreateQueue("b", 10)
+			s := newDispatcher(test.settings).subscribe([]*queueingSystem.Queue{a, b})
+
+			s.next(nil)
+			s.dequeued(a, queueingSystem.Message{Body: test.body})
+			if s.deficits[a] <= 0 || s.turn != a {
+				t.Fatalf("queue has no share left after one message, deficit %d", s.deficits[a])
+			}
+
+			s.next(nil)
+			s.idle(a)
+			if s.deficits[a] != 0 || s.turn != nil {
+				t.Errorf("idle queue keeps deficit %d and its turn", s.deficits[a])
+			}
+
+			if queue, _ := s.next(nil); queue != b {
+				t.Errorf("next queue is %s, expected b", queue.GetName())
+			}
+		})
+	}
+}
+
+// Function to check that a delivery loop waits until one of its queues is notified, and only
+// for its own queues.
+func TestDispatcherNotify(t *testing.T) {
+	d := newDispatcher(schedulingSettings(config.SchedulingRoundRobin, 0))
+	a, b, other := queueingSystem.CreateQueue("a", 10), queueingSystem.CreateQueue("b", 10), queueingSystem.CreateQueue("other", 10)
+	s := d.subscribe([]*queueingSystem.Queue{a, b})
+	d.subscribe([]*queueingSystem.Queue{other})
+
+	tests := []struct {
+		name    string
+		notify  func()
+		expects string // names of ready queues in order
+		ordered bool
+	}{
+		{"all queues are ready at first", func() {}, "ab", true},
+		{"nothing is notified", func() {}, "", true},
+		{"queue of another loop", func() { d.notify(other) }, "", true},
+		{"subscribed queue", func() { d.notify(a) }, "a", true},
+		{"in order of notification", func() { d.notify(b); d.notify(a) }, "ba", true},
+		{"notified twice is ready once", func() { d.notify(a); d.notify(a) }, "a", true},
+		{"all queues notified", func() { d.notifyAll() }, "ab", false},
+		{"unsubscribed loop", func() { d.unsubscribe(s); d.notify(a) }, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.notify()
+
+			ready := make([]string, 0)
+			for {
+				done := make(chan struct{})
+				timer := time.AfterFunc(20*time.Millisecond, func() { close(done) })
+				queue, ok := s.next(done)
+				timer.Stop()
+				if !ok {
+					break
+				}
+				ready = append(ready, queue.GetName())
+			}
+
+			// notifyAll goes over every queue of the dispatcher in no particular order.
+			if !test.ordered {
+				sort.Strings(ready)
+			}
+			if strings.Join(ready, "") != test.expects {
+				t.Errorf("ready queues are %v, expected %q", ready, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that a queue added to a subscription is ready at first and notified from then on.
+func TestDispatcherExtend(t *testing.T) {
+	d := newDispatcher(schedulingSettings(config.SchedulingRoundRobin, 0))
+	a, other := queueingSystem.CreateQueue("a", 10), queueingSystem.CreateQueue("other", 10)
+	s := d.subscribe(nil)
+	defer d.unsubscribe(s)
+
+	next := func() *queueingSystem.Queue {
+		done := make(chan struct{})
+		timer := time.AfterFunc(20*time.Millisecond, func() { close(done) })
+		defer timer.Stop()
+
+		queue, _ := s.next(done)
+		return queue
+	}
+
+	if queue := next(); queue != nil {
+		t.Fatalf("queue %s is ready without queues", queue.GetName())
+	}
+
+	d.extend(s, a)
+	if queue := next(); queue != a {
+		t.Fatalf("ready queue is %v after extending, expected a", queue)
+	}
+
+	d.notify(other)
+	d.notify(a)
+	if queue := next(); queue != a {
+		t.Errorf("ready queue is %v after notifying, expected a", queue)
+	}
+	if queue := next(); queue != nil {
+		t.Errorf("queue %s is ready, expected none", queue.GetName())
+	}
+}
@@ -0,0 +1,570 @@
+package messagebroker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+	"distributed-systems-message-queue/src/security"
+)
+
+// Error code of a request to the HTTP gateway that cannot be understood.
+const errorBadRequest = "bad_request"
+
+// Largest request body or WebSocket message a peer of the HTTP gateway may send, in bytes,
+// so a peer cannot make the broker read without limit before message sizes are checked.
+const maxRequestSize = 16 << 20
+
+// Longest a pull over the HTTP gateway may wait for messages, so waiting pulls do not pile up.
+const maxPullWait = 30 * time.Second
+
+// A structure that represent a message as the HTTP gateway reads and writes it. ID, client ID and
+// attempt are only set on pulled messages, dedup ID only on published ones.
+type httpMessage struct {
+	ID            string            `json:"id,omitempty"`
+	ClientID      string            `json:"client_id,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Key           string            `json:"key,omitempty"`
+	DedupID       string            `json:"dedup_id,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Body          string            `json:"body"`
+	Attempt       int               `json:"attempt,omitempty"`
+}
+
+// A structure that represent a request to publish one message, or a batch of them when messages is given.
+type publishRequest struct {
+	httpMessage
+	Messages []httpMessage `json:"messages,omitempty"`
+}
+
+// A structure that represent an error response of the HTTP gateway. Errors of the broker
+// have the same codes as error frames.
+type httpError struct {
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error"`
+}
+
+// A structure that represent a request to create a queue or change its capacity.
+type queueRequest struct {
+	Name     string `json:"name,omitempty"`
+	Capacity int    `json:"capacity"`
+}
+
+// A structure that represent a message pulled over HTTP that waits for its acknowledgment.
+// Only the peer that pulled it, its owner, can settle it.
+type lease struct {
+	delivery
+	owner string // identity of the peer that pulled the message, see gatewayIdentity
+	timer *time.Timer
+}
+
+// A structure that keeps track of messages pulled over HTTP until they are acknowledged or rejected.
+// A message that is not settled within the visibility timeout is put back to its queue.
+type leases struct {
+	mutex sync.Mutex
+	held  map[string]*lease
+}
+
+// Function to create leases where no message is held.
+func newLeases() *leases {
+	return &leases{held: make(map[string]*lease)}
+}
+
+// Function to hold a message pulled by owner until it is settled or the visibility timeout is over.
+// It returns the ID the message is settled with.
+func (b *Broker) lease(queue *queueingSystem.Queue, message queueingSystem.Message, owner string) string {
+	id := strconv.FormatUint(atomic.AddUint64(&b.deliveryCounter, 1), 10)
+	l := &lease{delivery: delivery{message: message, queue: queue}, owner: owner}
+
+	b.leases.mutex.Lock()
+	defer b.leases.mutex.Unlock()
+
+	l.timer = time.AfterFunc(b.Settings().VisibilityTimeout.Duration, func() { b.expire(id, l) })
+	b.leases.held[id] = l
+	return id
+}
+
+// Function to take a held message of a queue away from the leases for its owner. It returns false if the message
+// is not held, because it was settled already, its visibility timeout is over, it is of another queue
+// or another peer pulled it.
+func (b *Broker) release(queue *queueingSystem.Queue, id, owner string) (delivery, bool) {
+	b.leases.mutex.Lock()
+	defer b.leases.mutex.Unlock()
+
+	l, ok := b.leases.held[id]
+	if !ok || l.queue != queue || l.owner != owner {
+		return delivery{}, false
+	}
+	delete(b.leases.held, id)
+	l.timer.Stop()
+	return l.delivery, true
+}
+
+// Function to put a pulled message back to its queue when its visibility timeout is over.
+func (b *Broker) expire(id string, l *lease) {
+	b.leases.mutex.Lock()
+	if b.leases.held[id] != l {
+		b.leases.mutex.Unlock()
+		return
+	}
+	delete(b.leases.held, id)
+	b.leases.mutex.Unlock()
+
+	b.logger.Println("ERROR:", "message "+id+" pulled over HTTP was not acknowledged in time")
+	b.redeliver(l.delivery)
+}
+
+// Function to serve the HTTP gateway until the broker stops.
+func (b *Broker) serveHTTP(server *http.Server, listener net.Listener) {
+	err := server.Serve(listener)
+	if err != nil && !b.stopped() {
+		b.logger.Println("ERROR:", "http:", err)
+	}
+}
+
+// Function to get the handler of the HTTP gateway. It offers these endpoints, with JSON bodies:
+//
+//	GET    /queues                          list queues
+//	POST   /queues                          create a queue
+//	GET    /queues/{name}                   get state of a queue
+//	PUT    /queues/{name}                   change capacity of a queue
+//	DELETE /queues/{name}                   delete a queue
+//	POST   /queues/{name}/messages          publish a message or a batch
+//	GET    /queues/{name}/messages          pull messages, with ?max=n&wait=duration
+//	POST   /queues/{name}/messages/{id}/ack acknowledge a pulled message
+//	POST   /queues/{name}/messages/{id}/nack reject a pulled message so it is delivered again
+//	GET    /ws                              upgrade to a WebSocket stream, see handleStream
+func (b *Broker) gateway() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queues", b.handleQueues)
+	mux.HandleFunc("/queues/", b.handleQueue)
+	mux.HandleFunc("/ws", b.handleStream)
+	return mux
+}
+
+// Function to authenticate the user of an HTTP request with basic authentication, a bearer token
+// or a verified client certificate. Everyone is permitted when authentication is disabled.
+// It writes an error response and returns false if the user cannot be authenticated.
+func (b *Broker) authenticateHTTP(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if b.users == nil {
+		return "", true
+	}
+
+	username, password, _ := r.BasicAuth()
+	token := ""
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	identity := ""
+	if r.TLS != nil {
+		identity, _ = security.StateIdentity(*r.TLS)
+	}
+
+	user, err := b.users.Authenticate(username, password, token, identity)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="message broker"`)
+		writeHTTPError(w, http.StatusUnauthorized, protocol.ErrorUnauthorized, err.Error())
+		return "", false
+	}
+	return user, true
+}
+
+// Function to check whether a user of the HTTP gateway is permitted to do an action on queues
+// matching a name. It writes an error response and returns false if not.
+func (b *Broker) permittedHTTP(w http.ResponseWriter, user, action, queue string) bool {
+	if b.users == nil || b.users.Allowed(user, action, queue) {
+		return true
+	}
+
+	writeHTTPError(w, http.StatusForbidden, protocol.ErrorUnauthorized,
+		"user "+user+" is not permitted to "+action+" queue "+queue)
+	return false
+}
+
+// Function to handle requests to the list of queues. Managing queues needs the admin action
+// on every queue, like admin commands.
+func (b *Broker) handleQueues(w http.ResponseWriter, r *http.Request) {
+	user, ok := b.authenticateHTTP(w, r)
+	if !ok || !b.permittedHTTP(w, user, auth.Admin, "*") {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string][]QueueInfo{"queues": b.Queues()})
+	case http.MethodPost:
+		var request queueRequest
+		if !readJSON(w, r, &request) {
+			return
+		}
+		if err := b.CreateQueue(request.Name, request.Capacity); err != nil {
+			writeBrokerError(w, err)
+			return
+		}
+		b.writeQueue(w, http.StatusCreated, request.Name)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// Function to handle requests to a queue and its messages.
+func (b *Broker) handleQueue(w http.ResponseWriter, r *http.Request) {
+	user, ok := b.authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/queues/"), "/")
+	name := parts[0]
+
+	switch {
+	case len(parts) == 1 && name != "":
+		if b.permittedHTTP(w, user, auth.Admin, "*") {
+			b.manageQueue(w, r, name)
+		}
+	case len(parts) == 2 && parts[1] == "messages":
+		switch r.Method {
+		case http.MethodPost:
+			b.publishHTTP(w, r, user, name)
+		case http.MethodGet:
+			b.pullHTTP(w, r, user, name)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case len(parts) == 4 && parts[1] == "messages" && (parts[3] == "ack" || parts[3] == "nack"):
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if b.permittedHTTP(w, user, auth.Consume, name) {
+			b.settleHTTP(w, gatewayIdentity(user, r), name, parts[2], parts[3] == "ack")
+		}
+	default:
+		writeHTTPError(w, http.StatusNotFound, "", "no endpoint at "+r.URL.Path)
+	}
+}
+
+// Function to get, resize or delete a queue.
+func (b *Broker) manageQueue(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		b.writeQueue(w, http.StatusOK, name)
+	case http.MethodPut:
+		var request queueRequest
+		if !readJSON(w, r, &request) {
+			return
+		}
+		if err := b.SetQueueCapacity(name, request.Capacity); err != nil {
+			writeBrokerError(w, err)
+			return
+		}
+		b.writeQueue(w, http.StatusOK, name)
+	case http.MethodDelete:
+		if err := b.DeleteQueue(name); err != nil {
+			writeBrokerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// Function to write state of a queue as response.
+func (b *Broker) writeQueue(w http.ResponseWriter, status int, name string) {
+	info, err := b.Queue(name)
+	if err != nil {
+		writeBrokerError(w, err)
+		return
+	}
+	writeJSON(w, status, info)
+}
+
+// Function to publish a message or a batch to a queue, see publishGateway.
+func (b *Broker) publishHTTP(w http.ResponseWriter, r *http.Request, user, name string) {
+	var request publishRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	published := request.Messages
+	if len(published) == 0 {
+		published = []httpMessage{request.httpMessage}
+	}
+
+	frames := make([]protocol.Frame, len(published))
+	for i, m := range published {
+		frames[i] = protocol.Frame{CorrelationID: m.CorrelationID, Key: m.Key, DedupID: m.DedupID, Headers: m.Headers, Body: m.Body}
+	}
+
+	enqueued, err := b.publishGateway(gatewayIdentity(user, r), name, frames)
+	if err != nil {
+		b.logger.Println("ERROR:", "http:", err)
+		writeBrokerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"enqueued": enqueued, "duplicates": len(frames) - enqueued})
+}
+
+// Function to get who publishes over the HTTP gateway: the authenticated user, or the address
+// of the peer when authentication is disabled. Messages belong to it, and it has its own publish limit.
+func gatewayIdentity(user string, r *http.Request) string {
+	if user != "" {
+		return user
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "http:" + host
+}
+
+// Function to publish messages of the HTTP gateway or a WebSocket stream to a queue. The messages
+// are enqueued together, either all of them or none. Like messages of producers, they belong to the
+// identity of the peer whatever client ID they give, so a peer cannot get replies meant for another
+// client. Only the server publishes to the responses queue. The peer needs the publish action on
+// the queue, and messages over the HTTP publish limit of the peer are rejected with a hint how long
+// to wait. Messages with a dedup ID that was enqueued within the dedup window of the queue are dropped.
+// It returns how many messages are enqueued.
+func (b *Broker) publishGateway(identity, name string, frames []protocol.Frame) (int, error) {
+	current := b.Settings()
+
+	queue, ok := b.findQueue(name)
+	if !ok {
+		return 0, newRejection(protocol.ErrorUnknownQueue, "queue "+name+" does not exist")
+	}
+	if current.Messaging == "multi" && name == responsesQueue {
+		return 0, newRejection(protocol.ErrorUnauthorized, "only the server publishes to queue "+name)
+	}
+	if b.users != nil && !b.users.Allowed(identity, auth.Publish, name) {
+		return 0, newRejection(protocol.ErrorUnauthorized, "not permitted to publish to queue "+name)
+	}
+
+	bytes := 0
+	messages := make([]queueingSystem.Message, len(frames))
+	ids := make([]string, len(frames))
+	for i, frame := range frames {
+		if err := b.checkSize(frame.Body); err != nil {
+			return 0, err
+		}
+		bytes += len(frame.Body)
+
+		messages[i] = queueingSystem.Message{ClientID: identity, CorrelationID: frame.CorrelationID, Key: frame.Key,
+			Headers: frame.Headers, Body: frame.Body}
+		ids[i] = dedupID(protocol.Frame{DedupID: frame.DedupID})
+	}
+
+	if limit := current.HTTPPublishLimit; limit.Enabled() {
+		if wait := b.gatewayLimits.limiter(identity, limit.BurstDuration()).take(limit, len(frames), bytes); wait > 0 {
+			return 0, &rejection{code: protocol.ErrorRateLimited, reason: "publish rate limit exceeded", retryAfter: wait}
+		}
+	}
+
+	duplicates, err := b.enqueue(queue, messages, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	enqueued := 0
+	for _, duplicate := range duplicates {
+		if !duplicate {
+			enqueued++
+		}
+	}
+	b.logger.Println("LOG:", "enqueued "+strconv.Itoa(enqueued)+" from "+identity+" to queue", "SIZE:", queue.GetSize())
+
+	return enqueued, nil
+}
+
+// Function to check whether a peer of the HTTP gateway or a WebSocket stream may consume from a queue.
+// With authentication it needs the consume action on the queue. Without it, queues that clients or the
+// server use are not given out, so their messages cannot be taken from the server or the clients.
+func (b *Broker) checkConsume(user string, queue *queueingSystem.Queue) error {
+	name := queue.GetName()
+	if b.users != nil && !b.users.Allowed(user, auth.Consume, name) {
+		return newRejection(protocol.ErrorUnauthorized, "not permitted to consume from queue "+name)
+	}
+	if b.users == nil && b.queueInUse(name) {
+		return newRejection(protocol.ErrorUnauthorized, "queue "+name+" is used by clients or server, "+
+			"consuming it over the gateway needs authentication")
+	}
+	return nil
+}
+
+// Function to pull up to max messages from a queue, 1 by default. Without messages it waits up to
+// the wait duration for the first one, at most maxPullWait. It does not wait by default. Pulled messages
+// are held like messages delivered to the server: the next message with the same key waits until they
+// are acknowledged, and they are delivered again if they are rejected or the visibility timeout is over.
+func (b *Broker) pullHTTP(w http.ResponseWriter, r *http.Request, user, name string) {
+	queue, ok := b.findQueue(name)
+	if !ok {
+		writeBrokerError(w, newRejection(protocol.ErrorUnknownQueue, "queue "+name+" does not exist"))
+		return
+	}
+	if err := b.checkConsume(user, queue); err != nil {
+		writeBrokerError(w, err)
+		return
+	}
+
+	max := 1
+	if value := r.URL.Query().Get("max"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeHTTPError(w, http.StatusBadRequest, errorBadRequest, "max should be a positive number, not "+value)
+			return
+		}
+		max = n
+	}
+
+	wait := time.Duration(0)
+	if value := r.URL.Query().Get("wait"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || d > maxPullWait {
+			writeHTTPError(w, http.StatusBadRequest, errorBadRequest, "wait should be a duration like 5s up to "+
+				maxPullWait.String()+", not "+value)
+			return
+		}
+		wait = d
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	s := b.dispatcher.subscribe([]*queueingSystem.Queue{queue})
+	defer b.dispatcher.unsubscribe(s)
+
+	pulled := make([]httpMessage, 0, max)
+	for len(pulled) < max {
+		// The queue is ready right after subscribing, so a pull that does not wait still looks once.
+		if _, ok := s.next(ctx.Done()); !ok {
+			break
+		}
+
+		if !b.canDeliver(queue) {
+			if len(pulled) > 0 {
+				break
+			}
+			continue
+		}
+
+		message, err := b.dequeue(queue)
+		if err != nil {
+			s.idle(queue)
+			if len(pulled) > 0 {
+				break
+			}
+			continue
+		}
+		s.dequeued(queue, message)
+		b.chargeDelivery(queue, message)
+
+		message.Deliveries++
+		pulled = append(pulled, httpMessage{ID: b.lease(queue, message, gatewayIdentity(user, r)), ClientID: message.ClientID,
+			CorrelationID: message.CorrelationID, Key: message.Key, Headers: message.Headers, Body: message.Body,
+			Attempt: message.Deliveries})
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]httpMessage{"messages": pulled})
+}
+
+// Function to acknowledge or reject a pulled message. An acknowledged message is done, a rejected
+// one is put back to front of its queue. Only the peer that pulled it can settle it, to anyone else
+// it does not exist, so message IDs cannot be guessed to settle messages of other peers.
+func (b *Broker) settleHTTP(w http.ResponseWriter, identity, name, id string, ack bool) {
+	queue, ok := b.findQueue(name)
+	if !ok {
+		writeBrokerError(w, newRejection(protocol.ErrorUnknownQueue, "queue "+name+" does not exist"))
+		return
+	}
+
+	d, ok := b.release(queue, id, identity)
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, "", "message "+id+" is not pulled from queue "+name+
+			", or its visibility timeout is over")
+		return
+	}
+
+	if ack {
+		b.releaseKey(queue, d.message)
+	} else {
+		b.logger.Println("ERROR:", "message "+id+" pulled over HTTP is rejected")
+		b.redeliver(d)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Function to read the JSON body of a request. It writes an error response and returns false
+// if the body is not valid.
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		// MaxBytesReader has no error type to check for before Go 1.19.
+		if strings.Contains(err.Error(), "request body too large") {
+			writeHTTPError(w, http.StatusRequestEntityTooLarge, protocol.ErrorMessageTooLarge,
+				"request body is larger than "+strconv.Itoa(maxRequestSize)+" bytes")
+			return false
+		}
+		writeHTTPError(w, http.StatusBadRequest, errorBadRequest, "request body is not valid: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// Function to write a JSON response.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Function to write an error response with the error code and the reason.
+func writeHTTPError(w http.ResponseWriter, status int, code, reason string) {
+	writeJSON(w, status, httpError{Code: code, Error: reason})
+}
+
+// Function to write an error response for an error of the broker, with the status that matches its code.
+// Errors that can pass later have a Retry-After header when the broker knows how long to wait.
+func writeBrokerError(w http.ResponseWriter, err error) {
+	code, retryAfter := errorCode(err)
+
+	status := http.StatusBadRequest
+	switch {
+	case code == protocol.ErrorQueueFull:
+		status = http.StatusServiceUnavailable
+	case code == protocol.ErrorRateLimited:
+		status = http.StatusTooManyRequests
+	case code == protocol.ErrorMessageTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case code == protocol.ErrorUnauthorized:
+		status = http.StatusForbidden
+	case code == protocol.ErrorUnknownQueue, errors.Is(err, ErrQueueNotFound):
+		status, code = http.StatusNotFound, protocol.ErrorUnknownQueue
+	case errors.Is(err, ErrQueueExists), errors.Is(err, ErrQueueInUse):
+		status = http.StatusConflict
+	case code == "":
+		code = errorBadRequest
+	}
+
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	}
+	writeHTTPError(w, status, code, err.Error())
+}
+
+// Function to reject a request whose method the endpoint does not support.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeHTTPError(w, http.StatusMethodNotAllowed, "", "method is not allowed, use "+strings.Join(allowed, " or "))
+}
@@ -0,0 +1,253 @@
+package messagebroker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+)
+
+// Function to send a request to the HTTP gateway of a broker and get the response.
+func gatewayRequest(t *testing.T, b *Broker, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	b.gateway().ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+// Function to pull messages over the HTTP gateway and decode them.
+func pullMessages(t *testing.T, b *Broker, query string) []httpMessage {
+	t.Helper()
+
+	response := gatewayRequest(t, b, http.MethodGet, "/queues/jobs/messages"+query, "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("pull answered %d: %s", response.Code, response.Body)
+	}
+
+	var pulled struct {
+		Messages []httpMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&pulled); err != nil {
+		t.Fatal(err)
+	}
+	return pulled.Messages
+}
+
+// Function to check that queues are created, read, resized and deleted over the HTTP gateway,
+// with the status codes of the errors of the broker.
+func TestGatewayQueues(t *testing.T) {
+	b := newTestBroker(t, nil)
+
+	steps := []struct {
+		method, path, body string
+		status             int
+		response           string
+	}{
+		{http.MethodPost, "/queues", `{"name": "jobs", "capacity": 5}`, http.StatusCreated, `{"name":"jobs","size":0,"capacity":5}`},
+		{http.MethodPost, "/queues", `{"name": "jobs", "capacity": 5}`, http.StatusConflict, ""},
+		{http.MethodPost, "/queues", `{"name": "jobs", "size": 5}`, http.StatusBadRequest, ""},
+		{http.MethodGet, "/queues/jobs", "", http.StatusOK, `{"name":"jobs","size":0,"capacity":5}`},
+		{http.MethodPut, "/queues/jobs", `{"capacity": 8}`, http.StatusOK, `{"name":"jobs","size":0,"capacity":8}`},
+		{http.MethodPatch, "/queues/jobs", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodDelete, "/queues/jobs", "", http.StatusNoContent, ""},
+		{http.MethodGet, "/queues/jobs", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/queues/jobs/other", "", http.StatusNotFound, ""},
+	}
+
+	for _, step := range steps {
+		response := gatewayRequest(t, b, step.method, step.path, step.body)
+
+		if response.Code != step.status {
+			t.Fatalf("%s %s answered %d: %s, expected %d", step.method, step.path, response.Code, response.Body, step.status)
+		}
+		if step.response != "" && strings.TrimSpace(response.Body.String()) != step.response {
+			t.Errorf("%s %s answered %s, expected %s", step.method, step.path, response.Body, step.response)
+		}
+	}
+}
+
+// Function to check that pulled messages are held until they are acknowledged, put back when they
+// are rejected or their visibility timeout is over, and cannot be settled twice.
+func TestGatewayPullAndSettle(t *testing.T) {
+	b := newTestBroker(t, func(settings *config.Broker) {
+		settings.VisibilityTimeout.Duration = 100 * time.Millisecond
+	})
+	if err := b.CreateQueue("jobs", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	response := gatewayRequest(t, b, http.MethodPost, "/queues/jobs/messages",
+		`{"messages": [{"body": "first", "headers": {"type": "job"}}, {"body": "second"}]}`)
+	if response.Code != http.StatusOK || strings.TrimSpace(response.Body.String()) != `{"duplicates":0,"enqueued":2}` {
+		t.Fatalf("publish answered %d: %s", response.Code, response.Body)
+	}
+
+	pulled := pullMessages(t, b, "?max=5")
+	if len(pulled) != 2 || pulled[0].Body != "first" || pulled[0].Headers["type"] != "job" || pulled[0].Attempt != 1 {
+		t.Fatalf("pulled %+v, expected both messages", pulled)
+	}
+
+	if response := gatewayRequest(t, b, http.MethodPost, "/queues/jobs/messages/"+pulled[0].ID+"/ack", ""); response.Code != http.StatusNoContent {
+		t.Errorf("ack answered %d: %s", response.Code, response.Body)
+	}
+	if response := gatewayRequest(t, b, http.MethodPost, "/queues/jobs/messages/"+pulled[0].ID+"/ack", ""); response.Code != http.StatusNotFound {
+		t.Errorf("second ack answered %d, expected 404", response.Code)
+	}
+	if response := gatewayRequest(t, b, http.MethodPost, "/queues/jobs/messages/"+pulled[1].ID+"/nack", ""); response.Code != http.StatusNoContent {
+		t.Errorf("nack answered %d: %s", response.Code, response.Body)
+	}
+
+	again := pullMessages(t, b, "")
+	if len(again) != 1 || again[0].Body != "second" || again[0].Attempt != 2 {
+		t.Fatalf("pulled %+v after nack, expected second message again", again)
+	}
+
+	// Not settled within the visibility timeout, so it comes back once more.
+	expired := pullMessages(t, b, "?wait=2s")
+	if len(expired) != 1 || expired[0].Body != "second" || expired[0].Attempt != 3 {
+		t.Errorf("pulled %+v after visibility timeout, expected second message again", expired)
+	}
+	if response := gatewayRequest(t, b, http.MethodPost, "/queues/jobs/messages/"+again[0].ID+"/ack", ""); response.Code != http.StatusNotFound {
+		t.Errorf("ack after visibility timeout answered %d, expected 404", response.Code)
+	}
+}
+
+// Function to check that only the peer that pulled a message can settle it.
+func TestGatewaySettleOwner(t *testing.T) {
+	b := newTestBroker(t, nil)
+	if err := b.CreateQueue("jobs", 10); err != nil {
+		t.Fatal(err)
+	}
+	gatewayRequest(t, b, http.MethodPost, "/queues/jobs/messages", `{"body": "mine"}`)
+	pulled := pullMessages(t, b, "")
+	if len(pulled) != 1 {
+		t.Fatalf("pulled %+v, expected one message", pulled)
+	}
+
+	for _, action := range []string{"ack", "nack"} {
+		request := httptest.NewRequest(http.MethodPost, "/queues/jobs/messages/"+pulled[0].ID+"/"+action, nil)
+		request.RemoteAddr = "198.51.100.7:1234"
+		response := httptest.NewRecorder()
+		b.gateway().ServeHTTP(response, request)
+
+		if response.Code != http.StatusNotFound {
+			t.Errorf("%s of another peer answered %d, expected 404", action, response.Code)
+		}
+	}
+
+	if response := gatewayRequest(t, b, http.MethodPost, "/queues/jobs/messages/"+pulled[0].ID+"/ack", ""); response.Code != http.StatusNoContent {
+		t.Errorf("ack of the peer that pulled the message answered %d: %s", response.Code, response.Body)
+	}
+}
+
+// Function to check that pulling an empty queue waits only as long as asked.
+func TestGatewayPullWait(t *testing.T) {
+	b := newTestBroker(t, nil)
+	if err := b.CreateQueue("jobs", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now()
+	if pulled := pullMessages(t, b, ""); len(pulled) != 0 || time.Since(started) > time.Second {
+		t.Errorf("pulled %+v after %v, expected nothing at once", pulled, time.Since(started))
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		gatewayRequest(t, b, http.MethodPost, "/queues/jobs/messages", `{"body": "late"}`)
+	}()
+	if pulled := pullMessages(t, b, "?wait=5s"); len(pulled) != 1 || pulled[0].Body != "late" {
+		t.Errorf("pulled %+v, expected the message published while waiting", pulled)
+	}
+}
+
+// Function to check that requests to messages that cannot be understood are rejected with their status.
+func TestGatewayMessageErrors(t *testing.T) {
+	b := newTestBroker(t, func(settings *config.Broker) { settings.MaxMessageSize = 5 })
+	if err := b.CreateQueue("jobs", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+		code                     string
+	}{
+		{"unknown queue", http.MethodPost, "/queues/other/messages", `{"body": "a"}`, http.StatusNotFound, "unknown_queue"},
+		{"invalid body", http.MethodPost, "/queues/jobs/messages", `{"text": "a"}`, http.StatusBadRequest, errorBadRequest},
+		{"too large", http.MethodPost, "/queues/jobs/messages", `{"body": "too large"}`, http.StatusRequestEntityTooLarge, "message_too_large"},
+		{"batch over capacity", http.MethodPost, "/queues/jobs/messages", `{"messages": [{"body": "a"}, {"body": "b"}]}`,
+			http.StatusServiceUnavailable, "queue_full"},
+		{"invalid max", http.MethodGet, "/queues/jobs/messages?max=0", "", http.StatusBadRequest, errorBadRequest},
+		{"invalid wait", http.MethodGet, "/queues/jobs/messages?wait=soon", "", http.StatusBadRequest, errorBadRequest},
+		{"wait too long", http.MethodGet, "/queues/jobs/messages?wait=31s", "", http.StatusBadRequest, errorBadRequest},
+		{"settle unknown message", http.MethodPost, "/queues/jobs/messages/7/ack", "", http.StatusNotFound, ""},
+		{"settle with get", http.MethodGet, "/queues/jobs/messages/7/ack", "", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := gatewayRequest(t, b, test.method, test.path, test.body)
+
+			var answer httpError
+			json.NewDecoder(response.Body).Decode(&answer)
+			if response.Code != test.status || answer.Code != test.code {
+				t.Errorf("answered %d with code %q: %s, expected %d with code %q",
+					response.Code, answer.Code, answer.Error, test.status, test.code)
+			}
+		})
+	}
+}
+
+// Function to check that messages published over the HTTP gateway belong to the address of the peer,
+// that the peer cannot publish to the responses queue or take messages of clients, and that its
+// publishes and request bodies are limited.
+func TestGatewayPublishGuards(t *testing.T) {
+	b := newTestBroker(t, func(settings *config.Broker) {
+		settings.Messaging, settings.Server.WritingPort = "multi", "9002"
+		settings.HTTPPublishLimit = config.RateLimit{Messages: 2}
+	})
+	if err := b.CreateQueue("jobs", 10); err != nil {
+		t.Fatal(err)
+	}
+	b.getQueue(responsesQueue)
+	b.getQueue(b.Settings().ClientQueue(0))
+
+	steps := []struct {
+		name, method, path, body string
+		status                   int
+		code                     string
+	}{
+		{"body over the cap", http.MethodPost, "/queues/jobs/messages", `{"body": "` + strings.Repeat("a", maxRequestSize) + `"}`,
+			http.StatusRequestEntityTooLarge, "message_too_large"},
+		{"client ID is replaced", http.MethodPost, "/queues/jobs/messages", `{"client_id": "client-0", "body": "a"}`, http.StatusOK, ""},
+		{"responses queue", http.MethodPost, "/queues/responses/messages", `{"body": "answer"}`, http.StatusForbidden, "unauthorized"},
+		{"queue of a client", http.MethodGet, "/queues/client-0/messages", "", http.StatusForbidden, "unauthorized"},
+		{"within publish limit", http.MethodPost, "/queues/jobs/messages", `{"body": "b"}`, http.StatusOK, ""},
+		{"over publish limit", http.MethodPost, "/queues/jobs/messages", `{"body": "c"}`, http.StatusTooManyRequests, "rate_limited"},
+	}
+
+	for _, step := range steps {
+		response := gatewayRequest(t, b, step.method, step.path, step.body)
+
+		var answer httpError
+		json.NewDecoder(response.Body).Decode(&answer)
+		if response.Code != step.status || answer.Code != step.code {
+			t.Errorf("%s: answered %d with code %q: %s, expected %d with code %q",
+				step.name, response.Code, answer.Code, answer.Error, step.status, step.code)
+		}
+		if step.status == http.StatusTooManyRequests && response.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: answered without Retry-After", step.name)
+		}
+	}
+
+	pulled := pullMessages(t, b, "?max=5")
+	if len(pulled) != 2 || pulled[0].ClientID != "http:192.0.2.1" {
+		t.Errorf("pulled %+v, expected two messages of the address of the peer", pulled)
+	}
+}
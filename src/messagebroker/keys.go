@@ -0,0 +1,68 @@
+package messagebroker
+
+import (
+	"sync"
+
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// A structure that keeps track of keys that have a message in flight. A message with a key
+// is not delivered while another message of the same queue with the same key is in flight,
+// so messages with the same key are handled in order, even by different receivers.
+type keyLocks struct {
+	mutex sync.Mutex
+	held  map[*queueingSystem.Queue]map[string]bool
+}
+
+// Function to create key locks where no key is held.
+func newKeyLocks() *keyLocks {
+	return &keyLocks{held: make(map[*queueingSystem.Queue]map[string]bool)}
+}
+
+// Function to hold a key of a queue. It returns false if the key is already held.
+func (k *keyLocks) acquire(queue *queueingSystem.Queue, key string) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	keys, ok := k.held[queue]
+	if !ok {
+		keys = make(map[string]bool)
+		k.held[queue] = keys
+	}
+
+	if keys[key] {
+		return false
+	}
+	keys[key] = true
+	return true
+}
+
+// Function to release a key of a queue so the next message with the key can be delivered.
+func (k *keyLocks) release(queue *queueingSystem.Queue, key string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	keys := k.held[queue]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(k.held, queue)
+	}
+}
+
+// Function to dequeue the first message of a queue that can be delivered. Messages whose key
+// has a message in flight are skipped, and the key of the dequeued message is held until
+// releaseKey is called for it.
+func (b *Broker) dequeue(queue *queueingSystem.Queue) (queueingSystem.Message, error) {
+	return queue.DequeueFunc(func(message queueingSystem.Message) bool {
+		return message.Key == "" || b.keys.acquire(queue, message.Key)
+	})
+}
+
+// Function to release the key of a message dequeued by dequeue after it is handled.
+// Delivery loops of the queue are notified, as the next message with the key can be delivered now.
+func (b *Broker) releaseKey(queue *queueingSystem.Queue, message queueingSystem.Message) {
+	if message.Key != "" {
+		b.keys.release(queue, message.Key)
+		b.dispatcher.notify(queue)
+	}
+}
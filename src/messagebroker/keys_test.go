@@ -0,0 +1,38 @@
+package messagebroker
+
+import (
+	"testing"
+
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// Function to check that a message waits while a message with the same key is in flight,
+// and that messages with other keys or without a key are delivered meanwhile.
+func TestDequeueKeys(t *testing.T) {
+	b := newTestBroker(t, nil)
+	queue := queueingSystem.CreateQueue("jobs", 10)
+	other := queueingSystem.CreateQueue("audit", 10)
+
+	for _, message := range []queueingSystem.Message{{Key: "a", Body: "a1"}, {Key: "a", Body: "a2"}, {Key: "b", Body: "b1"}, {Body: "none"}} {
+		queue.Enqueue(message)
+	}
+	other.Enqueue(queueingSystem.Message{Key: "a", Body: "other a1"})
+
+	first, _ := b.dequeue(queue)
+	second, _ := b.dequeue(queue)
+	third, _ := b.dequeue(queue)
+	if first.Body != "a1" || second.Body != "b1" || third.Body != "none" {
+		t.Fatalf("dequeued %q, %q, %q, expected a1, b1, none", first.Body, second.Body, third.Body)
+	}
+	if message, err := b.dequeue(queue); err == nil {
+		t.Fatalf("message %q is dequeued while its key is in flight", message.Body)
+	}
+	if message, err := b.dequeue(other); err != nil || message.Body != "other a1" {
+		t.Errorf("key of another queue = %q, %v, expected other a1", message.Body, err)
+	}
+
+	b.releaseKey(queue, first)
+	if message, err := b.dequeue(queue); err != nil || message.Body != "a2" {
+		t.Errorf("after release = %q, %v, expected a2", message.Body, err)
+	}
+}
@@ -0,0 +1,650 @@
+package messagebroker
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+	"distributed-systems-message-queue/src/security"
+)
+
+// A structure that represent a message that is sent to a peer but not acknowledged yet.
+// If the peer is declared dead, the message is put back to the queue it came from.
+type delivery struct {
+	message queueingSystem.Message
+	queue   *queueingSystem.Queue
+}
+
+// A structure that represent one connection of a peer (client or server).
+// The listener stays open so the peer can reconnect after it is declared dead.
+type link struct {
+	broker       *Broker
+	name         string
+	peer         string // name of the peer the link belongs to, shared by its reading and writing links
+	role         string // role the peer has to declare in handshake
+	reading      bool   // whether the peer reads from this link
+	client       int    // index of the client in configuration, -1 for the server
+	listener     net.Listener
+	mutex        sync.Mutex // guards conn, reconnecting, inFlight and transactions
+	conn         *protocol.Conn
+	reconnecting bool       // set while the peer of a dead connection is accepted again
+	reconnected  *sync.Cond // signalled when reconnecting ends
+	inFlight     map[string]delivery
+	transactions map[string]*transaction // open transactions of the peer by ID, only on writing links
+	room         chan struct{}           // has a value when a delivery was acknowledged or put back
+	limiter      rateLimiter             // publish limit of the client, only on writing links
+}
+
+// A structure that keeps track of client IDs of connected peers so two peers cannot use the same ID.
+// It also remembers the reading link of every client so replies are routed by client ID.
+type registry struct {
+	mutex   sync.Mutex
+	owners  map[string]string // client ID to peer name
+	links   map[string]int    // client ID to number of connected links
+	readers map[string]*link  // client ID to reading link
+}
+
+// Function to create an empty registry.
+func newRegistry() *registry {
+	return &registry{owners: make(map[string]string), links: make(map[string]int), readers: make(map[string]*link)}
+}
+
+// Function to register client ID of a new connection of a link.
+// It fails if another peer is already connected with the same client ID.
+func (r *registry) register(l *link, clientID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if clientID == "" {
+		return errors.New("client ID is required")
+	}
+
+	if owner, ok := r.owners[clientID]; ok && owner != l.peer {
+		return errors.New("client ID " + clientID + " is already connected")
+	}
+
+	r.owners[clientID] = l.peer
+	r.links[clientID]++
+	if l.reading {
+		r.readers[clientID] = l
+	}
+	return nil
+}
+
+// Function to unregister client ID of a closed connection.
+// The reading link is still remembered so replies wait for the client to reconnect.
+func (r *registry) unregister(clientID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.links[clientID]--
+	if r.links[clientID] <= 0 {
+		delete(r.links, clientID)
+		delete(r.owners, clientID)
+	}
+}
+
+// Function to get reading link of a client.
+func (r *registry) reader(clientID string) *link {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.readers[clientID]
+}
+
+// Function to create a link and its listener. The peer is accepted later by connect.
+func (b *Broker) listen(peer, role string, reading bool, port string) (*link, error) {
+	listener, err := security.Listen(port, b.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	name := peer + " writing"
+	if reading {
+		name = peer + " reading"
+	}
+
+	l := &link{broker: b, name: name, peer: peer, role: role, reading: reading, client: -1, listener: listener,
+		inFlight: make(map[string]delivery), transactions: make(map[string]*transaction), room: make(chan struct{}, 1)}
+	l.reconnected = sync.NewCond(&l.mutex)
+	b.links = append(b.links, l)
+
+	return l, nil
+}
+
+// Function to wait until the peer of a link connects. The broker only writes to reading links,
+// so they are watched for acknowledgments and heartbeats. It returns false if the broker stopped first.
+func (l *link) connect() bool {
+	conn, err := l.broker.acceptPeer(l)
+	if err != nil {
+		return false
+	}
+
+	l.mutex.Lock()
+	if l.broker.stopped() {
+		l.mutex.Unlock()
+		conn.Close()
+		return false
+	}
+	l.conn = conn
+	l.mutex.Unlock()
+
+	if l.reading {
+		l.broker.spawn(l.watch)
+	}
+
+	return true
+}
+
+// Function to get current connection of a link.
+// It blocks while the link is waiting for the peer to reconnect.
+func (l *link) current() *protocol.Conn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.waitReconnected()
+	return l.conn
+}
+
+// Function to wait until the link is not reconnecting. It is called with the mutex held,
+// which is released while waiting.
+func (l *link) waitReconnected() {
+	for l.reconnecting {
+		l.reconnected.Wait()
+	}
+}
+
+// Function to close current connection of a link, if it has one.
+func (l *link) close() {
+	l.listener.Close()
+
+	conn := l.current()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Function to remember a message that is about to be delivered on current connection.
+func (l *link) track(queue *queueingSystem.Queue, message queueingSystem.Message) (*protocol.Conn, string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.waitReconnected()
+	id := strconv.FormatUint(atomic.AddUint64(&l.broker.deliveryCounter, 1), 10)
+	l.inFlight[id] = delivery{message: message, queue: queue}
+	return l.conn, id
+}
+
+// Function to forget a delivered message after the peer acknowledged it.
+// The next message with the same key can be delivered then.
+func (l *link) acknowledge(conn *protocol.Conn, id string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	d, ok := l.inFlight[id]
+	if l.conn != conn || !ok {
+		return
+	}
+	delete(l.inFlight, id)
+	l.freed()
+
+	l.broker.releaseKey(d.queue, d.message)
+}
+
+// Function to tell the delivery loop of a link that it may have room for more deliveries.
+func (l *link) freed() {
+	select {
+	case l.room <- struct{}{}:
+	default:
+	}
+}
+
+// Function to wait until the peer has fewer unacknowledged deliveries than the prefetch limit.
+// It returns false if the broker stopped first.
+func (l *link) waitRoom() bool {
+	for {
+		prefetch := l.broker.Settings().Prefetch
+
+		l.mutex.Lock()
+		full := prefetch > 0 && len(l.inFlight) >= prefetch
+		l.mutex.Unlock()
+
+		if !full {
+			return true
+		}
+
+		select {
+		case <-l.room:
+		case <-l.broker.done:
+			return false
+		}
+	}
+}
+
+// Function to deliver a message again after the peer rejected it.
+func (l *link) requeue(conn *protocol.Conn, id, reason string) {
+	b := l.broker
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	d, ok := l.inFlight[id]
+	if l.conn != conn || !ok {
+		return
+	}
+	delete(l.inFlight, id)
+	l.freed()
+
+	b.logger.Println("ERROR:", l.name+" rejected message "+id+":", reason)
+
+	b.redeliver(d)
+}
+
+// Function to put a delivered message back to front of its queue, so it is delivered again
+// before messages with the same key that came after it.
+func (b *Broker) redeliver(d delivery) {
+	d.queue.Requeue(d.message)
+	b.releaseKey(d.queue, d.message)
+	b.dispatcher.notify(d.queue)
+	b.logger.Println("LOG:", "message is enqueued again for redelivery", "SIZE:", d.queue.GetSize())
+}
+
+// Function to handle a dead peer. The old connection is closed, messages that were not
+// acknowledged are put back to their queues, open transactions are aborted and it waits until the peer reconnects.
+// The peer is accepted without holding the mutex, so acknowledgments of the old connection and stop
+// are not blocked, but current connection is not handed out until the new one is in place.
+// If the link has already reconnected since the old connection was taken, nothing happens.
+// It returns false if the broker is stopped, then the old connection is kept closed.
+func (l *link) reconnect(old *protocol.Conn, reason error) bool {
+	b := l.broker
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.waitReconnected()
+	if b.stopped() {
+		return false
+	}
+
+	if l.conn != old {
+		return true
+	}
+
+	b.logger.Println("ERROR:", l.name+" is dead:", reason)
+	old.Close()
+	b.clients.unregister(old.ClientID())
+
+	for _, d := range l.inFlight {
+		b.redeliver(d)
+	}
+	l.inFlight = make(map[string]delivery)
+	l.freed()
+	l.abortAll()
+
+	l.reconnecting = true
+	l.mutex.Unlock()
+	conn, err := b.acceptPeer(l)
+	l.mutex.Lock()
+	l.reconnecting = false
+	l.reconnected.Broadcast()
+
+	if err != nil {
+		return false
+	}
+
+	l.conn = conn
+	b.logger.Println("LOG:", l.name+" reconnected")
+	return true
+}
+
+// Function to watch a link that the broker only writes to. It reads acknowledgments
+// and rejections, and reconnects when the peer is declared dead.
+func (l *link) watch() {
+	for {
+		conn := l.current()
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			if !l.reconnect(conn, err) {
+				return
+			}
+			continue
+		}
+
+		switch frame.Type {
+		case protocol.AckFrame:
+			l.acknowledge(conn, frame.ID)
+		case protocol.NackFrame:
+			l.requeue(conn, frame.ID, frame.Reason)
+		}
+	}
+}
+
+// Function to check whether the user of a connection is permitted to do an action on a queue.
+// Everything is permitted when authentication is disabled.
+func (b *Broker) authorized(conn *protocol.Conn, action string, queue *queueingSystem.Queue) bool {
+	return b.users == nil || b.users.Allowed(conn.Username(), action, queue.GetName())
+}
+
+// Function to send message to a receiver. The message is not tracked for redelivery,
+// but if the receiver is dead it is sent again once the receiver reconnects.
+// It returns false if the broker stopped before the message was sent.
+func (l *link) sendMessage(message queueingSystem.Message) bool {
+	for {
+		conn := l.current()
+		err := conn.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ClientID: message.ClientID,
+			CorrelationID: message.CorrelationID, Key: message.Key, Headers: message.Headers, Body: message.Body})
+		if err == nil {
+			return true
+		}
+		if !l.reconnect(conn, err) {
+			return false
+		}
+	}
+}
+
+// Function to deliver a message dequeued by dequeue to a receiver. The message stays in flight
+// until the receiver acknowledges it, and so does its key. If the receiver is declared dead first,
+// the message is put back to the queue. The frame tells the receiver which attempt
+// to deliver the message it is. Receivers that do not support acknowledgments get the message without tracking.
+func (l *link) deliver(queue *queueingSystem.Queue, message queueingSystem.Message) bool {
+	if !l.current().HasCapability(protocol.AckCapability) {
+		defer l.broker.releaseKey(queue, message)
+		return l.sendMessage(message)
+	}
+
+	message.Deliveries++
+	conn, id := l.track(queue, message)
+
+	err := conn.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ID: id, ClientID: message.ClientID,
+		CorrelationID: message.CorrelationID, Key: message.Key, Headers: message.Headers, Body: message.Body, Attempt: message.Deliveries})
+	if err != nil {
+		return l.reconnect(conn, err)
+	}
+	return true
+}
+
+// Function to receive message from a sender. The message will be enqueued to the corresponding queue.
+// The messages of a batch are enqueued together, either all of them or none.
+// If the sender is declared dead, it waits for the sender to reconnect.
+// Messages from producers belong to the client ID given in handshake, whatever the frame says.
+// Messages the sender is not permitted to publish, that are too large or over the publish limit are
+// rejected with an error frame that has a code.
+// A message that was already enqueued within the dedup window of the queue is dropped, but confirmed
+// like an enqueued one, so a producer that publishes it again after a reconnect is not rejected.
+// Senders with the confirm capability get an ack frame for every message with an ID that is
+// enqueued and an error frame with the same ID for every message that is not.
+// Frames of a transaction are staged until it is committed. A commit that enqueues nothing to the queue
+// does not end the wait, so callers that wait for answers to what they received have something to wait for.
+// It returns the messages enqueued to the queue, or ErrStopped if the broker stopped while waiting.
+func (l *link) receiveMessage(q *queueingSystem.Queue) ([]queueingSystem.Message, error) {
+	b := l.broker
+
+	for {
+		conn := l.current()
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			if !l.reconnect(conn, err) {
+				return nil, ErrStopped
+			}
+			continue
+		}
+
+		var frames []protocol.Frame
+		switch frame.Type {
+		case protocol.MessageFrame:
+			frames = []protocol.Frame{frame}
+		case protocol.BatchFrame:
+			frames = frame.Messages
+		case protocol.BeginFrame:
+			l.begin(conn, frame)
+			continue
+		case protocol.AckFrame:
+			if frame.Transaction != "" {
+				l.stageAck(conn, frame)
+			}
+			continue
+		case protocol.CommitFrame:
+			if enqueued := l.commit(conn, q, frame); len(enqueued) > 0 {
+				return enqueued, nil
+			}
+			continue
+		case protocol.AbortFrame:
+			l.abort(conn, frame)
+			continue
+		default:
+			continue
+		}
+
+		if err := l.checkPublish(frames); err != nil {
+			if err != ErrStopped {
+				l.rejectAll(conn, frame.Transaction, frames, err)
+			}
+			continue
+		}
+
+		if frame.Transaction != "" {
+			l.stage(conn, q, frame.Transaction, frames)
+			continue
+		}
+
+		if !b.authorized(conn, auth.Publish, q) {
+			l.rejectAll(conn, "", frames, newRejection(protocol.ErrorUnauthorized, "not permitted to publish to queue "+q.GetName()))
+			continue
+		}
+
+		messages := make([]queueingSystem.Message, len(frames))
+		ids := make([]string, len(frames))
+		for i, frame := range frames {
+			messages[i] = queueingSystem.Message{ClientID: frame.ClientID, CorrelationID: frame.CorrelationID, Key: frame.Key,
+				Headers: frame.Headers, Body: frame.Body}
+			if conn.Role() == protocol.RoleProducer {
+				messages[i].ClientID = conn.ClientID()
+			}
+			b.correlate(&messages[i])
+			ids[i] = dedupID(frame)
+		}
+
+		duplicates, err := b.enqueue(q, messages, ids)
+		for _, frame := range frames {
+			b.confirm(conn, frame.ID, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		enqueued := make([]queueingSystem.Message, 0, len(messages))
+		for i, duplicate := range duplicates {
+			if duplicate {
+				b.logger.Println("LOG:", "duplicate message "+ids[i]+" is dropped")
+			} else {
+				enqueued = append(enqueued, messages[i])
+			}
+		}
+
+		if len(enqueued) > 0 {
+			b.logger.Println("LOG:", "enqueued "+strconv.Itoa(len(enqueued))+" to queue", "SIZE:", q.GetSize())
+		}
+
+		return enqueued, nil
+	}
+}
+
+// Function to check messages a peer published against the maximum message size and the publish
+// limit of the client. With the throttle policy it waits until the limit allows the messages,
+// with the reject policy messages over the limit are rejected with a hint how long to wait.
+// It returns ErrStopped if the broker stopped while waiting.
+func (l *link) checkPublish(frames []protocol.Frame) error {
+	b := l.broker
+	current := b.Settings()
+
+	bytes := 0
+	for _, frame := range frames {
+		if err := b.checkSize(frame.Body); err != nil {
+			return err
+		}
+		bytes += len(frame.Body)
+	}
+
+	if l.client < 0 {
+		return nil
+	}
+
+	client := current.Clients[l.client]
+	if !client.PublishLimit.Enabled() {
+		return nil
+	}
+
+	for {
+		wait := l.limiter.take(client.PublishLimit, len(frames), bytes)
+		if wait == 0 {
+			return nil
+		}
+
+		if client.OverLimitPolicy() == config.OverLimitReject {
+			return &rejection{code: protocol.ErrorRateLimited, reason: "publish rate limit exceeded", retryAfter: wait}
+		}
+
+		if !b.sleep(wait) {
+			return ErrStopped
+		}
+	}
+}
+
+// Function to reject messages a peer published. Every frame gets an error frame with the reason,
+// also frames without ID so the peer knows its messages are lost. The transaction the messages
+// belong to fails, its frames without ID are not rejected one by one as the commit reports the error.
+func (l *link) rejectAll(conn *protocol.Conn, transaction string, frames []protocol.Frame, err error) {
+	l.broker.logger.Println("ERROR:", l.name+":", err.Error()+", "+strconv.Itoa(len(frames))+" messages are rejected")
+
+	if transaction != "" {
+		l.fail(transaction, err)
+	}
+
+	for _, frame := range frames {
+		if transaction != "" && frame.ID == "" {
+			continue
+		}
+		if err := conn.WriteFrame(errorFrame(frame.ID, err)); err != nil {
+			return
+		}
+	}
+}
+
+// Function to confirm a published message to its sender. The message is accepted when err is nil,
+// otherwise it is rejected with an error frame that has err as reason and its code. An accepted
+// message is not confirmed if it has no ID or the sender does not support confirms, but a rejected
+// message always is, so the sender knows it is lost.
+func (b *Broker) confirm(conn *protocol.Conn, id string, err error) {
+	frame := protocol.Frame{Type: protocol.AckFrame, ID: id}
+	if err != nil {
+		frame = errorFrame(id, err)
+	} else if id == "" || !conn.HasCapability(protocol.ConfirmCapability) {
+		return
+	}
+
+	if err := conn.WriteFrame(frame); err != nil {
+		b.logger.Println("ERROR:", "could not confirm message "+id+":", err)
+	}
+}
+
+// Function to accept connections on a link until a peer completes handshake.
+// It fails only when the listener is closed because the broker stopped.
+func (b *Broker) acceptPeer(l *link) (*protocol.Conn, error) {
+	for {
+		conn, err := b.acceptConn(l)
+		if err == nil {
+			return conn, nil
+		}
+		if b.stopped() {
+			return nil, ErrStopped
+		}
+		b.logger.Println("ERROR:", l.name+":", err)
+	}
+}
+
+// Function to accept a connection of a link and do handshake with the peer.
+func (b *Broker) acceptConn(l *link) (*protocol.Conn, error) {
+	netConn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.handshake(netConn, l.role, l)
+}
+
+// Function to do handshake with a peer. The peer is rejected if it declares another role than
+// expected or its client ID is already used by another peer. Peers of a link are registered,
+// admin peers are not. If the peer has a verified certificate, its client ID is the certificate subject.
+// When authentication is enabled, the peer is rejected unless its credentials or certificate
+// belong to a user, and a peer without client ID is identified by its user name.
+func (b *Broker) handshake(netConn net.Conn, role string, l *link) (*protocol.Conn, error) {
+	conn := protocol.NewConn(netConn)
+	registered := false
+	current := b.Settings()
+
+	netConn.SetDeadline(time.Now().Add(current.HandshakeTimeout.Duration))
+
+	hello, err := conn.AcceptHandshake(current.Heartbeat.Duration, func(hello *protocol.Frame) error {
+		if hello.Role != role {
+			return errors.New("role " + hello.Role + " is not allowed, expected " + role)
+		}
+
+		identity, ok := security.PeerIdentity(netConn)
+		if ok {
+			if hello.ClientID != "" && hello.ClientID != identity {
+				return errors.New("client ID " + hello.ClientID + " does not match certificate " + identity)
+			}
+			hello.ClientID = identity
+		}
+
+		if b.users != nil {
+			username, err := b.users.Authenticate(hello.Username, hello.Password, hello.Token, identity)
+			if err != nil {
+				return err
+			}
+
+			hello.Username = username
+			if hello.ClientID == "" {
+				hello.ClientID = username
+			}
+		}
+
+		if l == nil {
+			return nil
+		}
+
+		err := b.clients.register(l, hello.ClientID)
+		registered = err == nil
+		return err
+	})
+	if err != nil {
+		if registered {
+			b.clients.unregister(hello.ClientID)
+		}
+		conn.Close()
+		return nil, err
+	}
+
+	if conn.Heartbeat() == 0 {
+		netConn.SetDeadline(time.Time{})
+	}
+
+	b.logger.Println("LOG:", "established a "+b.connectionType()+" connection with "+hello.Role+" "+hello.ClientID+" "+
+		conn.LocalAddr().String(), "HEARTBEAT:", conn.Heartbeat())
+
+	return conn, nil
+}
+
+// Function to get type of connections for logging.
+func (b *Broker) connectionType() string {
+	if b.tlsConfig != nil {
+		return "TLS"
+	}
+	return "TCP"
+}
@@ -0,0 +1,260 @@
+package messagebroker
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// Function to create a link of a test broker with a connection whose peer discards every frame written to it.
+func newTestLink(t *testing.T) (*link, *protocol.Conn) {
+	t.Helper()
+
+	first, second := net.Pipe()
+	t.Cleanup(func() {
+		first.Close()
+		second.Close()
+	})
+	go io.Copy(io.Discard, second)
+
+	conn := protocol.NewConn(first)
+	l := &link{broker: newTestBroker(t, nil), name: "server reading", peer: "server", reading: true, conn: conn,
+		inFlight: make(map[string]delivery), room: make(chan struct{}, 1)}
+	l.reconnected = sync.NewCond(&l.mutex)
+	return l, conn
+}
+
+// Function to check what happens to a delivered message when the peer acknowledges or rejects it,
+// on the current connection or on one that has been replaced.
+func TestAcknowledgeAndRequeue(t *testing.T) {
+	tests := []struct {
+		name     string
+		answer   func(l *link, conn *protocol.Conn, id string)
+		inFlight int
+		queued   int
+	}{
+		{"acknowledged", func(l *link, conn *protocol.Conn, id string) { l.acknowledge(conn, id) }, 0, 0},
+		{"rejected", func(l *link, conn *protocol.Conn, id string) { l.requeue(conn, id, "handler failed") }, 0, 1},
+		{"rejected twice", func(l *link, conn *protocol.Conn, id string) {
+			l.requeue(conn, id, "handler failed")
+			l.requeue(conn, id, "handler failed")
+		}, 0, 1},
+		{"unknown message", func(l *link, conn *protocol.Conn, id string) { l.requeue(conn, "other", "handler failed") }, 1, 0},
+		{"rejected on old connection", func(l *link, conn *protocol.Conn, id string) {
+			l.requeue(protocol.NewConn(nil), id, "handler failed")
+		}, 1, 0},
+		{"acknowledged on old connection", func(l *link, conn *protocol.Conn, id string) {
+			l.acknowledge(protocol.NewConn(nil), id)
+		}, 1, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, conn := newTestLink(t)
+			queue := queueingSystem.CreateQueue("requests", 10)
+
+			_, id := l.track(queue, queueingSystem.Message{ClientID: "client-0", Body: "hello", Deliveries: 1})
+			test.answer(l, conn, id)
+
+			if len(l.inFlight) != test.inFlight {
+				t.Errorf("%d messages in flight, expected %d", len(l.inFlight), test.inFlight)
+			}
+			if queue.GetSize() != test.queued {
+				t.Fatalf("%d messages in queue, expected %d", queue.GetSize(), test.queued)
+			}
+			if test.queued > 0 {
+				message, _ := queue.Dequeue()
+				if message.Body != "hello" || message.ClientID != "client-0" || message.Deliveries != 1 {
+					t.Errorf("requeued message = %+v", message)
+				}
+			}
+		})
+	}
+}
+
+// Function to check that the messages of a batch are enqueued together, or none of them
+// when the queue has no room for all.
+func TestReceiveBatch(t *testing.T) {
+	first, second := net.Pipe()
+	defer first.Close()
+	defer second.Close()
+
+	l := &link{broker: newTestBroker(t, nil), name: "client writing", peer: "client", conn: protocol.NewConn(first),
+		inFlight: make(map[string]delivery)}
+	sender := protocol.NewConn(second)
+	queue := queueingSystem.CreateQueue("client-0", 3)
+
+	batch := func(bodies ...string) protocol.Frame {
+		frame := protocol.Frame{Type: protocol.BatchFrame}
+		for _, body := range bodies {
+			frame.Messages = append(frame.Messages, protocol.Frame{Type: protocol.MessageFrame, ClientID: "client-0", Body: body})
+		}
+		return frame
+	}
+
+	rejections := make(chan protocol.Frame, 2)
+	go func() {
+		sender.WriteFrame(batch("a", "b"))
+		sender.WriteFrame(batch("c", "d"))
+		for i := 0; i < 2; i++ {
+			frame, err := sender.ReadFrame()
+			if err != nil {
+				return
+			}
+			rejections <- frame
+		}
+	}()
+
+	if messages, err := l.receiveMessage(queue); len(messages) != 2 || err != nil {
+		t.Fatalf("received %d messages, %v, expected 2", len(messages), err)
+	}
+	if messages, err := l.receiveMessage(queue); len(messages) != 0 || err == nil {
+		t.Errorf("received %d messages, %v, expected the batch to be rejected", len(messages), err)
+	}
+	for i := 0; i < 2; i++ {
+		if frame := <-rejections; frame.Type != protocol.ErrorFrame || frame.Code != protocol.ErrorQueueFull {
+			t.Errorf("rejection = %+v, expected queue full", frame)
+		}
+	}
+	if queue.GetSize() != 2 {
+		t.Errorf("%d messages in queue, expected 2", queue.GetSize())
+	}
+}
+
+// Function to check that a delivery waits while the peer has as many unacknowledged deliveries
+// as the prefetch limit, and goes on once one of them is acknowledged.
+func TestWaitRoom(t *testing.T) {
+	l, conn := newTestLink(t)
+	queue := queueingSystem.CreateQueue("requests", 10)
+	settings := l.broker.Settings()
+	settings.Prefetch = 2
+	l.broker.settings = settings
+
+	_, first := l.track(queue, queueingSystem.Message{Body: "first"})
+	if !l.waitRoom() {
+		t.Fatal("delivery waits below the prefetch limit")
+	}
+	l.track(queue, queueingSystem.Message{Body: "second"})
+
+	room := make(chan bool, 1)
+	go func() { room <- l.waitRoom() }()
+
+	select {
+	case <-room:
+		t.Fatal("delivery does not wait at the prefetch limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l.acknowledge(conn, first)
+	select {
+	case ok := <-room:
+		if !ok {
+			t.Error("waiting for room failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery waits after a message is acknowledged")
+	}
+}
+
+// Function to check that the headers of a received message are kept in the queue and passed on
+// when it is delivered.
+func TestHeaders(t *testing.T) {
+	first, second := net.Pipe()
+	defer first.Close()
+	defer second.Close()
+
+	l := &link{broker: newTestBroker(t, nil), name: "server reading", peer: "server", conn: protocol.NewConn(first),
+		inFlight: make(map[string]delivery), room: make(chan struct{}, 1)}
+	peer := protocol.NewConn(second)
+	queue := queueingSystem.CreateQueue("client-0", 3)
+	headers := map[string]string{"source": "cli", "type": "login"}
+
+	delivered := make(chan protocol.Frame, 1)
+	go func() {
+		peer.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ClientID: "client-0", Headers: headers, Body: "hello"})
+		frame, _ := peer.ReadFrame()
+		delivered <- frame
+	}()
+
+	messages, err := l.receiveMessage(queue)
+	if err != nil || len(messages) != 1 || !reflect.DeepEqual(messages[0].Headers, headers) {
+		t.Fatalf("received %+v, %v, expected a message with headers %v", messages, err, headers)
+	}
+
+	message, _ := queue.Dequeue()
+	if !l.deliver(queue, message) {
+		t.Fatal("message is not delivered")
+	}
+	if frame := <-delivered; frame.Body != "hello" || !reflect.DeepEqual(frame.Headers, headers) {
+		t.Errorf("delivered %+v, expected headers %v", frame, headers)
+	}
+}
+
+// Function to check that a link waiting for its peer to reconnect does not hold its mutex,
+// so answers on the old connection are not blocked, while its connection is only handed out once the peer is back.
+func TestReconnect(t *testing.T) {
+	l, old := newTestLink(t)
+	l.role = protocol.RoleConsumer
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	l.listener = listener
+
+	queue := queueingSystem.CreateQueue("requests", 10)
+	_, id := l.track(queue, queueingSystem.Message{Body: "hello"})
+
+	reconnected := make(chan bool, 1)
+	go func() { reconnected <- l.reconnect(old, errors.New("connection reset")) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.GetSize() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if queue.GetSize() != 1 {
+		t.Fatal("message in flight is not put back")
+	}
+
+	answered := make(chan struct{})
+	go func() {
+		l.acknowledge(old, id)
+		close(answered)
+	}()
+	select {
+	case <-answered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("acknowledgment blocks while the peer is accepted")
+	}
+
+	current := make(chan *protocol.Conn, 1)
+	go func() { current <- l.current() }()
+	select {
+	case <-current:
+		t.Fatal("connection is handed out before the peer reconnects")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	netConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+	if _, err := protocol.NewConn(netConn).Handshake(protocol.Frame{ClientID: "consumer-test", Role: protocol.RoleConsumer}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok := <-reconnected; !ok {
+		t.Fatal("reconnect failed")
+	}
+	if conn := <-current; conn == old || conn == nil {
+		t.Error("old connection is handed out after the peer reconnected")
+	}
+}
@@ -0,0 +1,355 @@
+package messagebroker
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/config"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// Fucntion to write a message from client corresponding queue to server.
+// Queues the server is not permitted to consume from are skipped. A message waits while
+// another message with the same key is in flight. Nothing is dequeued while the server has
+// as many unacknowledged messages as the prefetch limit. The scheduling policy decides which
+// of the queues that have messages goes next, and a queue waits while it is over its delivery limit.
+// If delivered is not nil, it is called with every message delivered to the server.
+func (b *Broker) serverWriteTo(name string, readLink *link, queues []*queueingSystem.Queue,
+	delivered func(message queueingSystem.Message) bool) {
+	s := b.dispatcher.subscribe(queues)
+	defer b.dispatcher.unsubscribe(s)
+
+	for readLink.waitRoom() {
+		queue, ok := s.next(b.done)
+		if !ok {
+			return
+		}
+
+		if !b.authorized(readLink.current(), auth.Consume, queue) || !b.canDeliver(queue) {
+			continue
+		}
+
+		message, err := b.dequeue(queue)
+		if err != nil {
+			s.idle(queue)
+			continue
+		}
+		s.dequeued(queue, message)
+		b.chargeDelivery(queue, message)
+
+		b.logger.Println("LOG:", `send message to the `+name)
+
+		if !readLink.deliver(queue, message) {
+			return
+		}
+
+		if delivered != nil && !delivered(message) {
+			return
+		}
+	}
+}
+
+// Fucntion to write a message that is from a queue to a connection.
+// The connection is the reading link of the client the message belongs to.
+// A message that answers a request of the client in sync mode finishes the request.
+func (b *Broker) writeTo(name string, queue *queueingSystem.Queue) {
+	s := b.dispatcher.subscribe([]*queueingSystem.Queue{queue})
+	defer b.dispatcher.unsubscribe(s)
+
+	for {
+		if _, ok := s.next(b.done); !ok {
+			return
+		}
+
+		if !b.canDeliver(queue) {
+			continue
+		}
+
+		message, err := b.dequeue(queue)
+		if err != nil {
+			continue
+		}
+		s.dequeued(queue, message)
+		b.chargeDelivery(queue, message)
+
+		readLink := b.clients.reader(message.ClientID)
+		if readLink == nil {
+			b.logger.Println("ERROR:", "drop message for unknown client "+message.ClientID)
+			b.releaseKey(queue, message)
+			continue
+		}
+		if !readLink.deliver(queue, message) {
+			return
+		}
+		b.answer(message)
+	}
+}
+
+// Function to log that the broker is still alive every few seconds until it stops.
+func (b *Broker) keepAlive() {
+	for b.sleep(10 * time.Second) {
+		b.logger.Println("LOG:", "doing something ...")
+	}
+}
+
+// Fucntion to handle message passing asynchronously. Every client is read by its own goroutine,
+// and the server gets the messages of all client queues as the scheduling policy merges them.
+func (b *Broker) handleMessagePassingAsynchronously(serverLink *link, clientQueues, sourceQueues []*queueingSystem.Queue) {
+	signals := make(chan queueingSystem.Message)
+
+	b.handleClients(clientQueues, signals)
+	b.spawn(func() { b.handleServer(serverLink, sourceQueues, signals) })
+
+	b.keepAlive()
+}
+
+// Fucntion to handle running server async.
+func (b *Broker) runServer(name string, serverReadLink, serverWriteLink *link, sourceQueue []*queueingSystem.Queue, destinationQueue *queueingSystem.Queue) {
+	b.spawn(func() { b.readFrom(name, serverWriteLink, destinationQueue, false) })
+	b.spawn(func() { b.serverWriteTo(name, serverReadLink, sourceQueue, nil) })
+}
+
+// Function to handle running client async. It will use goroutines for reading of each client and one goroutines for writing to server.
+// Each client writes to the queue at the same index. In sync mode a client waits for the answers to its requests.
+func (b *Broker) runClients(name string, clientQueues []*queueingSystem.Queue, destinationQueue *queueingSystem.Queue, sync bool) {
+	b.readClients(clientQueues, sync)
+
+	b.spawn(func() { b.writeTo(name, destinationQueue) })
+}
+
+// Function to read messages of every client in its own goroutine. Each client writes to the queue at the same index.
+// In sync mode a client waits for the answers to its requests.
+func (b *Broker) readClients(clientQueues []*queueingSystem.Queue, sync bool) {
+	for i := range clientQueues {
+		writeLink, queue := b.clientWriteLinks[i], clientQueues[i]
+		b.spawn(func() { b.readFrom(writeLink.peer, writeLink, queue, sync) })
+	}
+}
+
+// Function to wait for each client and get its corresponding queue. Clients are accepted at the same time,
+// so they can connect in any order. Clients that are configured with the same queue share it,
+// so source queues have every queue once. It returns false if the broker stopped first.
+func (b *Broker) connectClients() ([]*queueingSystem.Queue, []*queueingSystem.Queue, bool) {
+	clientQueues := make([]*queueingSystem.Queue, 0)
+	sourceQueues := make([]*queueingSystem.Queue, 0)
+	seen := make(map[string]bool)
+
+	connected := make([]bool, len(b.clientWriteLinks))
+	var wg sync.WaitGroup
+	for i := range b.clientWriteLinks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			connected[i] = b.clientReadLinks[i].connect() && b.clientWriteLinks[i].connect()
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range b.clientWriteLinks {
+		if !connected[i] {
+			return nil, nil, false
+		}
+
+		name := b.Settings().ClientQueue(i)
+		if !seen[name] {
+			sourceQueues = append(sourceQueues, b.getQueue(name))
+			seen[name] = true
+		}
+		clientQueues = append(clientQueues, b.getQueue(name))
+	}
+
+	return clientQueues, sourceQueues, true
+}
+
+// Function to handle multi-way message passing with multiple clients. It first waits for the server.
+// Waits for each client and gets its corresponding queue. Then it will run each client and server as a goroutines.
+func (b *Broker) handleMultipleClients(sync bool) {
+	if !b.serverReadLink.connect() || !b.serverWriteLink.connect() {
+		return
+	}
+
+	clientQueues, sourceQueues, ok := b.connectClients()
+	if !ok {
+		return
+	}
+
+	destinationQueue := b.getQueue(responsesQueue)
+
+	b.runClients("client", clientQueues, destinationQueue, sync)
+
+	b.runServer("server", b.serverReadLink, b.serverWriteLink, sourceQueues, destinationQueue)
+
+	b.keepAlive()
+}
+
+// Function to handle multi-way message passing asynchronously.
+// Asynchronously multi-way message passing can handle multiple clients.
+func (b *Broker) handleAsync() {
+	b.handleMultipleClients(false)
+}
+
+// Function to handle multi-way message passing synchronously. It can handle multiple clients too, but
+// the next request of a client is only read after the server answered its previous ones or they timed out.
+// So every client waits for its own requests, while the server goes on with requests of other clients.
+func (b *Broker) handleSync() {
+	b.handleMultipleClients(true)
+}
+
+// Function to handle multy-way messaging. Multi-way messaging can be handled
+// synchronously or asynchronously that is based on message passing mode parameter.
+func (b *Broker) handleMultiWayMessaging(messagePassingMode string) {
+	switch messagePassingMode {
+	case "sync":
+		b.handleSync()
+	case "async":
+		b.handleAsync()
+	default:
+		b.logger.Println("ERROR:", "mode does not exist")
+	}
+}
+
+// Function to handle server. After receiving a message from a client. The message will be edqueued.
+// So whenever a client queue is not empty a message is dequeued and sent to server, the scheduling policy
+// decides which queue goes next. After a message is sent, a signal is passed so the client gets an acknowledgment.
+// Nothing is sent while the server is not permitted to consume from the queue or has as many
+// unacknowledged messages as the prefetch limit.
+func (b *Broker) handleServer(serverLink *link, sourceQueues []*queueingSystem.Queue,
+	signals chan queueingSystem.Message) {
+	b.serverWriteTo("server", serverLink, sourceQueues, func(message queueingSystem.Message) bool {
+		select {
+		case signals <- message:
+		case <-b.done:
+			return false
+		}
+
+		return b.sleep(8 * time.Second)
+	})
+}
+
+// Function to handle writing to clients. This function waits for a signal to
+// check whether a client message is sent to server or not. If it is, a signal is passed thorough channel
+// an acknowledgment can be sent to the client the message belongs to.
+func (b *Broker) writeToClient(signals chan queueingSystem.Message) {
+	for {
+		var message queueingSystem.Message
+		select {
+		case message = <-signals:
+		case <-b.done:
+			return
+		}
+
+		if !b.reachedServer(message) {
+			return
+		}
+	}
+}
+
+// Function to handle reading. It infinitely receive message from a sender.
+// When the queue is full, the overflow policy of the queue decides what happens. With pause it
+// ignores new messages for a while so that queue gets less crowded, with drop the message or batch is lost
+// and with exit buffer overflow stops the broker with an error.
+// In sync mode it waits until the server answered the received messages, or they timed out, before it reads more.
+func (b *Broker) readFrom(name string, writeLink *link, queue *queueingSystem.Queue, sync bool) {
+	for {
+		messages, err := writeLink.receiveMessage(queue)
+		if err == ErrStopped {
+			return
+		}
+
+		if err == nil {
+			b.logger.Println("LOG:", name+" request is received")
+			if sync && !b.await(b.expect(messages)) {
+				return
+			}
+			continue
+		}
+
+		switch b.Settings().Queue(queue.GetName()).Overflow {
+		case config.OverflowPause:
+			b.logger.Println("ERROR:", err)
+			if !b.sleep(b.Settings().OverflowPause.Duration) {
+				return
+			}
+		case config.OverflowDrop:
+			b.logger.Println("ERROR:", err, "message from "+name+" is dropped")
+		default:
+			b.fail(err)
+			return
+		}
+	}
+}
+
+// Function to handle clients. Every client is read by its own goroutine and one goroutine writes
+// acknowledgments to all of them. It means reading and writing will execute concurrently.
+func (b *Broker) handleClients(clientQueues []*queueingSystem.Queue, signals chan queueingSystem.Message) {
+	b.readClients(clientQueues, false)
+	b.spawn(func() { b.writeToClient(signals) })
+}
+
+// Function to handle massage passing synchronously. The next request of a client is only read after
+// the server received its previous ones, or they timed out, while other clients go on. When the server
+// receives a request, an acknowledgment is sent to the client.
+func (b *Broker) handleMessagePassingSynchronously(serverLink *link, clientQueues, sourceQueues []*queueingSystem.Queue) {
+	b.readClients(clientQueues, true)
+	b.spawn(func() { b.serverWriteTo("server", serverLink, sourceQueues, b.reachedServer) })
+
+	b.keepAlive()
+}
+
+// Function to send an acknowledgment to the client of a request that has reached the server.
+// It returns false if the broker stopped before the acknowledgment was sent.
+func (b *Broker) reachedServer(message queueingSystem.Message) bool {
+	b.answer(message)
+
+	readLink := b.clients.reader(message.ClientID)
+	if readLink == nil {
+		b.logger.Println("ERROR:", "drop acknowledgment for unknown client "+message.ClientID)
+		return true
+	}
+
+	b.logger.Println("LOG:", `send an acknowledgment to the client`)
+
+	return readLink.sendMessage(queueingSystem.Message{ClientID: message.ClientID, CorrelationID: message.CorrelationID,
+		Body: strings.TrimSpace(message.Body) + " has reached the server successfully"})
+}
+
+// Function to handle one way messaging. It waits for server and clients and gets the corresponding queues.
+// Any number of clients can publish, their messages are merged under the same scheduling and overflow policies.
+// And handle message passing synchronously or asynchronously based on message passing mode.
+func (b *Broker) handleOneWayMessaging(messagePassingMode string) {
+	serverLink := b.serverReadLink
+
+	if !serverLink.connect() {
+		return
+	}
+
+	clientQueues, sourceQueues, ok := b.connectClients()
+	if !ok {
+		return
+	}
+
+	switch messagePassingMode {
+	case "sync":
+		b.handleMessagePassingSynchronously(serverLink, clientQueues, sourceQueues)
+	case "async":
+		b.handleMessagePassingAsynchronously(serverLink, clientQueues, sourceQueues)
+	default:
+		b.logger.Println("ERROR:", "mode does not exist")
+	}
+}
+
+// Function to handle how program message passing work based on messaging mode that can be one or multi.
+// When messaging mode is one that means server only reads from broker.
+// when messaging mode is multi that means server reads and writes from and to broker.
+func (b *Broker) handleMessagePassing() {
+	switch b.Settings().Messaging {
+	case "one":
+		b.handleOneWayMessaging(b.Settings().Mode)
+	case "multi":
+		b.handleMultiWayMessaging(b.Settings().Mode)
+	default:
+		b.logger.Println("ERROR:", "mode does not exist")
+	}
+}
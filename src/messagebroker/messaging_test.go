@@ -0,0 +1,173 @@
+package messagebroker
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/consumer"
+	"distributed-systems-message-queue/src/producer"
+)
+
+// Function to start a broker for multi-way messaging with given mode and number of clients,
+// and a server that answers every request with the body in upper case.
+func startMultiWay(t *testing.T, mode string, clients int) *Broker {
+	t.Helper()
+
+	b := startTestBroker(t, func(settings *config.Broker) {
+		settings.Messaging, settings.Mode = "multi", mode
+		settings.Server.WritingPort = freePort(t)
+		settings.Clients = make([]config.Client, clients)
+		for i := range settings.Clients {
+			settings.Clients[i].ReadingPort, settings.Clients[i].WritingPort = freePort(t), freePort(t)
+		}
+	})
+	settings := b.Settings()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, err := consumer.Connect(ctx, settings.Server.ReadingPort, settings.Server.WritingPort,
+		consumer.WithClientID("server"), consumer.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running, stop := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		server.Run(running, func(ctx context.Context, message consumer.Message) error {
+			return server.Reply(message, "ANSWER TO "+message.Body)
+		})
+	}()
+	t.Cleanup(func() {
+		stop()
+		<-finished
+		server.Close()
+	})
+
+	return b
+}
+
+// Function to connect a producer as the client with given index.
+func connectClient(t *testing.T, b *Broker, client int) *producer.Producer {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	listener := b.Settings().Clients[client].Listener
+	p, err := producer.Connect(ctx, listener.ReadingPort, listener.WritingPort,
+		producer.WithClientID("client-"+strconv.Itoa(client)), producer.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// Function to check that every client in sync mode gets the answers to its own requests,
+// while other clients send requests at the same time.
+func TestSyncManyClients(t *testing.T) {
+	b := startMultiWay(t, "sync", 3)
+
+	var wg sync.WaitGroup
+	for client := 0; client < 3; client++ {
+		p := connectClient(t, b, client)
+
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				body := "question " + strconv.Itoa(i) + " of client " + strconv.Itoa(client)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				reply, err := p.Request(ctx, body)
+				cancel()
+
+				if err != nil || reply.Body != "ANSWER TO "+body {
+					t.Errorf("reply = %q, %v, expected answer to %q", reply.Body, err, body)
+					return
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+}
+
+// Function to check that clients can connect in any order, not only in the order they are configured in.
+// Clients are served once all of them are connected.
+func TestClientsConnectInAnyOrder(t *testing.T) {
+	b := startMultiWay(t, "async", 3)
+
+	producers := make(map[int]*producer.Producer)
+	for _, client := range []int{2, 0, 1} {
+		producers[client] = connectClient(t, b, client)
+	}
+
+	for client, p := range producers {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reply, err := p.Request(ctx, "hello")
+		cancel()
+		if err != nil || reply.Body != "ANSWER TO hello" {
+			t.Fatalf("client %d gets reply %q, %v, expected an answer", client, reply.Body, err)
+		}
+	}
+}
+
+// Function to check that one-way messaging takes the messages of every producer to the server.
+func TestOneWayManyProducers(t *testing.T) {
+	b := startTestBroker(t, func(settings *config.Broker) {
+		settings.Messaging, settings.Mode = "one", "sync"
+		settings.Clients = make([]config.Client, 3)
+		for i := range settings.Clients {
+			settings.Clients[i].ReadingPort, settings.Clients[i].WritingPort = freePort(t), freePort(t)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server, err := consumer.Connect(ctx, b.Settings().Server.ReadingPort, "",
+		consumer.WithClientID("server"), consumer.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	received := make(chan string)
+	go server.Run(ctx, func(ctx context.Context, message consumer.Message) error {
+		select {
+		case received <- message.Body:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+
+	expects := make(map[string]bool)
+	for client := 0; client < 3; client++ {
+		p := connectClient(t, b, client)
+		for i := 0; i < 2; i++ {
+			body := "event " + strconv.Itoa(i) + " of client " + strconv.Itoa(client)
+			expects[body] = true
+			go p.Publish(ctx, body)
+		}
+	}
+
+	for len(expects) > 0 {
+		select {
+		case body := <-received:
+			if !expects[body] {
+				t.Fatalf("server received %q that is not expected", body)
+			}
+			delete(expects, body)
+		case <-ctx.Done():
+			t.Fatalf("server did not receive %d messages", len(expects))
+		}
+	}
+}
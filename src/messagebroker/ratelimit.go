@@ -0,0 +1,229 @@
+package messagebroker
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// A structure that represent a token bucket. Tokens are added at the rate of its limit,
+// up to the rate times the burst of the limit.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens were last added
+}
+
+// Function to add tokens for the time since they were last added. A new bucket starts full.
+func (t *tokenBucket) fill(rate float64, burst time.Duration, now time.Time) {
+	capacity := rate * burst.Seconds()
+	if t.last.IsZero() {
+		t.tokens = capacity
+	} else {
+		t.tokens = math.Min(capacity, t.tokens+rate*now.Sub(t.last).Seconds())
+	}
+	t.last = now
+}
+
+// Function to get how long to wait until the bucket has n tokens. An amount larger than the
+// bucket can hold only has to wait until the bucket is full.
+func (t *tokenBucket) wait(rate float64, burst time.Duration, n float64) time.Duration {
+	needed := math.Min(n, rate*burst.Seconds())
+	if t.tokens >= needed {
+		return 0
+	}
+	return time.Duration((needed - t.tokens) / rate * float64(time.Second))
+}
+
+// A structure that limits messages and bytes of message bodies with a token bucket each.
+// It is safe to use from multiple goroutines.
+type rateLimiter struct {
+	mutex    sync.Mutex
+	messages tokenBucket
+	bytes    tokenBucket
+}
+
+// Function to get how long to wait until the limit allows given messages and bytes.
+// The tokens are taken only if it does not need to wait.
+func (r *rateLimiter) take(limit config.RateLimit, messages, bytes int) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	burst := limit.BurstDuration()
+	wait := time.Duration(0)
+
+	if limit.Messages > 0 {
+		r.messages.fill(limit.Messages, burst, now)
+		wait = r.messages.wait(limit.Messages, burst, float64(messages))
+	}
+	if limit.Bytes > 0 {
+		r.bytes.fill(limit.Bytes, burst, now)
+		if bytesWait := r.bytes.wait(limit.Bytes, burst, float64(bytes)); bytesWait > wait {
+			wait = bytesWait
+		}
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	if limit.Messages > 0 {
+		r.messages.tokens -= float64(messages)
+	}
+	if limit.Bytes > 0 {
+		r.bytes.tokens -= float64(bytes)
+	}
+	return 0
+}
+
+// Function to take tokens for given messages and bytes even if the limit does not allow them yet.
+// The buckets go below zero, so the next messages wait longer.
+func (r *rateLimiter) charge(limit config.RateLimit, messages, bytes int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	burst := limit.BurstDuration()
+
+	if limit.Messages > 0 {
+		r.messages.fill(limit.Messages, burst, now)
+		r.messages.tokens -= float64(messages)
+	}
+	if limit.Bytes > 0 {
+		r.bytes.fill(limit.Bytes, burst, now)
+		r.bytes.tokens -= float64(bytes)
+	}
+}
+
+// A structure that keeps delivery rate limiters of queues.
+type deliveryLimits struct {
+	mutex    sync.Mutex
+	limiters map[*queueingSystem.Queue]*rateLimiter
+}
+
+// Function to create delivery limits where no queue has been limited yet.
+func newDeliveryLimits() *deliveryLimits {
+	return &deliveryLimits{limiters: make(map[*queueingSystem.Queue]*rateLimiter)}
+}
+
+// Function to get the delivery rate limiter of a queue.
+func (d *deliveryLimits) limiter(queue *queueingSystem.Queue) *rateLimiter {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	limiter, ok := d.limiters[queue]
+	if !ok {
+		limiter = &rateLimiter{}
+		d.limiters[queue] = limiter
+	}
+	return limiter
+}
+
+// Function to forget the delivery rate limiter of a deleted queue.
+func (d *deliveryLimits) forget(queue *queueingSystem.Queue) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.limiters, queue)
+}
+
+// Function to get how long to wait until the limit allows one more message whose size is not
+// known yet, that is until a message token is left and the bytes are not overdrawn.
+func (r *rateLimiter) delay(limit config.RateLimit) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	burst := limit.BurstDuration()
+	wait := time.Duration(0)
+
+	if limit.Messages > 0 {
+		r.messages.fill(limit.Messages, burst, now)
+		wait = r.messages.wait(limit.Messages, burst, 1)
+	}
+	if limit.Bytes > 0 {
+		r.bytes.fill(limit.Bytes, burst, now)
+		if bytesWait := r.bytes.wait(limit.Bytes, burst, 0); bytesWait > wait {
+			wait = bytesWait
+		}
+	}
+	return wait
+}
+
+// Function to check whether a message of a queue can be delivered now under the delivery limit
+// of the queue. If not, delivery loops of the queue are notified once it can deliver again.
+func (b *Broker) canDeliver(queue *queueingSystem.Queue) bool {
+	limit := b.Settings().Queue(queue.GetName()).DeliveryLimit
+	if !limit.Enabled() {
+		return true
+	}
+
+	wait := b.deliveryLimits.limiter(queue).delay(limit)
+	if wait > 0 {
+		time.AfterFunc(wait, func() { b.dispatcher.notify(queue) })
+		return false
+	}
+	return true
+}
+
+// Function to charge a message dequeued for delivery to the delivery limit of its queue.
+func (b *Broker) chargeDelivery(queue *queueingSystem.Queue, message queueingSystem.Message) {
+	limit := b.Settings().Queue(queue.GetName()).DeliveryLimit
+	if limit.Enabled() {
+		b.deliveryLimits.limiter(queue).charge(limit, 1, len(message.Body))
+	}
+}
+
+// Number of publish limiters of gateway peers kept before idle ones are dropped.
+const maxGatewayLimiters = 1024
+
+// A structure that keeps publish rate limiters of peers of the HTTP gateway by their identity.
+type gatewayLimits struct {
+	mutex    sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+// Function to create gateway limits where no peer has been limited yet.
+func newGatewayLimits() *gatewayLimits {
+	return &gatewayLimits{limiters: make(map[string]*rateLimiter)}
+}
+
+// Function to get the publish rate limiter of a gateway peer. When many peers are kept, the ones
+// that did not publish for longer than the burst are dropped, as their buckets are full again anyway.
+func (g *gatewayLimits) limiter(identity string, burst time.Duration) *rateLimiter {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	limiter, ok := g.limiters[identity]
+	if ok {
+		return limiter
+	}
+
+	if len(g.limiters) >= maxGatewayLimiters {
+		now := time.Now()
+		for other, l := range g.limiters {
+			if l.idle(now, burst) {
+				delete(g.limiters, other)
+			}
+		}
+	}
+
+	limiter = &rateLimiter{}
+	g.limiters[identity] = limiter
+	return limiter
+}
+
+// Function to check whether no tokens were taken for longer than the burst.
+func (r *rateLimiter) idle(now time.Time, burst time.Duration) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	last := r.messages.last
+	if r.bytes.last.After(last) {
+		last = r.bytes.last
+	}
+	return now.Sub(last) > burst
+}
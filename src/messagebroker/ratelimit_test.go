@@ -0,0 +1,257 @@
+package messagebroker
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// Function to check that a bucket starts full, refills at its rate and holds at most rate times burst.
+func TestTokenBucketFill(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name    string
+		tokens  float64
+		last    time.Time
+		rate    float64
+		burst   time.Duration
+		now     time.Time
+		expects float64
+	}{
+		{"new bucket is full", 0, time.Time{}, 10, time.Second, start, 10},
+		{"burst sets capacity", 0, time.Time{}, 10, 3 * time.Second, start, 30},
+		{"refills at rate", 0, start, 10, time.Second, start.Add(500 * time.Millisecond), 5},
+		{"refills overdrawn bucket", -5, start, 10, time.Second, start.Add(time.Second), 5},
+		{"stops at capacity", 8, start, 10, time.Second, start.Add(time.Minute), 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := tokenBucket{tokens: test.tokens, last: test.last}
+			bucket.fill(test.rate, test.burst, test.now)
+
+			if bucket.tokens != test.expects {
+				t.Errorf("tokens = %v, expected %v", bucket.tokens, test.expects)
+			}
+			if !bucket.last.Equal(test.now) {
+				t.Errorf("last = %v, expected %v", bucket.last, test.now)
+			}
+		})
+	}
+}
+
+// Function to check how long a bucket waits for tokens.
+func TestTokenBucketWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		tokens  float64
+		n       float64
+		expects time.Duration
+	}{
+		{"enough tokens", 5, 5, 0},
+		{"missing tokens", 2, 5, 300 * time.Millisecond},
+		{"overdrawn bucket", -10, 0, time.Second},
+		{"more than capacity waits until full", 0, 50, time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := tokenBucket{tokens: test.tokens}
+
+			if wait := bucket.wait(10, time.Second, test.n); wait != test.expects {
+				t.Errorf("wait = %v, expected %v", wait, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that take takes tokens only when the limit allows all messages and bytes.
+func TestRateLimiterTake(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    config.RateLimit
+		messages int
+		bytes    int
+		waits    []bool // whether each take has to wait
+	}{
+		{"burst passes", config.RateLimit{Messages: 3}, 1, 0, []bool{false, false, false, true}},
+		{"batch takes all its messages", config.RateLimit{Messages: 3}, 2, 0, []bool{false, true}},
+		{"bytes limit", config.RateLimit{Bytes: 100}, 1, 60, []bool{false, true}},
+		{"waits for the stricter bucket", config.RateLimit{Messages: 100, Bytes: 100}, 1, 60, []bool{false, true}},
+		{"longer burst saves up more", config.RateLimit{Messages: 1, Burst: config.Duration{Duration: 2 * time.Second}}, 1, 0,
+			[]bool{false, false, true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var limiter rateLimiter
+
+			for i, expects := range test.waits {
+				before := limiter.messages.tokens
+				wait := limiter.take(test.limit, test.messages, test.bytes)
+
+				if (wait > 0) != expects {
+					t.Fatalf("take %d waits %v, expected to wait: %v", i, wait, expects)
+				}
+				if wait > 0 && test.limit.Messages > 0 && limiter.messages.tokens < before {
+					t.Fatalf("take %d that has to wait took tokens", i)
+				}
+			}
+		})
+	}
+}
+
+// Function to check that delay waits for one message token and for overdrawn bytes, after charge
+// took tokens the limit did not allow.
+func TestRateLimiterDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    config.RateLimit
+		messages int
+		bytes    int
+		waits    bool
+	}{
+		{"tokens left", config.RateLimit{Messages: 10}, 5, 0, false},
+		{"no message token left", config.RateLimit{Messages: 10}, 10, 0, true},
+		{"bytes left", config.RateLimit{Bytes: 100}, 1, 100, false},
+		{"bytes overdrawn", config.RateLimit{Bytes: 100}, 1, 150, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var limiter rateLimiter
+			limiter.charge(test.limit, test.messages, test.bytes)
+
+			if wait := limiter.delay(test.limit); (wait > 0) != test.waits {
+				t.Errorf("delay = %v, expected to wait: %v", wait, test.waits)
+			}
+		})
+	}
+}
+
+// Function to check that canDeliver holds a queue back while it is over its delivery limit.
+func TestCanDeliver(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    config.RateLimit
+		body     string
+		delivers []bool // whether each message can be delivered, every one is charged
+	}{
+		{"no limit", config.RateLimit{}, "hello", []bool{true, true, true}},
+		{"messages limit", config.RateLimit{Messages: 2}, "hello", []bool{true, true, false}},
+		{"bytes limit", config.RateLimit{Bytes: 8}, "hello", []bool{true, true, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBroker(t, func(settings *config.Broker) {
+				settings.Queues = []config.Queue{{Name: "jobs", DeliveryLimit: test.limit}}
+			})
+			queue := b.getQueue("jobs")
+
+			for i, expects := range test.delivers {
+				if ok := b.canDeliver(queue); ok != expects {
+					t.Fatalf("message %d can be delivered: %v, expected %v", i, ok, expects)
+				}
+				b.chargeDelivery(queue, queueingSystem.Message{Body: test.body})
+			}
+		})
+	}
+}
+
+// Function to check that a client over its publish limit is throttled or rejected by its over limit policy.
+func TestCheckPublishOverLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		overLimit string
+		rejects   bool
+	}{
+		{"throttle by default", "", false},
+		{"throttle", config.OverLimitThrottle, false},
+		{"reject", config.OverLimitReject, true},
+	}
+
+	frames := []protocol.Frame{{Type: protocol.MessageFrame, Body: "hello"}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBroker(t, func(settings *config.Broker) {
+				settings.Clients[0].PublishLimit = config.RateLimit{Messages: 10, Burst: config.Duration{Duration: 100 * time.Millisecond}}
+				settings.Clients[0].OverLimit = test.overLimit
+			})
+			l := &link{broker: b, name: "client-0 writing", client: 0}
+
+			if err := l.checkPublish(frames); err != nil {
+				t.Fatalf("first message is not allowed: %v", err)
+			}
+
+			start := time.Now()
+			err := l.checkPublish(frames)
+			elapsed := time.Since(start)
+
+			if !test.rejects {
+				if err != nil {
+					t.Fatalf("throttled message is rejected: %v", err)
+				}
+				if elapsed < 50*time.Millisecond {
+					t.Errorf("throttled message waited only %v", elapsed)
+				}
+				return
+			}
+
+			frame := errorFrame("1", err)
+			if frame.Code != protocol.ErrorRateLimited {
+				t.Fatalf("code = %q, expected %q", frame.Code, protocol.ErrorRateLimited)
+			}
+			if frame.RetryAfter <= 0 || frame.RetryAfter > 100 {
+				t.Errorf("retry after = %dms, expected up to 100ms", frame.RetryAfter)
+			}
+			if elapsed > 50*time.Millisecond {
+				t.Errorf("rejected message waited %v", elapsed)
+			}
+		})
+	}
+}
+
+// Function to check that a throttled client stops waiting when the broker stops.
+func TestCheckPublishStopped(t *testing.T) {
+	b := newTestBroker(t, func(settings *config.Broker) {
+		settings.Clients[0].PublishLimit = config.RateLimit{Messages: 1}
+	})
+	l := &link{broker: b, name: "client-0 writing", client: 0}
+	frames := []protocol.Frame{{Type: protocol.MessageFrame, Body: "hello"}}
+
+	if err := l.checkPublish(frames); err != nil {
+		t.Fatal(err)
+	}
+
+	close(b.done)
+	if err := l.checkPublish(frames); err != ErrStopped {
+		t.Errorf("err = %v, expected %v", err, ErrStopped)
+	}
+}
+
+// Function to check that idle publish limiters of gateway peers are dropped when too many are kept.
+func TestGatewayLimitsDropIdle(t *testing.T) {
+	g := newGatewayLimits()
+
+	busy := g.limiter("busy", time.Second)
+	busy.take(config.RateLimit{Messages: 10}, 1, 0)
+	for i := 1; i < maxGatewayLimiters; i++ {
+		g.limiter("idle-"+strconv.Itoa(i), time.Second)
+	}
+
+	g.limiter("new", time.Second)
+
+	if len(g.limiters) != 2 {
+		t.Errorf("%d limiters are kept, expected 2", len(g.limiters))
+	}
+	if g.limiters["busy"] != busy {
+		t.Error("limiter that is not idle was dropped")
+	}
+}
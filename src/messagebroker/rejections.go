@@ -0,0 +1,59 @@
+package messagebroker
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// An error that rejects a frame of a peer. It is sent to the peer with its code,
+// so the peer can tell why without parsing the reason.
+type rejection struct {
+	code       string
+	reason     string
+	retryAfter time.Duration // how long the peer should wait before publishing again, if it is over a limit
+}
+
+// Function to describe a rejection.
+func (r *rejection) Error() string {
+	return r.reason
+}
+
+// Function to create a rejection with one of the error codes of the protocol.
+func newRejection(code, reason string) error {
+	return &rejection{code: code, reason: reason}
+}
+
+// Function to check a message body against the maximum message size.
+func (b *Broker) checkSize(body string) error {
+	maxSize := b.Settings().MaxMessageSize
+	if maxSize > 0 && len(body) > maxSize {
+		return newRejection(protocol.ErrorMessageTooLarge, "message of "+strconv.Itoa(len(body))+
+			" bytes is larger than "+strconv.Itoa(maxSize)+" bytes")
+	}
+	return nil
+}
+
+// Function to get the error code of err and how long to wait before trying again.
+// A full queue has the queue full code, other errors that are not rejections have no code.
+func errorCode(err error) (string, time.Duration) {
+	var r *rejection
+	var full *queueingSystem.FullError
+	switch {
+	case errors.As(err, &r):
+		return r.code, r.retryAfter
+	case errors.As(err, &full):
+		return protocol.ErrorQueueFull, 0
+	}
+	return "", 0
+}
+
+// Function to get the error frame that rejects the frame with given ID because of err.
+func errorFrame(id string, err error) protocol.Frame {
+	code, retryAfter := errorCode(err)
+	return protocol.Frame{Type: protocol.ErrorFrame, ID: id, Reason: err.Error(), Code: code,
+		RetryAfter: int((retryAfter + time.Millisecond - 1) / time.Millisecond)}
+}
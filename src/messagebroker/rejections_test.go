@@ -0,0 +1,57 @@
+package messagebroker
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// Function to check the error frame every kind of error is sent to a peer with.
+func TestErrorFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		expects protocol.Frame
+	}{
+		{"rejection", newRejection(protocol.ErrorUnknownQueue, "queue jobs does not exist"),
+			protocol.Frame{Type: protocol.ErrorFrame, ID: "1", Code: protocol.ErrorUnknownQueue, Reason: "queue jobs does not exist"}},
+		{"retry after is rounded up to milliseconds", &rejection{code: protocol.ErrorRateLimited, reason: "publish rate limit exceeded",
+			retryAfter: 1500 * time.Microsecond},
+			protocol.Frame{Type: protocol.ErrorFrame, ID: "1", Code: protocol.ErrorRateLimited, Reason: "publish rate limit exceeded", RetryAfter: 2}},
+		{"full queue", &queueingSystem.FullError{Queue: "jobs"},
+			protocol.Frame{Type: protocol.ErrorFrame, ID: "1", Code: protocol.ErrorQueueFull, Reason: "queue jobs is full"}},
+		{"wrapped full queue", fmt.Errorf("transaction failed: %w", &queueingSystem.FullError{Queue: "jobs"}),
+			protocol.Frame{Type: protocol.ErrorFrame, ID: "1", Code: protocol.ErrorQueueFull, Reason: "transaction failed: queue jobs is full"}},
+		{"other error", errors.New("something broke"),
+			protocol.Frame{Type: protocol.ErrorFrame, ID: "1", Reason: "something broke"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if frame := errorFrame("1", test.err); !reflect.DeepEqual(frame, test.expects) {
+				t.Errorf("frame = %+v, expected %+v", frame, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that messages larger than the maximum message size are rejected as too large.
+func TestCheckPublishSize(t *testing.T) {
+	b := newTestBroker(t, func(settings *config.Broker) { settings.MaxMessageSize = 5 })
+	l := &link{broker: b, name: "server writing", client: -1}
+
+	if err := l.checkPublish([]protocol.Frame{{Body: "12345"}, {Body: "12"}}); err != nil {
+		t.Errorf("messages up to the maximum size are rejected: %v", err)
+	}
+
+	err := l.checkPublish([]protocol.Frame{{Body: "12"}, {Body: "123456"}})
+	if frame := errorFrame("1", err); frame.Code != protocol.ErrorMessageTooLarge {
+		t.Errorf("code = %q, expected %q", frame.Code, protocol.ErrorMessageTooLarge)
+	}
+}
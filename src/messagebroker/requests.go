@@ -0,0 +1,134 @@
+package messagebroker
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// A structure that identifies a request by the client that sent it and its correlation ID.
+type requestKey struct {
+	clientID      string
+	correlationID string
+}
+
+// A structure that represent a request of a client in sync mode that waits for the server.
+type request struct {
+	done  chan struct{} // closed when the request is answered or timed out
+	timer *time.Timer
+}
+
+// A structure that keeps track of requests clients sent in sync mode until the server answers them.
+// A request that is not answered within the request timeout fails, and its client gets an error frame.
+type requests struct {
+	counter uint64 // used to give requests without correlation ID one
+	mutex   sync.Mutex
+	pending map[requestKey]*request
+}
+
+// Function to create an empty set of requests.
+func newRequests() *requests {
+	return &requests{pending: make(map[requestKey]*request)}
+}
+
+// Function to give a request without correlation ID one in sync mode, so requests of the same client
+// are told apart when they wait for the server at the same time. The server answers with it like with
+// any other correlation ID.
+func (b *Broker) correlate(message *queueingSystem.Message) {
+	if message.CorrelationID != "" || b.Settings().Mode != "sync" {
+		return
+	}
+	message.CorrelationID = "broker-" + strconv.FormatUint(atomic.AddUint64(&b.requests.counter, 1), 10)
+}
+
+// Function to remember requests a client sent, so their answers can be awaited. The timeout
+// of every request starts now. A request with the same key as one that still waits replaces it.
+func (b *Broker) expect(messages []queueingSystem.Message) []*request {
+	r := b.requests
+	timeout := b.Settings().RequestTimeout.Duration
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	expected := make([]*request, len(messages))
+	for i, message := range messages {
+		key := requestKey{clientID: message.ClientID, correlationID: message.CorrelationID}
+		if old, ok := r.pending[key]; ok {
+			old.timer.Stop()
+			close(old.done)
+		}
+
+		req := &request{done: make(chan struct{})}
+		req.timer = time.AfterFunc(timeout, func() { b.timeout(key, req) })
+		r.pending[key] = req
+		expected[i] = req
+	}
+	return expected
+}
+
+// Function to finish the request a message answers, found by client ID and correlation ID.
+// It returns false if no request waits for the answer, because it timed out or was not sent in sync mode.
+func (b *Broker) answer(message queueingSystem.Message) bool {
+	r := b.requests
+	key := requestKey{clientID: message.ClientID, correlationID: message.CorrelationID}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	req, ok := r.pending[key]
+	if !ok {
+		return false
+	}
+	delete(r.pending, key)
+	req.timer.Stop()
+	close(req.done)
+	return true
+}
+
+// Function to fail a request the server did not answer in time. The client gets an error frame
+// with the correlation ID of the request, and a late answer is still delivered to it.
+func (b *Broker) timeout(key requestKey, req *request) {
+	r := b.requests
+
+	r.mutex.Lock()
+	if r.pending[key] != req {
+		r.mutex.Unlock()
+		return
+	}
+	delete(r.pending, key)
+	close(req.done)
+	r.mutex.Unlock()
+
+	if b.stopped() {
+		return
+	}
+
+	b.logger.Println("ERROR:", "request "+key.correlationID+" of client "+key.clientID+" timed out")
+
+	readLink := b.clients.reader(key.clientID)
+	if readLink == nil {
+		return
+	}
+
+	err := readLink.current().WriteFrame(protocol.Frame{Type: protocol.ErrorFrame, ClientID: key.clientID, CorrelationID: key.correlationID,
+		Code: protocol.ErrorTimeout, Reason: "server did not answer the request in time"})
+	if err != nil {
+		b.logger.Println("ERROR:", "could not send timeout to "+readLink.name+":", err)
+	}
+}
+
+// Function to wait until requests are answered or timed out. It returns false if the broker stopped first.
+func (b *Broker) await(expected []*request) bool {
+	for _, req := range expected {
+		select {
+		case <-req.done:
+		case <-b.done:
+			return false
+		}
+	}
+	return true
+}
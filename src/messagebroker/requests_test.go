@@ -0,0 +1,115 @@
+package messagebroker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// Function to check whether a channel is closed, without waiting.
+func closed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Function to check that a request is finished by its answer once, and that a request sent again
+// with the same correlation ID replaces the one that waits.
+func TestAnswer(t *testing.T) {
+	b := newTestBroker(t, nil)
+	question := queueingSystem.Message{ClientID: "client-0", CorrelationID: "1", Body: "question"}
+	other := queueingSystem.Message{ClientID: "client-1", CorrelationID: "1", Body: "question"}
+
+	expected := b.expect([]queueingSystem.Message{question, other})
+	if closed(expected[0].done) || closed(expected[1].done) {
+		t.Fatal("requests are finished before they are answered")
+	}
+
+	if !b.answer(queueingSystem.Message{ClientID: "client-0", CorrelationID: "1", Body: "answer"}) {
+		t.Fatal("answer does not find its request")
+	}
+	if !closed(expected[0].done) || closed(expected[1].done) {
+		t.Error("answer does not finish only the request of its client")
+	}
+	if b.answer(queueingSystem.Message{ClientID: "client-0", CorrelationID: "1", Body: "answer"}) {
+		t.Error("request is answered twice")
+	}
+
+	again := b.expect([]queueingSystem.Message{other})
+	if !closed(expected[1].done) || closed(again[0].done) {
+		t.Error("request sent again does not replace the one that waits")
+	}
+	if !b.answer(other) || !closed(again[0].done) {
+		t.Error("request sent again is not answered")
+	}
+}
+
+// Function to check that a request the server does not answer in time fails, and that its client
+// gets an error frame with the correlation ID of the request.
+func TestRequestTimeout(t *testing.T) {
+	b := newTestBroker(t, func(settings *config.Broker) {
+		settings.RequestTimeout = config.Duration{Duration: 20 * time.Millisecond}
+	})
+
+	first, second := net.Pipe()
+	defer first.Close()
+	defer second.Close()
+	reader := &link{broker: b, name: "client-0 reading", peer: "client-0", reading: true, conn: protocol.NewConn(first),
+		inFlight: make(map[string]delivery)}
+	if err := b.clients.register(reader, "client-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	question := queueingSystem.Message{ClientID: "client-0", CorrelationID: "7", Body: "question"}
+	expected := b.expect([]queueingSystem.Message{question})
+
+	frame, err := protocol.NewConn(second).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != protocol.ErrorFrame || frame.Code != protocol.ErrorTimeout || frame.CorrelationID != "7" {
+		t.Errorf("frame = %+v, expected timeout of request 7", frame)
+	}
+
+	if !b.await(expected) {
+		t.Error("timed out request is still awaited")
+	}
+	if b.answer(question) {
+		t.Error("late answer finds its timed out request")
+	}
+}
+
+// Function to check that only requests without correlation ID in sync mode are given one, each a new one.
+func TestCorrelate(t *testing.T) {
+	tests := []struct {
+		mode, correlationID string
+		given               bool
+	}{
+		{"sync", "", true},
+		{"sync", "7", false},
+		{"async", "", false},
+	}
+
+	for _, test := range tests {
+		b := newTestBroker(t, func(settings *config.Broker) { settings.Mode = test.mode })
+
+		first := queueingSystem.Message{CorrelationID: test.correlationID}
+		second := first
+		b.correlate(&first)
+		b.correlate(&second)
+
+		if !test.given && (first.CorrelationID != test.correlationID || second.CorrelationID != test.correlationID) {
+			t.Errorf("%s request with correlation ID %q gets %q", test.mode, test.correlationID, first.CorrelationID)
+		}
+		if test.given && (first.CorrelationID == "" || first.CorrelationID == second.CorrelationID) {
+			t.Errorf("%s requests without correlation ID get %q and %q", test.mode, first.CorrelationID, second.CorrelationID)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package messagebroker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// A structure that represent a WebSocket peer of the HTTP gateway. It can subscribe to queues,
+// whose messages are pushed to it and wait for its acknowledgment, and publish messages.
+// Every WebSocket message is one frame of the wire protocol. One delivery loop pushes the
+// messages of all subscribed queues, so they share the prefetch limit of the peer.
+type stream struct {
+	broker     *Broker
+	ws         *webSocket
+	user       string // authenticated user, empty when authentication is disabled
+	identity   string // who publishes, see gatewayIdentity
+	name       string
+	queues     *subscription // subscribed queues of the delivery loop
+	mutex      sync.Mutex    // guards inFlight, subscribed and closed
+	inFlight   map[string]delivery
+	subscribed map[*queueingSystem.Queue]bool
+	closed     bool
+	room       chan struct{} // has a value when a delivery was acknowledged or put back
+	done       chan struct{} // closed when the peer is gone
+	wg         sync.WaitGroup
+}
+
+// Prefix of the subprotocol a WebSocket peer offers its bearer token in.
+const bearerProtocol = "bearer."
+
+// Function to handle a WebSocket peer of the HTTP gateway until it closes the connection or the broker
+// stops. Browsers cannot set headers on WebSocket handshakes, so a token can also be offered as the
+// subprotocol bearer.<token> next to webSocketProtocol. It is not taken from the URL, which proxies and
+// access logs keep. Messages the peer has not acknowledged when it is gone are delivered again.
+func (b *Broker) handleStream(w http.ResponseWriter, r *http.Request) {
+	if token, ok := protocolToken(r.Header); ok && r.Header.Get("Authorization") == "" {
+		// The broker selects webSocketProtocol, never the token, so the token is not sent back.
+		if !headerHasToken(r.Header, "Sec-WebSocket-Protocol", webSocketProtocol) {
+			writeHTTPError(w, http.StatusBadRequest, errorBadRequest,
+				"a token offered as subprotocol needs the "+webSocketProtocol+" subprotocol next to it")
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	user, ok := b.authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		b.logger.Println("ERROR:", "websocket "+r.RemoteAddr+":", err)
+		return
+	}
+
+	heartbeat := b.Settings().Heartbeat.Duration
+	ws.timeout = protocol.MissedHeartbeats * heartbeat
+
+	s := &stream{broker: b, ws: ws, user: user, identity: gatewayIdentity(user, r), name: "websocket " + r.RemoteAddr,
+		queues: b.dispatcher.subscribe(nil), inFlight: make(map[string]delivery), subscribed: make(map[*queueingSystem.Queue]bool),
+		room: make(chan struct{}, 1), done: make(chan struct{})}
+	b.logger.Println("LOG:", "established a websocket connection with "+r.RemoteAddr, "HEARTBEAT:", heartbeat)
+
+	stop := b.closeOnStop(ws.conn)
+	defer stop()
+
+	s.wg.Add(1)
+	go s.deliver()
+
+	if heartbeat > 0 {
+		s.wg.Add(1)
+		go s.ping(heartbeat)
+	}
+
+	for {
+		data, err := ws.ReadMessage()
+		if err != nil {
+			s.close(err)
+			return
+		}
+
+		var frame protocol.Frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			s.write(protocol.Frame{Type: protocol.ErrorFrame, Code: errorBadRequest, Reason: "frame is not valid: " + err.Error()})
+			continue
+		}
+
+		switch frame.Type {
+		case protocol.SubscribeFrame:
+			s.subscribe(frame)
+		case protocol.AckFrame:
+			s.acknowledge(frame.ID)
+		case protocol.NackFrame:
+			s.requeue(frame.ID, frame.Reason)
+		case protocol.MessageFrame:
+			s.publish(frame, []protocol.Frame{frame})
+		case protocol.BatchFrame:
+			s.publish(frame, frame.Messages)
+		default:
+			s.write(errorFrame(frame.ID, newRejection(errorBadRequest, "frame type "+frame.Type+" is not supported")))
+		}
+	}
+}
+
+// Function to get the bearer token a WebSocket peer offers as subprotocol, see bearerProtocol.
+func protocolToken(header http.Header) (string, bool) {
+	for _, value := range header.Values("Sec-WebSocket-Protocol") {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); strings.HasPrefix(part, bearerProtocol) {
+				return strings.TrimPrefix(part, bearerProtocol), true
+			}
+		}
+	}
+	return "", false
+}
+
+// Function to write a frame to the peer. It returns false if the peer is gone.
+func (s *stream) write(frame protocol.Frame) bool {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return false
+	}
+	return s.ws.WriteMessage(data) == nil
+}
+
+// Function to ping the peer whenever half a heartbeat passed, so a peer that does not answer is found dead.
+func (s *stream) ping(heartbeat time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(heartbeat / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if s.ws.Ping() != nil {
+				return
+			}
+		}
+	}
+}
+
+// Function to end a stream after its peer is gone. Delivery loops are stopped, and messages
+// that were not acknowledged are put back to their queues.
+func (s *stream) close(reason error) {
+	b := s.broker
+
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	close(s.done)
+	s.ws.conn.Close()
+	s.wg.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, d := range s.inFlight {
+		b.redeliver(d)
+	}
+	s.inFlight = make(map[string]delivery)
+
+	if reason == errWebSocketClosed {
+		b.logger.Println("LOG:", s.name+" closed")
+	} else if !b.stopped() {
+		b.logger.Println("ERROR:", s.name+" is dead:", reason)
+	}
+}
+
+// Function to subscribe the peer to a queue, its messages are pushed from then on. The peer has
+// to be permitted to consume from the queue, see checkConsume. A subscribe frame with an ID is
+// confirmed with an ack frame.
+func (s *stream) subscribe(frame protocol.Frame) {
+	b := s.broker
+
+	queue, ok := b.findQueue(frame.Queue)
+	if !ok {
+		s.write(errorFrame(frame.ID, newRejection(protocol.ErrorUnknownQueue, "queue "+frame.Queue+" does not exist")))
+		return
+	}
+	if err := b.checkConsume(s.user, queue); err != nil {
+		s.write(errorFrame(frame.ID, err))
+		return
+	}
+
+	s.mutex.Lock()
+	added := !s.subscribed[queue]
+	s.subscribed[queue] = true
+	s.mutex.Unlock()
+
+	if added {
+		b.dispatcher.extend(s.queues, queue)
+		b.logger.Println("LOG:", s.name+" subscribed to queue "+queue.GetName())
+	}
+
+	if frame.ID != "" {
+		s.write(protocol.Frame{Type: protocol.AckFrame, ID: frame.ID})
+	}
+}
+
+// Function to push messages of the subscribed queues to the peer until it is gone. Like delivery
+// to the server, a message waits while another message with the same key is in flight, the peer
+// gets at most prefetch messages it has not acknowledged yet, the scheduling policy decides which
+// queue goes next and a queue waits while it is over its delivery limit.
+func (s *stream) deliver() {
+	defer s.wg.Done()
+	b := s.broker
+	defer b.dispatcher.unsubscribe(s.queues)
+
+	for s.waitRoom() {
+		queue, ok := s.queues.next(s.done)
+		if !ok {
+			return
+		}
+
+		if b.checkConsume(s.user, queue) != nil || !b.canDeliver(queue) {
+			continue
+		}
+
+		message, err := b.dequeue(queue)
+		if err != nil {
+			s.queues.idle(queue)
+			continue
+		}
+		s.queues.dequeued(queue, message)
+		b.chargeDelivery(queue, message)
+
+		message.Deliveries++
+		id, ok := s.track(queue, message)
+		if !ok {
+			b.redeliver(delivery{message: message, queue: queue})
+			return
+		}
+
+		if !s.write(protocol.Frame{Type: protocol.MessageFrame, ID: id, Queue: queue.GetName(), ClientID: message.ClientID,
+			CorrelationID: message.CorrelationID, Key: message.Key, Headers: message.Headers, Body: message.Body,
+			Attempt: message.Deliveries}) {
+			return
+		}
+	}
+}
+
+// Function to remember a message that is about to be pushed. It returns false if the peer is
+// gone already, then the message is not tracked.
+func (s *stream) track(queue *queueingSystem.Queue, message queueingSystem.Message) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return "", false
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&s.broker.deliveryCounter, 1), 10)
+	s.inFlight[id] = delivery{message: message, queue: queue}
+	return id, true
+}
+
+// Function to wait until the peer has fewer unacknowledged messages than the prefetch limit.
+// It returns false if the peer is gone first.
+func (s *stream) waitRoom() bool {
+	for {
+		prefetch := s.broker.Settings().Prefetch
+
+		s.mutex.Lock()
+		full := prefetch > 0 && len(s.inFlight) >= prefetch
+		s.mutex.Unlock()
+
+		if !full {
+			return true
+		}
+
+		select {
+		case <-s.room:
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+// Function to take a pushed message away from the messages in flight.
+func (s *stream) settle(id string) (delivery, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	d, ok := s.inFlight[id]
+	if !ok {
+		return d, false
+	}
+	delete(s.inFlight, id)
+
+	select {
+	case s.room <- struct{}{}:
+	default:
+	}
+	return d, true
+}
+
+// Function to forget a pushed message after the peer acknowledged it.
+func (s *stream) acknowledge(id string) {
+	if d, ok := s.settle(id); ok {
+		s.broker.releaseKey(d.queue, d.message)
+	}
+}
+
+// Function to deliver a pushed message again after the peer rejected it.
+func (s *stream) requeue(id, reason string) {
+	if d, ok := s.settle(id); ok {
+		s.broker.logger.Println("ERROR:", s.name+" rejected message "+id+":", reason)
+		s.broker.redeliver(d)
+	}
+}
+
+// Function to publish the messages of a message or batch frame to the queue the frame names,
+// see publishGateway. Every message with an ID is confirmed with an ack frame, and every message
+// that is rejected gets an error frame with a code.
+func (s *stream) publish(frame protocol.Frame, frames []protocol.Frame) {
+	b := s.broker
+
+	if _, err := b.publishGateway(s.identity, frame.Queue, frames); err != nil {
+		b.logger.Println("ERROR:", s.name+":", err.Error()+", "+strconv.Itoa(len(frames))+" messages are rejected")
+		for _, frame := range frames {
+			if !s.write(errorFrame(frame.ID, err)) {
+				return
+			}
+		}
+		return
+	}
+
+	for _, frame := range frames {
+		if frame.ID != "" && !s.write(protocol.Frame{Type: protocol.AckFrame, ID: frame.ID}) {
+			return
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package messagebroker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/protocol"
+)
+
+// A structure that represent a WebSocket client of a stream in a test.
+type streamClient struct {
+	t        *testing.T
+	conn     net.Conn
+	reader   *bufio.Reader
+	protocol string // subprotocol the broker selected
+}
+
+// Function to open a WebSocket stream to a path of the HTTP gateway of a test server, with extra headers of the handshake.
+// It returns the status of the handshake, the client is only usable when it is 101.
+func dialStream(t *testing.T, server *httptest.Server, path string, headers http.Header) (*streamClient, int) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	for name, values := range headers {
+		request.Header[name] = values
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := request.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &streamClient{t: t, conn: conn, reader: reader, protocol: response.Header.Get("Sec-WebSocket-Protocol")}, response.StatusCode
+}
+
+// Function to send a frame of the wire protocol as a text message.
+func (c *streamClient) send(frame protocol.Frame) {
+	c.t.Helper()
+
+	data, _ := json.Marshal(frame)
+	if _, err := c.conn.Write(testFrame{final: true, opcode: opText, payload: data}.encode()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Function to receive the next frame of the wire protocol, pings of the broker are skipped.
+func (c *streamClient) receive() protocol.Frame {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			c.t.Fatal("no frame is received:", err)
+		}
+
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			extended := make([]byte, 2)
+			io.ReadFull(c.reader, extended)
+			length = uint64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended := make([]byte, 8)
+			io.ReadFull(c.reader, extended)
+			length = binary.BigEndian.Uint64(extended)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			c.t.Fatal(err)
+		}
+
+		if header[0]&0x0f != opText {
+			continue
+		}
+		var frame protocol.Frame
+		if err := json.Unmarshal(payload, &frame); err != nil {
+			c.t.Fatal(err)
+		}
+		return frame
+	}
+}
+
+// Function to check that a stream publishes messages, pushes the messages of subscribed queues,
+// and delivers them again when they are rejected or the peer is gone.
+func TestStream(t *testing.T) {
+	b := newTestBroker(t, nil)
+	if err := b.CreateQueue("jobs", 10); err != nil {
+		t.Fatal(err)
+	}
+	queue, _ := b.findQueue("jobs")
+	server := httptest.NewServer(b.gateway())
+	defer server.Close()
+
+	c, status := dialStream(t, server, "/ws", nil)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake answered %d", status)
+	}
+
+	c.send(protocol.Frame{Type: protocol.MessageFrame, ID: "1", Queue: "jobs", Body: "first"})
+	if frame := c.receive(); frame.Type != protocol.AckFrame || frame.ID != "1" {
+		t.Fatalf("publish is answered with %+v, expected ack", frame)
+	}
+
+	c.send(protocol.Frame{Type: protocol.MessageFrame, ID: "2", Queue: "other", Body: "lost"})
+	if frame := c.receive(); frame.Type != protocol.ErrorFrame || frame.ID != "2" || frame.Code != protocol.ErrorUnknownQueue {
+		t.Fatalf("publish to unknown queue is answered with %+v", frame)
+	}
+
+	c.send(protocol.Frame{Type: "unsubscribe", ID: "3"})
+	if frame := c.receive(); frame.Type != protocol.ErrorFrame || frame.ID != "3" {
+		t.Fatalf("unknown frame is answered with %+v", frame)
+	}
+
+	c.send(protocol.Frame{Type: protocol.SubscribeFrame, ID: "s", Queue: "jobs"})
+	pushed := protocol.Frame{}
+	for _, expects := range []string{protocol.AckFrame, protocol.MessageFrame} {
+		frame := c.receive()
+		if frame.Type != expects {
+			t.Fatalf("received %+v, expected %s frame", frame, expects)
+		}
+		pushed = frame
+	}
+	if pushed.Body != "first" || pushed.Queue != "jobs" || pushed.Attempt != 1 {
+		t.Fatalf("pushed %+v, expected first message", pushed)
+	}
+
+	c.send(protocol.Frame{Type: protocol.NackFrame, ID: pushed.ID, Reason: "try again"})
+	if again := c.receive(); again.Body != "first" || again.Attempt != 2 {
+		t.Fatalf("pushed %+v after nack, expected first message again", again)
+	} else {
+		c.send(protocol.Frame{Type: protocol.AckFrame, ID: again.ID})
+	}
+
+	c.send(protocol.Frame{Type: protocol.MessageFrame, Queue: "jobs", Body: "second"})
+	if frame := c.receive(); frame.Body != "second" {
+		t.Fatalf("pushed %+v, expected second message", frame)
+	}
+
+	// The second message is not acknowledged when the peer is gone, so it is put back.
+	c.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.GetSize() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if message, err := queue.Dequeue(); err != nil || message.Body != "second" {
+		t.Errorf("queue has %+v, %v, expected the unacknowledged message", message, err)
+	}
+}
+
+// Function to check that a stream authenticates with a bearer token in the Authorization header or
+// offered as subprotocol, and that a token in the URL is not accepted.
+func TestStreamToken(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	content := `{"users": [{"username": "alice", "tokens": ["` + auth.HashToken("secret") + `"],
+		"permissions": [{"queue": "*", "actions": ["publish", "consume"]}]}]}`
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := auth.LoadUsers(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestBroker(t, nil)
+	b.users = users
+	server := httptest.NewServer(b.gateway())
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		headers  http.Header
+		status   int
+		protocol string
+	}{
+		{"no token", "/ws", nil, http.StatusUnauthorized, ""},
+		{"token in URL", "/ws?token=secret", nil, http.StatusUnauthorized, ""},
+		{"authorization header", "/ws", http.Header{"Authorization": {"Bearer secret"}}, http.StatusSwitchingProtocols, ""},
+		{"token as subprotocol", "/ws", http.Header{"Sec-Websocket-Protocol": {"mq, bearer.secret"}}, http.StatusSwitchingProtocols, "mq"},
+		{"subprotocols in two headers", "/ws", http.Header{"Sec-Websocket-Protocol": {"bearer.secret", "mq"}}, http.StatusSwitchingProtocols, "mq"},
+		{"token without mq subprotocol", "/ws", http.Header{"Sec-Websocket-Protocol": {"bearer.secret"}}, http.StatusBadRequest, ""},
+		{"wrong token as subprotocol", "/ws", http.Header{"Sec-Websocket-Protocol": {"mq, bearer.guess"}}, http.StatusUnauthorized, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, status := dialStream(t, server, test.path, test.headers)
+			if status != test.status || c.protocol != test.protocol {
+				t.Errorf("handshake answered %d with subprotocol %q, expected %d with %q", status, c.protocol, test.status, test.protocol)
+			}
+		})
+	}
+}
+
+// Function to check that one delivery loop pushes the messages of all subscribed queues, within
+// one prefetch limit of the peer, and that published messages belong to the address of the peer.
+func TestStreamSharedPrefetch(t *testing.T) {
+	b := newTestBroker(t, func(settings *config.Broker) { settings.Prefetch = 1 })
+	for _, name := range []string{"jobs", "mail"} {
+		if err := b.CreateQueue(name, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(b.gateway())
+	defer server.Close()
+
+	c, _ := dialStream(t, server, "/ws", nil)
+	for _, name := range []string{"jobs", "mail"} {
+		c.send(protocol.Frame{Type: protocol.MessageFrame, Queue: name, ClientID: "client-0", Body: "to " + name})
+	}
+	for _, name := range []string{"jobs", "mail"} {
+		c.send(protocol.Frame{Type: protocol.SubscribeFrame, ID: name, Queue: name})
+	}
+
+	// The first message may be pushed before the second subscription is confirmed.
+	var first protocol.Frame
+	acks := 0
+	for i := 0; i < 3; i++ {
+		switch frame := c.receive(); frame.Type {
+		case protocol.AckFrame:
+			acks++
+		case protocol.MessageFrame:
+			if first.Type != "" {
+				t.Fatal("second message is pushed before the first is acknowledged")
+			}
+			first = frame
+		}
+	}
+	if acks != 2 || first.ClientID != "http:127.0.0.1" {
+		t.Fatalf("received %d acks and %+v, expected a message of the address of the peer", acks, first)
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c.reader.Peek(1); err == nil {
+		t.Fatal("second message is pushed before the first is acknowledged")
+	}
+
+	c.send(protocol.Frame{Type: protocol.AckFrame, ID: first.ID})
+	second := c.receive()
+	if second.Type != protocol.MessageFrame || second.Queue == first.Queue {
+		t.Errorf("pushed %+v after %+v, expected the message of the other queue", second, first)
+	}
+}
@@ -0,0 +1,260 @@
+package messagebroker
+
+import (
+	"strconv"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// A structure that represent a message of a transaction that waits for the commit.
+type stagedMessage struct {
+	queue   *queueingSystem.Queue
+	message queueingSystem.Message
+	id      string // ID the message is deduplicated by
+}
+
+// A structure that represent an open transaction of a peer. Messages and acknowledgments
+// are staged until the transaction is committed, then they are applied together or not at all.
+type transaction struct {
+	messages []stagedMessage
+	acks     map[string]bool // IDs of deliveries on the reading link of the peer
+	err      error           // first frame of the transaction that was rejected, the commit fails with it
+}
+
+// Function to start a transaction on a writing link.
+func (l *link) begin(conn *protocol.Conn, frame protocol.Frame) {
+	l.mutex.Lock()
+	_, ok := l.transactions[frame.Transaction]
+	if !ok && frame.Transaction != "" {
+		l.transactions[frame.Transaction] = &transaction{acks: make(map[string]bool)}
+	}
+	l.mutex.Unlock()
+
+	var err error
+	if frame.Transaction == "" {
+		err = newRejection(protocol.ErrorInvalidTransaction, "transaction ID is required")
+	} else if ok {
+		err = newRejection(protocol.ErrorInvalidTransaction, "transaction "+frame.Transaction+" already exists")
+	}
+	l.broker.confirm(conn, frame.ID, err)
+}
+
+// Function to get an open transaction of a writing link.
+func (l *link) transaction(id string) (*transaction, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	tx, ok := l.transactions[id]
+	if !ok {
+		return nil, newRejection(protocol.ErrorInvalidTransaction, "transaction "+id+" does not exist")
+	}
+	return tx, nil
+}
+
+// Function to forget a transaction of a writing link after it is committed or aborted.
+func (l *link) finish(id string) (*transaction, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	tx, ok := l.transactions[id]
+	if !ok {
+		return nil, newRejection(protocol.ErrorInvalidTransaction, "transaction "+id+" does not exist")
+	}
+	delete(l.transactions, id)
+	return tx, nil
+}
+
+// Function to stage messages of a transaction. A message is published to the queue it names,
+// which has to exist, or to the queue of the sender. A message that cannot be staged is rejected
+// with an error frame and the transaction fails when it is committed.
+func (l *link) stage(conn *protocol.Conn, q *queueingSystem.Queue, id string, frames []protocol.Frame) {
+	b := l.broker
+
+	tx, err := l.transaction(id)
+	if err != nil {
+		for _, frame := range frames {
+			l.reject(conn, frame.ID, err)
+		}
+		return
+	}
+
+	for _, frame := range frames {
+		target := q
+		if frame.Queue != "" {
+			var ok bool
+			if target, ok = b.findQueue(frame.Queue); !ok {
+				err = newRejection(protocol.ErrorUnknownQueue, "queue "+frame.Queue+" does not exist")
+			}
+		}
+		if err == nil && !b.authorized(conn, auth.Publish, target) {
+			err = newRejection(protocol.ErrorUnauthorized, "not permitted to publish to queue "+target.GetName())
+		}
+
+		if err != nil {
+			b.logger.Println("ERROR:", "transaction "+id+" of "+l.name+":", err)
+			l.reject(conn, frame.ID, err)
+			l.fail(id, err)
+			err = nil
+			continue
+		}
+
+		message := queueingSystem.Message{ClientID: frame.ClientID, CorrelationID: frame.CorrelationID, Key: frame.Key,
+			Headers: frame.Headers, Body: frame.Body}
+		if conn.Role() == protocol.RoleProducer {
+			message.ClientID = conn.ClientID()
+		}
+		b.correlate(&message)
+
+		l.mutex.Lock()
+		tx.messages = append(tx.messages, stagedMessage{queue: target, message: message, id: dedupID(frame)})
+		l.mutex.Unlock()
+	}
+}
+
+// Function to reject a frame of a transaction with an error frame. Frames without ID are not
+// rejected, the peer learns about the error when it commits.
+func (l *link) reject(conn *protocol.Conn, id string, err error) {
+	if id != "" {
+		conn.WriteFrame(errorFrame(id, err))
+	}
+}
+
+// Function to make a transaction fail when it is committed, with the first error it had.
+func (l *link) fail(id string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	tx, ok := l.transactions[id]
+	if ok && tx.err == nil {
+		tx.err = err
+	}
+}
+
+// Function to stage an acknowledgment of a transaction. The ID is the ID of a delivery on the reading link of the peer.
+func (l *link) stageAck(conn *protocol.Conn, frame protocol.Frame) {
+	tx, err := l.transaction(frame.Transaction)
+	if err != nil {
+		l.reject(conn, frame.ID, err)
+		return
+	}
+
+	l.mutex.Lock()
+	tx.acks[frame.ID] = true
+	l.mutex.Unlock()
+}
+
+// Function to commit a transaction. Its messages are enqueued and its acknowledged deliveries
+// are forgotten at once, or nothing is done if any of them fails. The sender gets an ack frame
+// with the ID of the commit frame, or an error frame with the reason.
+// It returns the messages enqueued to q.
+func (l *link) commit(conn *protocol.Conn, q *queueingSystem.Queue, frame protocol.Frame) []queueingSystem.Message {
+	b := l.broker
+
+	tx, err := l.finish(frame.Transaction)
+	if err == nil {
+		err = tx.err
+	}
+
+	var enqueued []queueingSystem.Message
+	if err == nil {
+		enqueued, err = b.apply(conn.ClientID(), tx, q)
+	}
+
+	b.confirm(conn, frame.ID, err)
+	if err != nil {
+		b.logger.Println("ERROR:", "transaction "+frame.Transaction+" of "+l.name+" is aborted:", err)
+		return nil
+	}
+
+	b.logger.Println("LOG:", "transaction "+frame.Transaction+" of "+l.name+" is committed with "+
+		strconv.Itoa(len(tx.messages))+" messages and "+strconv.Itoa(len(tx.acks))+" acknowledgments")
+	return enqueued
+}
+
+// Function to abort a transaction. Nothing it staged is applied, so acknowledged deliveries stay in flight.
+func (l *link) abort(conn *protocol.Conn, frame protocol.Frame) {
+	_, err := l.finish(frame.Transaction)
+	if err == nil {
+		l.broker.logger.Println("LOG:", "transaction "+frame.Transaction+" of "+l.name+" is aborted")
+	}
+	l.broker.confirm(conn, frame.ID, err)
+}
+
+// Function to drop open transactions of a writing link whose connection is lost.
+func (l *link) abortAll() {
+	if len(l.transactions) > 0 {
+		l.broker.logger.Println("LOG:", strconv.Itoa(len(l.transactions))+" transactions of "+l.name+" are aborted")
+	}
+	l.transactions = make(map[string]*transaction)
+}
+
+// Function to apply a committed transaction of a client. The acknowledged deliveries have to be
+// in flight on the reading link of the client, and are kept in flight until the messages are enqueued.
+// It returns the messages enqueued to q.
+func (b *Broker) apply(clientID string, tx *transaction, q *queueingSystem.Queue) ([]queueingSystem.Message, error) {
+	var reader *link
+	if len(tx.acks) > 0 {
+		reader = b.clients.reader(clientID)
+		if reader == nil {
+			return nil, newRejection(protocol.ErrorInvalidTransaction, "client "+clientID+" has no deliveries")
+		}
+
+		reader.mutex.Lock()
+		defer reader.mutex.Unlock()
+
+		for id := range tx.acks {
+			if _, ok := reader.inFlight[id]; !ok {
+				return nil, newRejection(protocol.ErrorInvalidTransaction, "message "+id+" is not in flight")
+			}
+		}
+	}
+
+	publications := make([]publication, 0)
+	indexes := make(map[*queueingSystem.Queue]int)
+	for _, staged := range tx.messages {
+		i, ok := indexes[staged.queue]
+		if !ok {
+			i = len(publications)
+			indexes[staged.queue] = i
+			publications = append(publications, publication{queue: staged.queue})
+		}
+		publications[i].messages = append(publications[i].messages, staged.message)
+		publications[i].ids = append(publications[i].ids, staged.id)
+	}
+
+	duplicates, err := b.enqueueEach(publications)
+	if err != nil {
+		return nil, err
+	}
+
+	for id := range tx.acks {
+		d := reader.inFlight[id]
+		delete(reader.inFlight, id)
+		b.releaseKey(d.queue, d.message)
+	}
+	if reader != nil {
+		reader.freed()
+	}
+
+	var result []queueingSystem.Message
+	for i, p := range publications {
+		enqueued := make([]queueingSystem.Message, 0, len(p.messages))
+		for j, duplicate := range duplicates[i] {
+			if duplicate {
+				b.logger.Println("LOG:", "duplicate message "+p.ids[j]+" is dropped")
+			} else {
+				enqueued = append(enqueued, p.messages[j])
+			}
+		}
+		if len(enqueued) > 0 {
+			b.logger.Println("LOG:", "enqueued "+strconv.Itoa(len(enqueued))+" to queue "+p.queue.GetName(), "SIZE:", p.queue.GetSize())
+		}
+		if p.queue == q {
+			result = enqueued
+		}
+	}
+
+	return result, nil
+}
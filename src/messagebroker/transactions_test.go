@@ -0,0 +1,109 @@
+package messagebroker
+
+import (
+	"testing"
+
+	"distributed-systems-message-queue/src/config"
+	"distributed-systems-message-queue/src/protocol"
+	queueingSystem "distributed-systems-message-queue/src/queue"
+)
+
+// Function to check that a committed transaction enqueues its messages and forgets its acknowledged
+// deliveries together, and that nothing is applied when any part of it fails.
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		full     bool     // whether the audit queue is full before the commit
+		acks     []string // IDs of acknowledged deliveries, "delivered" is the one in flight
+		clientID string
+		fails    bool
+		enqueued int // messages in the client queue afterwards
+		audit    int // messages in the audit queue afterwards
+		inFlight int
+	}{
+		{"messages and acknowledgment", false, []string{"delivered"}, "client-0", false, 1, 1, 0},
+		{"messages only", false, nil, "client-0", false, 1, 1, 1},
+		{"acknowledgment not in flight", false, []string{"delivered", "other"}, "client-0", true, 0, 0, 1},
+		{"client without deliveries", false, []string{"delivered"}, "client-1", true, 0, 0, 1},
+		{"one queue full", true, []string{"delivered"}, "client-0", true, 0, 1, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBroker(t, func(settings *config.Broker) {
+				settings.Queues = []config.Queue{{Name: "audit", Capacity: 1}}
+			})
+			queue, audit := b.getQueue("client-0"), b.getQueue("audit")
+			if test.full {
+				audit.Enqueue(queueingSystem.Message{Body: "earlier entry"})
+			}
+
+			reader := &link{broker: b, name: "client reading", peer: "client", reading: true, inFlight: make(map[string]delivery)}
+			if err := b.clients.register(reader, "client-0"); err != nil {
+				t.Fatal(err)
+			}
+			_, delivered := reader.track(b.getQueue("requests"), queueingSystem.Message{Body: "request"})
+
+			tx := &transaction{acks: make(map[string]bool), messages: []stagedMessage{
+				{queue: queue, message: queueingSystem.Message{Body: "reply"}},
+				{queue: audit, message: queueingSystem.Message{Body: "entry"}},
+			}}
+			for _, id := range test.acks {
+				if id == "delivered" {
+					id = delivered
+				}
+				tx.acks[id] = true
+			}
+
+			enqueued, err := b.apply(test.clientID, tx, queue)
+
+			if (err != nil) != test.fails {
+				t.Errorf("err = %v, expected to fail: %v", err, test.fails)
+			}
+			if len(enqueued) != test.enqueued || queue.GetSize() != test.enqueued || audit.GetSize() != test.audit {
+				t.Errorf("%d enqueued, queues have %d and %d messages, expected %d and %d",
+					len(enqueued), queue.GetSize(), audit.GetSize(), test.enqueued, test.audit)
+			}
+			if len(reader.inFlight) != test.inFlight {
+				t.Errorf("%d deliveries in flight, expected %d", len(reader.inFlight), test.inFlight)
+			}
+		})
+	}
+}
+
+// Function to check the life of transactions on a writing link: staged messages wait for the commit,
+// an abort drops them, and a transaction with a rejected message commits nothing.
+func TestTransactionSteps(t *testing.T) {
+	l, conn := newTestLink(t)
+	l.transactions = make(map[string]*transaction)
+	queue := l.broker.getQueue("client-0")
+	message := func(body, queue string) protocol.Frame {
+		return protocol.Frame{Type: protocol.MessageFrame, Body: body, Queue: queue}
+	}
+
+	l.begin(conn, protocol.Frame{Type: protocol.BeginFrame, Transaction: "1"})
+	l.stage(conn, queue, "1", []protocol.Frame{message("a", ""), message("b", "")})
+	if queue.GetSize() != 0 {
+		t.Fatal("staged messages are enqueued before the commit")
+	}
+	if enqueued := l.commit(conn, queue, protocol.Frame{Type: protocol.CommitFrame, Transaction: "1"}); len(enqueued) != 2 || queue.GetSize() != 2 {
+		t.Fatalf("commit enqueued %d, queue has %d, expected 2", len(enqueued), queue.GetSize())
+	}
+
+	l.begin(conn, protocol.Frame{Type: protocol.BeginFrame, Transaction: "2"})
+	l.stage(conn, queue, "2", []protocol.Frame{message("c", "")})
+	l.abort(conn, protocol.Frame{Type: protocol.AbortFrame, Transaction: "2"})
+	if enqueued := l.commit(conn, queue, protocol.Frame{Type: protocol.CommitFrame, Transaction: "2"}); len(enqueued) != 0 {
+		t.Errorf("aborted transaction enqueued %d messages", len(enqueued))
+	}
+
+	l.begin(conn, protocol.Frame{Type: protocol.BeginFrame, Transaction: "3"})
+	l.stage(conn, queue, "3", []protocol.Frame{message("d", ""), message("e", "missing")})
+	if enqueued := l.commit(conn, queue, protocol.Frame{Type: protocol.CommitFrame, Transaction: "3"}); len(enqueued) != 0 {
+		t.Errorf("transaction with a rejected message enqueued %d messages", len(enqueued))
+	}
+
+	if queue.GetSize() != 2 || len(l.transactions) != 0 {
+		t.Errorf("queue has %d messages and %d transactions are open, expected 2 and none", queue.GetSize(), len(l.transactions))
+	}
+}
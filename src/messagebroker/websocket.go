@@ -0,0 +1,307 @@
+package messagebroker
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// GUID that the accept key of a WebSocket handshake is derived with, see RFC 6455.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Subprotocol of WebSocket streams. The handshake selects it when the peer offers it.
+const webSocketProtocol = "mq"
+
+// Opcodes of WebSocket frames.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Status codes of WebSocket close frames.
+const (
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeInvalidData   = 1007
+	closeTooLarge      = 1009
+)
+
+// Error returned when the peer of a WebSocket connection closed it with a close frame.
+var errWebSocketClosed = errors.New("websocket is closed")
+
+// A structure that represent an error of a WebSocket peer that breaks the protocol.
+// The connection is closed with its status code.
+type webSocketError struct {
+	status int
+	reason string
+}
+
+// Function to describe a protocol error of a WebSocket peer.
+func (e *webSocketError) Error() string {
+	return e.reason
+}
+
+// A structure that represent a WebSocket connection on the server side, as described in RFC 6455.
+// Messages are read by one goroutine, writes are safe from multiple goroutines. Extensions and
+// subprotocols are not supported.
+type webSocket struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	mutex   sync.Mutex    // guards writes
+	timeout time.Duration // a peer that sends nothing for this long is dead, 0 waits forever
+}
+
+// Function to upgrade an HTTP request to a WebSocket connection. If the request is not a valid
+// WebSocket handshake, an error response is written and an error is returned. The webSocketProtocol
+// subprotocol is selected when the peer offers it, no other subprotocol is ever selected.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocket, error) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return nil, errors.New("websocket handshake needs GET, not " + r.Method)
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		writeHTTPError(w, http.StatusBadRequest, errorBadRequest, "request is not a websocket handshake")
+		return nil, errors.New("request is not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeHTTPError(w, http.StatusUpgradeRequired, errorBadRequest, "websocket version 13 is required")
+		return nil, errors.New("websocket version " + r.Header.Get("Sec-WebSocket-Version") + " is not supported")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		writeHTTPError(w, http.StatusBadRequest, errorBadRequest, "Sec-WebSocket-Key is required")
+		return nil, errors.New("websocket handshake has no key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, "", "connection cannot be upgraded")
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := ""
+	if headerHasToken(r.Header, "Sec-WebSocket-Protocol", webSocketProtocol) {
+		selected = "Sec-WebSocket-Protocol: " + webSocketProtocol + "\r\n"
+	}
+
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n" + selected + "\r\n")
+	if err := buffer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &webSocket{conn: conn, reader: buffer.Reader}, nil
+}
+
+// Function to check whether a comma separated header has a token, ignoring case.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Function to read the next text or binary message. Fragmented messages are put together, and text
+// messages have to be valid UTF-8. Pings are answered and pongs are skipped. When the peer sends a close
+// frame, it is answered and errWebSocketClosed is returned. A peer that breaks the protocol gets a close
+// frame with the reason.
+func (ws *webSocket) ReadMessage() ([]byte, error) {
+	var message []byte
+	var first byte // opcode of the first frame of the message
+	started := false
+
+	for {
+		if ws.timeout > 0 {
+			ws.conn.SetReadDeadline(time.Now().Add(ws.timeout))
+		}
+
+		final, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			var protocolErr *webSocketError
+			if errors.As(err, &protocolErr) {
+				ws.Close(protocolErr.status, protocolErr.reason)
+			}
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := ws.write(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			status := closeNormal
+			if len(payload) >= 2 {
+				status = int(binary.BigEndian.Uint16(payload))
+			}
+			ws.Close(status, "")
+			return nil, errWebSocketClosed
+		case opText, opBinary:
+			if started {
+				return nil, ws.fail(closeProtocolError, "new message before the last one is finished")
+			}
+			started = true
+			first = opcode
+			message = payload
+		case opContinuation:
+			if !started {
+				return nil, ws.fail(closeProtocolError, "continuation without a message")
+			}
+			if len(message)+len(payload) > maxRequestSize {
+				return nil, ws.fail(closeTooLarge, "message is larger than the broker accepts")
+			}
+			message = append(message, payload...)
+		default:
+			return nil, ws.fail(closeProtocolError, "unknown opcode")
+		}
+
+		if final {
+			if first == opText && !utf8.Valid(message) {
+				return nil, ws.fail(closeInvalidData, "message is not valid UTF-8")
+			}
+			return message, nil
+		}
+	}
+}
+
+// Function to read one frame and unmask its payload. Frames of the peer have to be masked, and
+// control frames cannot be fragmented or longer than 125 bytes.
+func (ws *webSocket) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	final := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &webSocketError{closeProtocolError, "extensions are not supported"}
+	}
+	if !masked {
+		return false, 0, nil, &webSocketError{closeProtocolError, "frames of the client should be masked"}
+	}
+	if opcode >= opClose && (!final || length > 125) {
+		return false, 0, nil, &webSocketError{closeProtocolError, "control frame is fragmented or too long"}
+	}
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > maxRequestSize {
+		return false, 0, nil, &webSocketError{closeTooLarge, "message is larger than the broker accepts"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return final, opcode, payload, nil
+}
+
+// Function to close the connection after a protocol error of the peer.
+func (ws *webSocket) fail(status int, reason string) error {
+	ws.Close(status, reason)
+	return &webSocketError{status, reason}
+}
+
+// Function to write a text message.
+func (ws *webSocket) WriteMessage(message []byte) error {
+	return ws.write(opText, message)
+}
+
+// Function to write a ping, the peer answers it with a pong.
+func (ws *webSocket) Ping() error {
+	return ws.write(opPing, nil)
+}
+
+// Function to write a frame that is not fragmented. Frames of the server are not masked.
+// A peer that does not read for a while is dead, so a write waits at most the timeout.
+func (ws *webSocket) write(opcode byte, payload []byte) error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	header := []byte{0x80 | opcode, 0}
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	if ws.timeout > 0 {
+		ws.conn.SetWriteDeadline(time.Now().Add(ws.timeout))
+	}
+
+	_, err := ws.conn.Write(append(header, payload...))
+	return err
+}
+
+// Function to send a close frame with a status code and reason and close the connection.
+func (ws *webSocket) Close(status int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(status))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+
+	ws.write(opClose, payload)
+	return ws.conn.Close()
+}
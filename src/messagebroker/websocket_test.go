@@ -0,0 +1,352 @@
+package messagebroker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A structure that represent a frame in a test, as the client sends it or the server sent it.
+type testFrame struct {
+	final    bool
+	opcode   byte
+	payload  []byte
+	unmasked bool // the client breaks the protocol and does not mask the frame
+	rsv      bool // the client sets a reserved bit of an extension
+}
+
+// Function to encode a frame like a client does, masked unless the test frame says otherwise.
+func (f testFrame) encode() []byte {
+	first := f.opcode
+	if f.final {
+		first |= 0x80
+	}
+	if f.rsv {
+		first |= 0x40
+	}
+
+	mask := byte(0x80)
+	if f.unmasked {
+		mask = 0
+	}
+
+	frame := []byte{first, 0}
+	switch length := len(f.payload); {
+	case length <= 125:
+		frame[1] = mask | byte(length)
+	case length <= 0xffff:
+		frame[1] = mask | 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame[1] = mask | 127
+		frame = append(frame, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	if f.unmasked {
+		return append(frame, f.payload...)
+	}
+
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, key...)
+	for i, b := range f.payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+// Function to decode the frames the server wrote. Frames of the server are not masked.
+func decodeFrames(t *testing.T, data []byte) []testFrame {
+	t.Helper()
+
+	var frames []testFrame
+	for len(data) > 0 {
+		if len(data) < 2 || data[1]&0x80 != 0 {
+			t.Fatalf("server wrote a frame that is cut off or masked: %x", data)
+		}
+		final, opcode := data[0]&0x80 != 0, data[0]&0x0f
+		length, header := uint64(data[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, header = uint64(binary.BigEndian.Uint16(data[2:])), 4
+		case 127:
+			length, header = binary.BigEndian.Uint64(data[2:]), 10
+		}
+		end := header + int(length)
+		frames = append(frames, testFrame{final: final, opcode: opcode, payload: data[header:end]})
+		data = data[end:]
+	}
+	return frames
+}
+
+// Function to create a WebSocket of the server connected to a client through a pipe. The client
+// sends the given frames, and what the server writes back is returned once the connection is closed.
+func pipeWebSocket(frames []testFrame) (*webSocket, func() []byte) {
+	server, client := net.Pipe()
+	ws := &webSocket{conn: server, reader: bufio.NewReader(server)}
+
+	go func() {
+		for _, frame := range frames {
+			if _, err := client.Write(frame.encode()); err != nil {
+				return
+			}
+		}
+	}()
+
+	written := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(client)
+		written <- data
+	}()
+
+	return ws, func() []byte {
+		server.Close()
+		return <-written
+	}
+}
+
+// Function to get the close status of the last frame the server wrote, 0 if it is not a close frame.
+func closeStatus(frames []testFrame) int {
+	if len(frames) == 0 {
+		return 0
+	}
+	last := frames[len(frames)-1]
+	if last.opcode != opClose || len(last.payload) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(last.payload))
+}
+
+// Function to check reading messages: lengths, masking, fragmentation, control frames and protocol errors.
+func TestWebSocketReadMessage(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 300)
+	longer := bytes.Repeat([]byte("b"), 70000)
+	euro := []byte("€") // three bytes in UTF-8
+
+	tests := []struct {
+		name    string
+		frames  []testFrame
+		expects []byte
+		status  int         // close status the server sends, 0 if the message is read
+		replies []testFrame // frames the server writes before it closes, if any
+	}{
+		{"text", []testFrame{{final: true, opcode: opText, payload: []byte("hello")}}, []byte("hello"), 0, nil},
+		{"empty", []testFrame{{final: true, opcode: opText}}, []byte{}, 0, nil},
+		{"binary", []testFrame{{final: true, opcode: opBinary, payload: []byte{0xff, 0x00}}}, []byte{0xff, 0x00}, 0, nil},
+		{"16 bit length", []testFrame{{final: true, opcode: opText, payload: long}}, long, 0, nil},
+		{"64 bit length", []testFrame{{final: true, opcode: opBinary, payload: longer}}, longer, 0, nil},
+		{"fragmented", []testFrame{
+			{opcode: opText, payload: []byte("hel")},
+			{opcode: opContinuation, payload: []byte("lo ")},
+			{final: true, opcode: opContinuation, payload: []byte("world")},
+		}, []byte("hello world"), 0, nil},
+		{"character split over fragments", []testFrame{
+			{opcode: opText, payload: euro[:1]},
+			{final: true, opcode: opContinuation, payload: euro[1:]},
+		}, euro, 0, nil},
+		{"ping between fragments is answered", []testFrame{
+			{opcode: opText, payload: []byte("hel")},
+			{final: true, opcode: opPing, payload: []byte("are you there")},
+			{final: true, opcode: opContinuation, payload: []byte("lo")},
+		}, []byte("hello"), 0, []testFrame{{final: true, opcode: opPong, payload: []byte("are you there")}}},
+		{"pong is skipped", []testFrame{
+			{final: true, opcode: opPong},
+			{final: true, opcode: opText, payload: []byte("hello")},
+		}, []byte("hello"), 0, nil},
+		{"binary is not checked for UTF-8", []testFrame{{final: true, opcode: opBinary, payload: []byte{0xc3, 0x28}}},
+			[]byte{0xc3, 0x28}, 0, nil},
+		{"fragmented binary is not checked for UTF-8", []testFrame{
+			{opcode: opBinary, payload: []byte{0xc3}},
+			{final: true, opcode: opContinuation, payload: []byte{0x28}},
+		}, []byte{0xc3, 0x28}, 0, nil},
+		{"close is answered", []testFrame{{final: true, opcode: opClose, payload: []byte{0x03, 0xe8}}}, nil, closeNormal, nil},
+		{"close without status", []testFrame{{final: true, opcode: opClose}}, nil, closeNormal, nil},
+		{"text is not UTF-8", []testFrame{{final: true, opcode: opText, payload: []byte{0xc3, 0x28}}}, nil, closeInvalidData, nil},
+		{"unmasked", []testFrame{{final: true, opcode: opText, payload: []byte("hello"), unmasked: true}},
+			nil, closeProtocolError, nil},
+		{"extension bit", []testFrame{{final: true, opcode: opText, payload: []byte("hello"), rsv: true}},
+			nil, closeProtocolError, nil},
+		{"continuation without message", []testFrame{{final: true, opcode: opContinuation, payload: []byte("hello")}},
+			nil, closeProtocolError, nil},
+		{"message before the last one is finished", []testFrame{
+			{opcode: opText, payload: []byte("hel")},
+			{final: true, opcode: opText, payload: []byte("hello")},
+		}, nil, closeProtocolError, nil},
+		{"fragmented control frame", []testFrame{{opcode: opPing}}, nil, closeProtocolError, nil},
+		{"long control frame", []testFrame{{final: true, opcode: opPing, payload: long}}, nil, closeProtocolError, nil},
+		{"unknown opcode", []testFrame{{final: true, opcode: 0x3}}, nil, closeProtocolError, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws, written := pipeWebSocket(test.frames)
+
+			message, err := ws.ReadMessage()
+			frames := decodeFrames(t, written())
+
+			if test.status == 0 {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				if !bytes.Equal(message, test.expects) {
+					t.Errorf("message = %q, expected %q", message, test.expects)
+				}
+				if len(frames) != len(test.replies) {
+					t.Fatalf("server wrote %d frames, expected %d", len(frames), len(test.replies))
+				}
+				for i, reply := range test.replies {
+					if frames[i].opcode != reply.opcode || !bytes.Equal(frames[i].payload, reply.payload) {
+						t.Errorf("frame %d = %x %q, expected %x %q", i, frames[i].opcode, frames[i].payload, reply.opcode, reply.payload)
+					}
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("message %q is read, expected close status %d", message, test.status)
+			}
+			if status := closeStatus(frames); status != test.status {
+				t.Errorf("close status = %d, expected %d", status, test.status)
+			}
+
+			var protocolErr *webSocketError
+			if test.status == closeNormal && err != errWebSocketClosed {
+				t.Errorf("err = %v, expected %v", err, errWebSocketClosed)
+			} else if test.status != closeNormal && (!errors.As(err, &protocolErr) || protocolErr.status != test.status) {
+				t.Errorf("err = %v, expected a protocol error with status %d", err, test.status)
+			}
+		})
+	}
+}
+
+// Function to check that a frame longer than the broker accepts is refused before its payload is read.
+func TestWebSocketReadTooLarge(t *testing.T) {
+	server, client := net.Pipe()
+	ws := &webSocket{conn: server, reader: bufio.NewReader(server)}
+
+	header := []byte{0x80 | opBinary, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(header[2:], maxRequestSize+1)
+	go client.Write(header)
+
+	written := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(client)
+		written <- data
+	}()
+
+	_, err := ws.ReadMessage()
+	server.Close()
+
+	var protocolErr *webSocketError
+	if !errors.As(err, &protocolErr) || protocolErr.status != closeTooLarge {
+		t.Errorf("err = %v, expected a protocol error with status %d", err, closeTooLarge)
+	}
+	if status := closeStatus(decodeFrames(t, <-written)); status != closeTooLarge {
+		t.Errorf("close status = %d, expected %d", status, closeTooLarge)
+	}
+}
+
+// Function to check that frames of the server use the shortest length encoding and are not masked.
+func TestWebSocketWrite(t *testing.T) {
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{0, []byte{0x81, 0}},
+		{125, []byte{0x81, 125}},
+		{126, []byte{0x81, 126, 0, 126}},
+		{0xffff, []byte{0x81, 126, 0xff, 0xff}},
+		{0x10000, []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+
+	for _, test := range tests {
+		ws, written := pipeWebSocket(nil)
+		payload := bytes.Repeat([]byte("x"), test.length)
+
+		if err := ws.WriteMessage(payload); err != nil {
+			t.Fatal(err)
+		}
+		data := written()
+
+		if !bytes.HasPrefix(data, test.header) {
+			t.Errorf("header of %d bytes = %x, expected %x", test.length, data[:len(test.header)], test.header)
+		}
+		if !bytes.Equal(data[len(test.header):], payload) {
+			t.Errorf("payload of %d bytes is not written as it is", test.length)
+		}
+	}
+}
+
+// Function to check the opening handshake, the accept key is the example of RFC 6455.
+func TestUpgradeWebSocket(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{"valid", http.MethodGet, map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket",
+			"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusSwitchingProtocols},
+		{"not GET", http.MethodPost, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket",
+			"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusMethodNotAllowed},
+		{"no upgrade", http.MethodGet, map[string]string{"Sec-WebSocket-Version": "13",
+			"Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusBadRequest},
+		{"old version", http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket",
+			"Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusUpgradeRequired},
+		{"no key", http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket",
+			"Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ws, err := upgradeWebSocket(w, r); err == nil {
+			ws.Close(closeNormal, "")
+		}
+	}))
+	defer server.Close()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			request, _ := http.NewRequest(test.method, server.URL+"/ws", nil)
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+			if err := request.Write(conn); err != nil {
+				t.Fatal(err)
+			}
+
+			reader := bufio.NewReader(conn)
+			response, err := http.ReadResponse(reader, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("status = %d, expected %d", response.StatusCode, test.status)
+			}
+			if test.status != http.StatusSwitchingProtocols {
+				return
+			}
+
+			if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("accept key = %q", accept)
+			}
+			data, _ := io.ReadAll(reader)
+			if status := closeStatus(decodeFrames(t, data)); status != closeNormal {
+				t.Errorf("close status = %d, expected %d", status, closeNormal)
+			}
+		})
+	}
+}
@@ -0,0 +1,911 @@
+// Package producer is a client library to publish messages to the broker and to send requests
+// that the server replies to. A producer uses two connections like the client binary does:
+// it reads replies from the reading port and publishes to the writing port.
+package producer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distributed-systems-message-queue/src/protocol"
+	"distributed-systems-message-queue/src/security"
+)
+
+// Errors returned by a producer.
+var (
+	ErrClosed         = errors.New("producer is closed")
+	ErrTimeout        = errors.New("request timed out")
+	ErrConnectionLost = errors.New("connection to broker is lost")
+	ErrNoTransactions = errors.New("broker does not support transactions")
+	ErrFinished       = errors.New("transaction is already committed or aborted")
+)
+
+// An error returned when the broker rejects a published message. Code tells why, as one of the
+// error codes of the protocol. RetryAfter is how long the broker asks to wait before publishing
+// again, when it rejected the message for its rate limit.
+type RejectedError struct {
+	ID         string
+	Code       string
+	Reason     string
+	RetryAfter time.Duration
+}
+
+// Function to describe a rejected message.
+func (e *RejectedError) Error() string {
+	if e.RetryAfter > 0 {
+		return "message " + e.ID + " is rejected: " + e.Reason + ", retry after " + e.RetryAfter.String()
+	}
+	return "message " + e.ID + " is rejected: " + e.Reason
+}
+
+// Function to tell if publishing the message again later may succeed, because the queue was full
+// or the producer was over its rate limit.
+func (e *RejectedError) Retryable() bool {
+	return e.Code == protocol.ErrorQueueFull || e.Code == protocol.ErrorRateLimited
+}
+
+// A structure that represent a message received from the broker.
+type Message struct {
+	ID            string // ID the broker gave the delivery
+	ClientID      string
+	CorrelationID string // ID of the request the message replies to
+	Key           string
+	DedupID       string            // ID the broker drops duplicates of a published message by
+	Headers       map[string]string // metadata the broker passes on to the consumer
+	Body          string
+}
+
+// A structure that represent the reply to a request, or the error the broker sent instead.
+type reply struct {
+	message Message
+	err     error
+}
+
+// A structure that represent options of a producer.
+type options struct {
+	host           string
+	clientID       string
+	username       string
+	password       string
+	token          string
+	tlsConfig      *tls.Config
+	heartbeat      time.Duration
+	reconnectDelay time.Duration
+	requestTimeout time.Duration
+	maxBatch       int
+	idempotent     bool
+	linger         time.Duration
+	handler        func(message Message)
+	errorHandler   func(err error)
+	logger         *log.Logger
+}
+
+// A function that changes an option of a producer created by Connect.
+type Option func(o *options)
+
+// Function to set the host name or IP address of the broker. The ports given to Connect
+// are dialed on this host, on the local machine by default.
+func WithAddress(host string) Option {
+	return func(o *options) {
+		o.host = host
+	}
+}
+
+// Function to set client ID sent in handshake. A producer with a client certificate
+// or credentials can leave it empty, then the broker uses the certificate or user name.
+// By default it is producer-<pid>-<random>, see defaultClientID.
+func WithClientID(clientID string) Option {
+	return func(o *options) {
+		o.clientID = clientID
+	}
+}
+
+// Function to authenticate with a user name and password.
+func WithPassword(username, password string) Option {
+	return func(o *options) {
+		o.username, o.password = username, password
+	}
+}
+
+// Function to authenticate with a bearer token.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// Function to connect with TLS. Connections use plain TCP when it is nil.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = tlsConfig
+	}
+}
+
+// Function to set heartbeat interval proposed in handshake. Zero leaves it to the broker.
+func WithHeartbeat(heartbeat time.Duration) Option {
+	return func(o *options) {
+		o.heartbeat = heartbeat
+	}
+}
+
+// Function to set how long to wait between attempts to reconnect to the broker.
+func WithReconnectDelay(delay time.Duration) Option {
+	return func(o *options) {
+		o.reconnectDelay = delay
+	}
+}
+
+// Function to set how long Request waits for a reply when its context has no deadline.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.requestTimeout = timeout
+	}
+}
+
+// Function to batch published messages. A batch is written when it has maxSize messages or
+// linger time after its first message, whichever comes first. Requests are never batched.
+func WithBatching(maxSize int, linger time.Duration) Option {
+	return func(o *options) {
+		o.maxBatch, o.linger = maxSize, linger
+	}
+}
+
+// Function to number published messages with a producer ID and sequence number. Messages that
+// are not confirmed when the connection is lost are published again after reconnecting, and
+// the broker drops the ones it already has, so every message is enqueued once.
+func WithIdempotence() Option {
+	return func(o *options) {
+		o.idempotent = true
+	}
+}
+
+// Function to handle messages from the broker that are not replies to a pending request.
+// Such messages are dropped when no handler is set.
+func WithHandler(handler func(message Message)) Option {
+	return func(o *options) {
+		o.handler = handler
+	}
+}
+
+// Function to handle errors the broker sends that do not belong to a published message.
+func WithErrorHandler(handler func(err error)) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// Function to log with given logger instead of the standard logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// A structure that represent the confirmation of a published message. It is done when the
+// broker accepts or rejects the message, or when the connection is lost before that.
+type Confirmation struct {
+	ID   string
+	done chan struct{}
+	err  error
+}
+
+// Function to create a pending confirmation.
+func newConfirmation(id string) *Confirmation {
+	return &Confirmation{ID: id, done: make(chan struct{})}
+}
+
+// Function to finish a confirmation with the result of the message.
+func (c *Confirmation) finish(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// Function to get a channel that is closed when the confirmation is done.
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Function to get result of the message after the confirmation is done. It is nil when the
+// broker accepted the message, a *RejectedError when it rejected it, or ErrConnectionLost.
+func (c *Confirmation) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Function to call callback with result of the message once the confirmation is done.
+// The callback runs on its own goroutine, so many messages can wait for confirmation
+// without blocking the publisher.
+func (c *Confirmation) OnDone(callback func(err error)) {
+	go func() {
+		<-c.done
+		callback(c.err)
+	}()
+}
+
+// Function to wait until the confirmation is done or ctx is done.
+func (c *Confirmation) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A structure that represent a producer connected to the broker. It reconnects when the
+// broker is declared dead, until it is closed. It is safe to use from multiple goroutines.
+type Producer struct {
+	counter     uint64 // used to give every published message a unique ID and sequence number
+	options     options
+	producerID  string // identifies the producer to the broker when it is idempotent
+	readingPort string
+	writingPort string
+
+	mutex    sync.Mutex // guards reader, writer, confirms and requests
+	reader   *protocol.Conn
+	writer   *protocol.Conn
+	confirms map[string]pending    // messages waiting for confirmation by ID
+	requests map[string]chan reply // requests waiting for a reply by correlation ID
+
+	batchMutex sync.Mutex // guards batch and linger, and keeps writes of messages in order
+	batch      []pending
+	linger     *time.Timer
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Function to create the client ID of a producer that was not given one. The process ID
+// tells where it runs, and the random suffix keeps producers of the same process apart, as the
+// broker rejects a client ID that is already connected.
+func defaultClientID() string {
+	bytes := make([]byte, 4)
+	rand.Read(bytes)
+	return "producer-" + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(bytes)
+}
+
+// Function to connect to the broker. It connects to the reading port first, as the broker
+// accepts them in this order, and waits for both handshakes or until ctx is done.
+func Connect(ctx context.Context, readingPort, writingPort string, opts ...Option) (*Producer, error) {
+	p := &Producer{
+		options: options{
+			clientID:       defaultClientID(),
+			reconnectDelay: time.Second,
+			requestTimeout: 30 * time.Second,
+			logger:         log.Default(),
+		},
+		readingPort: readingPort,
+		writingPort: writingPort,
+		confirms:    make(map[string]pending),
+		requests:    make(map[string]chan reply),
+		done:        make(chan struct{}),
+	}
+
+	for _, option := range opts {
+		option(&p.options)
+	}
+
+	if p.options.idempotent {
+		p.producerID = newProducerID()
+	}
+
+	reader, err := p.dial(ctx, readingPort)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both connections have to use the same identity, the one the broker gave the first.
+	p.options.clientID = reader.ClientID()
+
+	writer, err := p.dial(ctx, writingPort)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	p.reader, p.writer = reader, writer
+
+	p.wg.Add(2)
+	go p.read(reader)
+	go p.watch(writer)
+
+	return p, nil
+}
+
+// Function to create a random producer ID, so no two producers number their messages the same.
+func newProducerID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// Function to get client ID the broker knows the producer by.
+func (p *Producer) ClientID() string {
+	return p.options.clientID
+}
+
+// Function to dial the broker and do handshake as a producer. The connection is closed if ctx is done first.
+func (p *Producer) dial(ctx context.Context, port string) (*protocol.Conn, error) {
+	netConn, err := security.Dial(net.JoinHostPort(p.options.host, port), p.options.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := protocol.NewConn(netConn)
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-p.done:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	hello := protocol.Frame{ClientID: p.options.clientID, Role: protocol.RoleProducer, Capabilities: protocol.Capabilities,
+		Username: p.options.username, Password: p.options.password, Token: p.options.token}
+
+	_, err = conn.Handshake(hello, p.options.heartbeat)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Function to dial a port again after its connection failed. It keeps dialing until it
+// succeeds or the producer is closed, then it returns nil.
+func (p *Producer) redial(port string, old *protocol.Conn, reason error) *protocol.Conn {
+	old.Close()
+	if p.closed() {
+		return nil
+	}
+	p.options.logger.Println("ERROR:", "lost connection to broker:", reason)
+
+	for {
+		select {
+		case <-p.done:
+			return nil
+		case <-time.After(p.options.reconnectDelay):
+		}
+
+		conn, err := p.dial(context.Background(), port)
+		if err == nil {
+			p.options.logger.Println("LOG:", "reconnected to broker on port "+port)
+			return conn
+		}
+		if p.closed() {
+			return nil
+		}
+		p.options.logger.Println("ERROR:", err)
+	}
+}
+
+// Function to read messages from the reading connection. Every message the broker tracks is
+// acknowledged, replies go to their pending request and other messages to the handler.
+func (p *Producer) read(conn *protocol.Conn) {
+	defer p.wg.Done()
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			if conn = p.redial(p.readingPort, conn, err); conn == nil {
+				return
+			}
+			p.mutex.Lock()
+			p.reader = conn
+			p.mutex.Unlock()
+			continue
+		}
+
+		switch frame.Type {
+		case protocol.MessageFrame:
+			if frame.ID != "" {
+				if err := conn.Ack(frame.ID); err != nil {
+					p.options.logger.Println("ERROR:", "could not acknowledge message:", err)
+				}
+			}
+			p.receive(Message{ID: frame.ID, ClientID: frame.ClientID, CorrelationID: frame.CorrelationID, Key: frame.Key,
+				Headers: frame.Headers, Body: frame.Body})
+		case protocol.ErrorFrame:
+			err := errors.New(frame.Reason)
+			if frame.Code == protocol.ErrorTimeout {
+				err = ErrTimeout
+			}
+			if frame.CorrelationID == "" || !p.fail(frame.CorrelationID, err) {
+				p.handleError(errors.New(frame.Reason))
+			}
+		}
+	}
+}
+
+// Function to pass a received message to the request it replies to or to the handler.
+func (p *Producer) receive(message Message) {
+	if !p.finishRequest(message.CorrelationID, reply{message: message}) && p.options.handler != nil {
+		p.options.handler(message)
+	}
+}
+
+// Function to fail the request with a correlation ID, when the broker sent an error for it.
+// It returns false if no request has the ID.
+func (p *Producer) fail(id string, err error) bool {
+	return p.finishRequest(id, reply{err: err})
+}
+
+// Function to pass a reply to the request with a correlation ID. It returns false if no request has the ID.
+func (p *Producer) finishRequest(id string, r reply) bool {
+	p.mutex.Lock()
+	request, ok := p.requests[id]
+	if ok {
+		delete(p.requests, id)
+	}
+	p.mutex.Unlock()
+
+	if ok {
+		request <- r
+	}
+	return ok
+}
+
+// Function to handle an error the broker sent that does not belong to a published message.
+func (p *Producer) handleError(err error) {
+	if p.options.errorHandler != nil {
+		p.options.errorHandler(err)
+	} else {
+		p.options.logger.Println("ERROR:", "broker:", err)
+	}
+}
+
+// Function to watch the writing connection for confirmations. When the connection is lost,
+// messages that are not confirmed yet fail with ErrConnectionLost, as the broker may or may not have them.
+// Idempotent producers publish them again after reconnecting instead, and the broker drops the duplicates.
+func (p *Producer) watch(conn *protocol.Conn) {
+	defer p.wg.Done()
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			if !p.options.idempotent {
+				p.failConfirms()
+			}
+			if conn = p.redial(p.writingPort, conn, err); conn == nil {
+				return
+			}
+			p.resend(conn)
+			continue
+		}
+
+		switch frame.Type {
+		case protocol.AckFrame:
+			p.confirm(frame.ID, nil)
+		case protocol.ErrorFrame:
+			rejected := &RejectedError{ID: frame.ID, Code: frame.Code, Reason: frame.Reason, RetryAfter: time.Duration(frame.RetryAfter) * time.Millisecond}
+			if frame.ID == "" || !p.confirm(frame.ID, rejected) {
+				p.handleError(errors.New(frame.Reason))
+			}
+		}
+	}
+}
+
+// Function to finish the confirmation of a message. It returns false if no message has the ID.
+func (p *Producer) confirm(id string, err error) bool {
+	p.mutex.Lock()
+	message, ok := p.confirms[id]
+	delete(p.confirms, id)
+	p.mutex.Unlock()
+
+	if ok {
+		message.confirmation.finish(err)
+	}
+	return ok
+}
+
+// Function to fail all confirmations that are not done yet.
+func (p *Producer) failConfirms() {
+	p.mutex.Lock()
+	confirms := p.confirms
+	p.confirms = make(map[string]pending)
+	p.mutex.Unlock()
+
+	for _, message := range confirms {
+		message.confirmation.finish(ErrConnectionLost)
+	}
+}
+
+// Function to use a new writing connection. Messages that are not confirmed yet are written
+// again on it in the order they were published, before any new message.
+func (p *Producer) resend(conn *protocol.Conn) {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	p.mutex.Lock()
+	p.writer = conn
+	messages := make([]pending, 0, len(p.confirms))
+	commits := make([]pending, 0)
+	for id, message := range p.confirms {
+		if message.frame.Transaction != "" {
+			// The broker aborted the transaction when the old connection was lost.
+			delete(p.confirms, id)
+			commits = append(commits, message)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	p.mutex.Unlock()
+
+	for _, commit := range commits {
+		commit.confirmation.finish(ErrConnectionLost)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].frame.Sequence < messages[j].frame.Sequence
+	})
+
+	for _, message := range messages {
+		if err := conn.WriteFrame(message.frame); err != nil {
+			return
+		}
+	}
+	if len(messages) > 0 {
+		p.options.logger.Println("LOG:", "published "+strconv.Itoa(len(messages))+" unconfirmed messages again")
+	}
+}
+
+// Function to publish a message and wait until the broker confirms it or ctx is done.
+func (p *Producer) Publish(ctx context.Context, body string) error {
+	return p.PublishAsync(body).Wait(ctx)
+}
+
+// Function to publish a message without waiting. The returned confirmation is done when the
+// broker confirms the message. If the broker does not support confirms, it is done once the
+// message is written.
+func (p *Producer) PublishAsync(body string) *Confirmation {
+	return p.publish(protocol.Frame{Type: protocol.MessageFrame, Body: body}, true)
+}
+
+// Function to publish a message with the key, dedup ID and body of given message and wait until
+// the broker confirms it or ctx is done. The broker drops a message whose dedup ID it has seen
+// within the dedup window of the queue.
+func (p *Producer) PublishMessage(ctx context.Context, message Message) error {
+	return p.PublishMessageAsync(message).Wait(ctx)
+}
+
+// Function to publish a message with the key, dedup ID, headers and body of given message without waiting.
+func (p *Producer) PublishMessageAsync(message Message) *Confirmation {
+	return p.publish(protocol.Frame{Type: protocol.MessageFrame, Key: message.Key, DedupID: message.DedupID,
+		Headers: message.Headers, Body: message.Body}, true)
+}
+
+// Function to publish a message with an ordering key and wait until the broker confirms it or ctx is done.
+// Messages with the same key are handled by consumers in the order they are published.
+func (p *Producer) PublishWithKey(ctx context.Context, key, body string) error {
+	return p.PublishWithKeyAsync(key, body).Wait(ctx)
+}
+
+// Function to publish a message with an ordering key without waiting.
+func (p *Producer) PublishWithKeyAsync(key, body string) *Confirmation {
+	return p.publish(protocol.Frame{Type: protocol.MessageFrame, Key: key, Body: body}, true)
+}
+
+// A structure that represent a message frame that waits to be written.
+type pending struct {
+	frame        protocol.Frame
+	confirmation *Confirmation
+}
+
+// Function to give a message frame a new ID and write it. When batching is enabled, batched
+// frames wait in the batch until it is full or its linger time has passed. Other frames are
+// written at once, after the batch, so messages are written in the order they are published.
+func (p *Producer) publish(frame protocol.Frame, batched bool) *Confirmation {
+	frame.Sequence = atomic.AddUint64(&p.counter, 1)
+	frame.ID = strconv.FormatUint(frame.Sequence, 10)
+	confirmation := newConfirmation(frame.ID)
+	if p.options.idempotent {
+		frame.ProducerID = p.producerID
+	} else {
+		frame.Sequence = 0
+	}
+
+	if p.closed() {
+		confirmation.finish(ErrClosed)
+		return confirmation
+	}
+
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	if !batched || p.options.maxBatch <= 1 {
+		p.flush()
+		p.write([]pending{{frame: frame, confirmation: confirmation}})
+		return confirmation
+	}
+
+	p.batch = append(p.batch, pending{frame: frame, confirmation: confirmation})
+	if len(p.batch) >= p.options.maxBatch {
+		p.flush()
+	} else if len(p.batch) == 1 {
+		p.linger = time.AfterFunc(p.options.linger, p.Flush)
+	}
+
+	return confirmation
+}
+
+// Function to write the messages that wait in the batch now.
+func (p *Producer) Flush() {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	p.flush()
+}
+
+// Function to write the messages that wait in the batch, while batchMutex is held.
+func (p *Producer) flush() {
+	if p.linger != nil {
+		p.linger.Stop()
+		p.linger = nil
+	}
+
+	if len(p.batch) > 0 {
+		p.write(p.batch)
+		p.batch = nil
+	}
+}
+
+// Function to write message frames and track their confirmations. More than one frame is
+// written as a batch frame, so the broker enqueues them together, if the broker supports it.
+func (p *Producer) write(messages []pending) {
+	p.mutex.Lock()
+	writer := p.writer
+	confirmed := writer.HasCapability(protocol.ConfirmCapability)
+	if confirmed {
+		for _, message := range messages {
+			p.confirms[message.frame.ID] = message
+		}
+	}
+	p.mutex.Unlock()
+
+	var err error
+	if len(messages) > 1 && writer.HasCapability(protocol.BatchCapability) {
+		frames := make([]protocol.Frame, len(messages))
+		for i, message := range messages {
+			frames[i] = message.frame
+		}
+		err = writer.WriteFrame(protocol.Frame{Type: protocol.BatchFrame, Messages: frames})
+	} else {
+		for _, message := range messages {
+			if err = writer.WriteFrame(message.frame); err != nil {
+				break
+			}
+		}
+	}
+
+	for _, message := range messages {
+		if err != nil && confirmed && p.options.idempotent {
+			// The message is published again once the watcher has reconnected.
+			continue
+		}
+		if err != nil {
+			// The watcher may have failed the confirmation already when it lost the connection.
+			if !p.confirm(message.frame.ID, ErrConnectionLost) && !confirmed {
+				message.confirmation.finish(ErrConnectionLost)
+			}
+		} else if !confirmed {
+			message.confirmation.finish(nil)
+		}
+	}
+}
+
+// A structure that represent a transaction of a producer. Messages published in it are enqueued
+// when it is committed, all of them or none, and dropped when it is aborted. The broker aborts
+// the transaction when the writing connection is lost, then Commit fails with ErrConnectionLost.
+type Transaction struct {
+	ID       string
+	producer *Producer
+	conn     *protocol.Conn // writing connection the transaction was started on
+
+	mutex    sync.Mutex // guards finished
+	finished bool
+}
+
+// Function to start a transaction. Messages that wait in the batch are written first.
+func (p *Producer) Begin() (*Transaction, error) {
+	if p.closed() {
+		return nil, ErrClosed
+	}
+
+	p.Flush()
+
+	p.mutex.Lock()
+	conn := p.writer
+	p.mutex.Unlock()
+
+	if !conn.HasCapability(protocol.TransactionCapability) || !conn.HasCapability(protocol.ConfirmCapability) {
+		return nil, ErrNoTransactions
+	}
+
+	t := &Transaction{ID: strconv.FormatUint(atomic.AddUint64(&p.counter, 1), 10), producer: p, conn: conn}
+	if err := conn.WriteFrame(protocol.Frame{Type: protocol.BeginFrame, Transaction: t.ID}); err != nil {
+		return nil, ErrConnectionLost
+	}
+	return t, nil
+}
+
+// Function to write a frame of the transaction unless it is finished.
+func (t *Transaction) write(frame protocol.Frame) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.finished {
+		return ErrFinished
+	}
+
+	frame.Transaction = t.ID
+	if err := t.conn.WriteFrame(frame); err != nil {
+		return ErrConnectionLost
+	}
+	return nil
+}
+
+// Function to publish a message to a queue in the transaction. An empty queue is the queue of
+// the producer, any other queue has to exist. The message is enqueued when the transaction is committed.
+func (t *Transaction) Publish(queue, body string) error {
+	return t.PublishMessage(queue, Message{Body: body})
+}
+
+// Function to publish a message with the key, dedup ID, headers and body of given message to a queue in the transaction.
+func (t *Transaction) PublishMessage(queue string, message Message) error {
+	return t.write(protocol.Frame{Type: protocol.MessageFrame, Queue: queue, Key: message.Key, DedupID: message.DedupID,
+		Headers: message.Headers, Body: message.Body})
+}
+
+// Function to commit the transaction and wait until the broker enqueued its messages or ctx is done.
+// If any message cannot be enqueued, none is and it fails with a *RejectedError.
+func (t *Transaction) Commit(ctx context.Context) error {
+	p := t.producer
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.finished {
+		return ErrFinished
+	}
+	t.finished = true
+
+	frame := protocol.Frame{Type: protocol.CommitFrame, ID: strconv.FormatUint(atomic.AddUint64(&p.counter, 1), 10), Transaction: t.ID}
+	confirmation := newConfirmation(frame.ID)
+
+	p.mutex.Lock()
+	if p.writer != t.conn {
+		p.mutex.Unlock()
+		return ErrConnectionLost
+	}
+	p.confirms[frame.ID] = pending{frame: frame, confirmation: confirmation}
+	p.mutex.Unlock()
+
+	if err := t.conn.WriteFrame(frame); err != nil {
+		p.confirm(frame.ID, ErrConnectionLost)
+	}
+
+	return confirmation.Wait(ctx)
+}
+
+// Function to abort the transaction, so none of its messages is enqueued.
+func (t *Transaction) Abort() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.finished {
+		return ErrFinished
+	}
+	t.finished = true
+
+	// The broker aborts the transaction anyway if the connection is lost.
+	t.conn.WriteFrame(protocol.Frame{Type: protocol.AbortFrame, Transaction: t.ID})
+	return nil
+}
+
+// Function to send a request and wait for the reply of the server. It waits until ctx is done,
+// or for the request timeout if ctx has no deadline, and then fails with ErrTimeout.
+// It also fails with ErrTimeout when the broker tells the server did not answer in time.
+func (p *Producer) Request(ctx context.Context, body string) (Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.requestTimeout)
+		defer cancel()
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&p.counter, 1), 10)
+	replies := make(chan reply, 1)
+
+	p.mutex.Lock()
+	p.requests[id] = replies
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		delete(p.requests, id)
+		p.mutex.Unlock()
+	}()
+
+	confirmation := p.publish(protocol.Frame{Type: protocol.MessageFrame, CorrelationID: id, Body: body}, false)
+
+	select {
+	case <-confirmation.Done():
+		if err := confirmation.Err(); err != nil {
+			return Message{}, err
+		}
+	case <-ctx.Done():
+		return Message{}, requestError(ctx)
+	}
+
+	select {
+	case r := <-replies:
+		return r.message, r.err
+	case <-p.done:
+		return Message{}, ErrClosed
+	case <-ctx.Done():
+		return Message{}, requestError(ctx)
+	}
+}
+
+// Function to get the error of a request whose context is done.
+func requestError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+// Function to check whether the producer is closed.
+func (p *Producer) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Function to close the producer. Messages that wait in the batch are written first.
+// Messages that are not confirmed yet fail with ErrConnectionLost.
+func (p *Producer) Close() error {
+	p.closeOnce.Do(func() {
+		p.Flush()
+		close(p.done)
+
+		p.mutex.Lock()
+		reader, writer := p.reader, p.writer
+		p.mutex.Unlock()
+
+		reader.Close()
+		writer.Close()
+	})
+
+	p.wg.Wait()
+	p.failConfirms()
+
+	return nil
+}
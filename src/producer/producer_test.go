@@ -0,0 +1,530 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/protocol"
+)
+
+// A structure that represent a broker a test plays. Connections of producers arrive on
+// readers and writers after handshake.
+type fakeBroker struct {
+	readingPort string
+	writingPort string
+	readers     chan *protocol.Conn
+	writers     chan *protocol.Conn
+}
+
+// Function to listen on free ports for producers and accept them until the test ends.
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+
+	return newFakeBrokerOn(t, "")
+}
+
+// Function to listen on free ports of the given host only, an empty host listens on every address.
+func newFakeBrokerOn(t *testing.T, host string) *fakeBroker {
+	t.Helper()
+
+	f := &fakeBroker{readers: make(chan *protocol.Conn, 10), writers: make(chan *protocol.Conn, 10)}
+	f.readingPort = f.accept(t, host, f.readers)
+	f.writingPort = f.accept(t, host, f.writers)
+	return f
+}
+
+// Function to accept connections on a free port, do handshake and pass them to conns.
+func (f *fakeBroker) accept(t *testing.T, host string, conns chan *protocol.Conn) string {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := make(chan struct{})
+	t.Cleanup(func() {
+		listener.Close()
+		<-finished
+	})
+
+	go func() {
+		defer close(finished)
+
+		accepted := make([]*protocol.Conn, 0)
+		defer func() {
+			for _, conn := range accepted {
+				conn.Close()
+			}
+		}()
+
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn := protocol.NewConn(netConn)
+			if _, err := conn.AcceptHandshake(0, nil); err != nil {
+				conn.Close()
+				continue
+			}
+			accepted = append(accepted, conn)
+			conns <- conn
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// Function to read the next message frame a producer published.
+func readMessage(t *testing.T, conn *protocol.Conn) protocol.Frame {
+	t.Helper()
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			t.Error(err)
+			return frame
+		}
+		if frame.Type == protocol.MessageFrame {
+			return frame
+		}
+	}
+}
+
+// Function to connect a producer to a fake broker and get the connections the broker accepted.
+func connect(t *testing.T, f *fakeBroker, opts ...Option) (*Producer, *protocol.Conn, *protocol.Conn) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts = append([]Option{WithClientID("producer-test"), WithReconnectDelay(10 * time.Millisecond),
+		WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	p, err := Connect(ctx, f.readingPort, f.writingPort, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p, <-f.readers, <-f.writers
+}
+
+// Function to check that Publish returns the result the broker confirms a message with.
+func TestPublish(t *testing.T) {
+	f := newFakeBroker(t)
+	p, _, writer := connect(t, f)
+
+	if p.ClientID() != "producer-test" {
+		t.Errorf("client ID = %s, expected producer-test", p.ClientID())
+	}
+
+	tests := []struct {
+		name    string
+		confirm func(frame protocol.Frame) protocol.Frame
+		expects *RejectedError
+	}{
+		{"accepted", func(frame protocol.Frame) protocol.Frame {
+			return protocol.Frame{Type: protocol.AckFrame, ID: frame.ID}
+		}, nil},
+		{"rejected", func(frame protocol.Frame) protocol.Frame {
+			return protocol.Frame{Type: protocol.ErrorFrame, ID: frame.ID, Code: protocol.ErrorQueueFull, Reason: "queue is full"}
+		}, &RejectedError{Code: protocol.ErrorQueueFull, Reason: "queue is full"}},
+		{"rate limited", func(frame protocol.Frame) protocol.Frame {
+			return protocol.Frame{Type: protocol.ErrorFrame, ID: frame.ID, Code: protocol.ErrorRateLimited,
+				Reason: "publish rate limit exceeded", RetryAfter: 250}
+		}, &RejectedError{Code: protocol.ErrorRateLimited, Reason: "publish rate limit exceeded", RetryAfter: 250 * time.Millisecond}},
+		{"too large", func(frame protocol.Frame) protocol.Frame {
+			return protocol.Frame{Type: protocol.ErrorFrame, ID: frame.ID, Code: protocol.ErrorMessageTooLarge, Reason: "message is too large"}
+		}, &RejectedError{Code: protocol.ErrorMessageTooLarge, Reason: "message is too large"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			go func() {
+				frame := readMessage(t, writer)
+				if frame.Body != "hello" {
+					t.Errorf("body = %q, expected hello", frame.Body)
+				}
+				writer.WriteFrame(test.confirm(frame))
+			}()
+
+			err := p.Publish(context.Background(), "hello")
+
+			var rejected *RejectedError
+			if test.expects == nil && err != nil {
+				t.Errorf("err = %v, expected message to be accepted", err)
+			}
+			if test.expects != nil && (!errors.As(err, &rejected) || rejected.Code != test.expects.Code ||
+				rejected.Reason != test.expects.Reason || rejected.RetryAfter != test.expects.RetryAfter) {
+				t.Errorf("err = %v, expected %v", err, test.expects)
+			}
+			if test.expects != nil && rejected != nil && rejected.Retryable() != (test.expects.Code != protocol.ErrorMessageTooLarge) {
+				t.Errorf("rejection with code %s is retryable: %v", rejected.Code, rejected.Retryable())
+			}
+		})
+	}
+}
+
+// Function to check that messages waiting for confirmation fail when the connection is lost,
+// and that the producer publishes again once it reconnects.
+func TestPublishConnectionLost(t *testing.T) {
+	f := newFakeBroker(t)
+	p, _, writer := connect(t, f)
+
+	confirmation := p.PublishAsync("lost")
+	readMessage(t, writer)
+	writer.Close()
+
+	if err := confirmation.Wait(context.Background()); err != ErrConnectionLost {
+		t.Fatalf("err = %v, expected ErrConnectionLost", err)
+	}
+
+	writer = <-f.writers
+	go func() {
+		frame := readMessage(t, writer)
+		writer.WriteFrame(protocol.Frame{Type: protocol.AckFrame, ID: frame.ID})
+	}()
+
+	// The broker can accept the connection before the producer switches to it.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := p.Publish(ctx, "after reconnect")
+	for err == ErrConnectionLost && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		err = p.Publish(ctx, "after reconnect")
+	}
+	if err != nil {
+		t.Errorf("publish after reconnect err = %v", err)
+	}
+}
+
+// Function to check that a request gets the reply with its correlation ID and that other
+// messages go to the handler.
+func TestRequest(t *testing.T) {
+	f := newFakeBroker(t)
+	handled := make(chan Message, 1)
+	p, reader, writer := connect(t, f, WithHandler(func(message Message) { handled <- message }))
+
+	go func() {
+		frame := readMessage(t, writer)
+		writer.WriteFrame(protocol.Frame{Type: protocol.AckFrame, ID: frame.ID})
+
+		reader.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ID: "1", CorrelationID: "other", Body: "notice"})
+		reader.WriteFrame(protocol.Frame{Type: protocol.MessageFrame, ID: "2", CorrelationID: frame.CorrelationID,
+			Body: "reply to " + frame.Body})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := p.Request(ctx, "question")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Body != "reply to question" {
+		t.Errorf("reply = %q", reply.Body)
+	}
+	if message := <-handled; message.Body != "notice" {
+		t.Errorf("handler gets %q, expected notice", message.Body)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		if frame, err := reader.ReadFrame(); err != nil || frame.Type != protocol.AckFrame || frame.ID != id {
+			t.Errorf("frame = %+v, %v, expected ack of message %s", frame, err, id)
+		}
+	}
+}
+
+// Function to check that a request without a reply times out.
+func TestRequestTimeout(t *testing.T) {
+	f := newFakeBroker(t)
+	p, _, writer := connect(t, f, WithRequestTimeout(50*time.Millisecond))
+
+	go func() {
+		frame := readMessage(t, writer)
+		writer.WriteFrame(protocol.Frame{Type: protocol.AckFrame, ID: frame.ID})
+	}()
+
+	if _, err := p.Request(context.Background(), "question"); err != ErrTimeout {
+		t.Errorf("err = %v, expected ErrTimeout", err)
+	}
+}
+
+// Function to check that a request fails with the error the broker sends for it instead of a reply.
+func TestRequestFailed(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		reason  string
+		expects string
+	}{
+		{"server did not answer in time", protocol.ErrorTimeout, "server did not answer the request in time", ErrTimeout.Error()},
+		{"other error", "", "server is gone", "server is gone"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeBroker(t)
+			p, reader, writer := connect(t, f)
+
+			go func() {
+				frame := readMessage(t, writer)
+				writer.WriteFrame(protocol.Frame{Type: protocol.AckFrame, ID: frame.ID})
+				reader.WriteFrame(protocol.Frame{Type: protocol.ErrorFrame, CorrelationID: frame.CorrelationID, Code: test.code, Reason: test.reason})
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := p.Request(ctx, "question"); err == nil || err.Error() != test.expects {
+				t.Errorf("err = %v, expected %s", err, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that a closed producer does not publish and fails messages still waiting.
+func TestClose(t *testing.T) {
+	f := newFakeBroker(t)
+	p, _, writer := connect(t, f)
+
+	confirmation := p.PublishAsync("waiting")
+	readMessage(t, writer)
+
+	p.Close()
+
+	if err := confirmation.Err(); err != ErrConnectionLost {
+		t.Errorf("waiting message err = %v, expected ErrConnectionLost", err)
+	}
+	if err := p.Publish(context.Background(), "closed"); err != ErrClosed {
+		t.Errorf("err = %v, expected ErrClosed", err)
+	}
+}
+
+// Function to check that callbacks get the result of every message, in whatever order
+// the broker confirms them.
+func TestOnDone(t *testing.T) {
+	f := newFakeBroker(t)
+	p, _, writer := connect(t, f)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 3)
+	for _, body := range []string{"first", "second", "third"} {
+		body := body
+		p.PublishAsync(body).OnDone(func(err error) { results <- result{body, err} })
+	}
+
+	frames := []protocol.Frame{readMessage(t, writer), readMessage(t, writer), readMessage(t, writer)}
+	writer.WriteFrame(protocol.Frame{Type: protocol.AckFrame, ID: frames[2].ID})
+	writer.WriteFrame(protocol.Frame{Type: protocol.ErrorFrame, ID: frames[0].ID, Reason: "queue is full"})
+	writer.WriteFrame(protocol.Frame{Type: protocol.AckFrame, ID: frames[1].ID})
+
+	for i := 0; i < 3; i++ {
+		var r result
+		select {
+		case r = <-results:
+		case <-time.After(5 * time.Second):
+			t.Fatal("callback is not called")
+		}
+
+		var rejected *RejectedError
+		if r.body == "first" && (!errors.As(r.err, &rejected) || rejected.Reason != "queue is full") {
+			t.Errorf("first: err = %v, expected rejection", r.err)
+		}
+		if r.body != "first" && r.err != nil {
+			t.Errorf("%s: err = %v, expected message to be confirmed", r.body, r.err)
+		}
+	}
+}
+
+// Function to check that published messages are written as a batch when the batch is full
+// or its linger time has passed, and that a request does not wait behind the batch.
+func TestBatching(t *testing.T) {
+	f := newFakeBroker(t)
+	p, _, writer := connect(t, f, WithBatching(3, 50*time.Millisecond))
+
+	bodies := func(frame protocol.Frame) []string {
+		if frame.Type == protocol.MessageFrame {
+			return []string{frame.Body}
+		}
+		result := make([]string, 0)
+		for _, message := range frame.Messages {
+			result = append(result, message.Body)
+		}
+		return result
+	}
+
+	steps := []struct {
+		name    string
+		publish func()
+		expects []string // bodies of the next frame the broker reads
+	}{
+		{"full batch", func() {
+			p.PublishAsync("a")
+			p.PublishAsync("b")
+			p.PublishAsync("c")
+		}, []string{"a", "b", "c"}},
+		{"linger time", func() {
+			p.PublishAsync("d")
+			p.PublishAsync("e")
+		}, []string{"d", "e"}},
+		{"request", func() {
+			p.PublishAsync("f")
+			go p.Request(context.Background(), "question")
+		}, []string{"f"}},
+	}
+
+	for _, step := range steps {
+		started := time.Now()
+		step.publish()
+
+		frame, err := writer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bodies(frame); !reflect.DeepEqual(got, step.expects) {
+			t.Errorf("%s: frame has %v, expected %v", step.name, got, step.expects)
+		}
+		if step.name == "linger time" && time.Since(started) < 50*time.Millisecond {
+			t.Errorf("batch is written before its linger time")
+		}
+	}
+
+	if frame, err := writer.ReadFrame(); err != nil || frame.Body != "question" || frame.CorrelationID == "" {
+		t.Errorf("frame = %+v, %v, expected request", frame, err)
+	}
+}
+
+// Function to check that an idempotent producer numbers its messages and publishes the ones
+// that are not confirmed again, with the same numbers, after it reconnects.
+func TestIdempotence(t *testing.T) {
+	f := newFakeBroker(t)
+	p, _, writer := connect(t, f, WithIdempotence())
+
+	first := p.PublishAsync("first")
+	second := p.PublishAsync("second")
+	frames := []protocol.Frame{readMessage(t, writer), readMessage(t, writer)}
+	if frames[0].ProducerID == "" || frames[0].ProducerID != frames[1].ProducerID || frames[1].Sequence != frames[0].Sequence+1 {
+		t.Fatalf("frames are not numbered: %+v", frames)
+	}
+
+	writer.WriteFrame(protocol.Frame{Type: protocol.AckFrame, ID: frames[0].ID})
+	if err := first.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	writer = <-f.writers
+	resent := readMessage(t, writer)
+	if resent.Body != "second" || resent.ProducerID != frames[1].ProducerID || resent.Sequence != frames[1].Sequence {
+		t.Errorf("resent frame = %+v, expected %+v", resent, frames[1])
+	}
+	writer.WriteFrame(protocol.Frame{Type: protocol.AckFrame, ID: resent.ID})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := second.Wait(ctx); err != nil {
+		t.Errorf("message published again err = %v", err)
+	}
+}
+
+// Function to check the frames a transaction is written with, and that it cannot be used
+// after it is committed or aborted.
+func TestTransaction(t *testing.T) {
+	f := newFakeBroker(t)
+	p, _, writer := connect(t, f)
+
+	tx, err := p.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Publish("audit", "entry"); err != nil {
+		t.Fatal(err)
+	}
+
+	committed := make(chan error, 1)
+	go func() { committed <- tx.Commit(context.Background()) }()
+
+	expects := []protocol.Frame{
+		{Type: protocol.BeginFrame, Transaction: tx.ID},
+		{Type: protocol.MessageFrame, Transaction: tx.ID, Queue: "audit", Body: "entry"},
+		{Type: protocol.CommitFrame, Transaction: tx.ID},
+	}
+	for _, expected := range expects {
+		frame, err := writer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := frame.ID
+		if frame.Type == protocol.CommitFrame {
+			frame.ID = ""
+			writer.WriteFrame(protocol.Frame{Type: protocol.AckFrame, ID: id})
+		}
+		if !reflect.DeepEqual(frame, expected) {
+			t.Errorf("frame = %+v, expected %+v", frame, expected)
+		}
+	}
+
+	if err := <-committed; err != nil {
+		t.Errorf("commit err = %v", err)
+	}
+	if err := tx.Publish("", "late"); err != ErrFinished {
+		t.Errorf("publish after commit err = %v, expected ErrFinished", err)
+	}
+
+	aborted, err := p.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aborted.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	writer.ReadFrame()
+	if frame, err := writer.ReadFrame(); err != nil || frame.Type != protocol.AbortFrame || frame.Transaction != aborted.ID {
+		t.Errorf("frame = %+v, %v, expected abort", frame, err)
+	}
+	if err := aborted.Commit(context.Background()); err != ErrFinished {
+		t.Errorf("commit after abort err = %v, expected ErrFinished", err)
+	}
+}
+
+// Function to check that default client IDs name the process and differ between producers.
+func TestDefaultClientID(t *testing.T) {
+	pattern := regexp.MustCompile(`^producer-` + strconv.Itoa(os.Getpid()) + `-[0-9a-f]{8}$`)
+
+	first, second := defaultClientID(), defaultClientID()
+	if !pattern.MatchString(first) {
+		t.Errorf("client ID %s does not match %s", first, pattern)
+	}
+	if first == second {
+		t.Errorf("two producers get the same client ID %s", first)
+	}
+}
+
+// Function to check that a producer dials the ports on the host given with WithAddress,
+// and on the local machine without it.
+func TestAddress(t *testing.T) {
+	f := newFakeBrokerOn(t, "127.0.0.2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := Connect(ctx, f.readingPort, f.writingPort, WithLogger(log.New(io.Discard, "", 0))); err == nil {
+		t.Fatal("producer without address connects to a broker on another host")
+	}
+
+	p, _, writer := connect(t, f, WithAddress("127.0.0.2"))
+	p.PublishAsync("hello")
+	if frame := readMessage(t, writer); frame.Body != "hello" {
+		t.Errorf("broker received %+v, expected hello", frame)
+	}
+}
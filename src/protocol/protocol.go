@@ -0,0 +1,390 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Version of the protocol. Peers with a different version are rejected during handshake.
+const Version = 1
+
+// Frame types exchanged between the broker and its peers.
+const (
+	HelloFrame     = "hello"
+	WelcomeFrame   = "welcome"
+	ErrorFrame     = "error"
+	HeartbeatFrame = "heartbeat"
+	MessageFrame   = "message"
+	AckFrame       = "ack"
+	NackFrame      = "nack"      // delivery failed, the broker delivers the message again
+	BatchFrame     = "batch"     // message frames that are enqueued together
+	BeginFrame     = "begin"     // starts a transaction
+	CommitFrame    = "commit"    // applies messages and acknowledgments of a transaction at once
+	AbortFrame     = "abort"     // drops messages and acknowledgments of a transaction
+	CommandFrame   = "command"   // admin command, its name is in the body
+	ResultFrame    = "result"    // result of an admin command
+	SubscribeFrame = "subscribe" // a WebSocket stream asks for the messages of a queue
+)
+
+// Codes of error frames that reject a frame, so peers can tell why without parsing the reason.
+const (
+	ErrorQueueFull          = "queue_full"          // the queue has no room, publishing again later may succeed
+	ErrorMessageTooLarge    = "message_too_large"   // the body is larger than the broker accepts
+	ErrorUnauthorized       = "unauthorized"        // the user is not permitted to do it
+	ErrorUnknownQueue       = "unknown_queue"       // the queue does not exist
+	ErrorRateLimited        = "rate_limited"        // the publish limit is exceeded, retry after the hint
+	ErrorInvalidTransaction = "invalid_transaction" // the transaction does not exist or cannot be applied
+	ErrorTimeout            = "timeout"             // the server did not answer the request in time
+)
+
+// Roles a peer can take.
+const (
+	RoleProducer = "producer"
+	RoleConsumer = "consumer"
+	RoleAdmin    = "admin"
+)
+
+// Capabilities a peer can support. Only capabilities supported by both sides are enabled.
+const (
+	HeartbeatCapability   = "heartbeat"
+	AckCapability         = "ack"
+	ConfirmCapability     = "confirm"     // the broker confirms every published message that has an ID
+	NackCapability        = "nack"        // the broker delivers a message again when the receiver rejects it
+	BatchCapability       = "batch"       // the broker accepts batch frames
+	TransactionCapability = "transaction" // the broker supports transactions
+)
+
+// Capabilities supported by this implementation of the protocol.
+var Capabilities = []string{HeartbeatCapability, AckCapability, ConfirmCapability, NackCapability, BatchCapability, TransactionCapability}
+
+// Number of heartbeat intervals without any frame from the other side
+// after which the other side is declared dead.
+const MissedHeartbeats = 3
+
+// Error returned when the other side has not sent anything for too long.
+var ErrPeerDead = errors.New("peer missed heartbeats")
+
+// A structure that represent a frame. Frames are encoded as one JSON object per line.
+type Frame struct {
+	Type          string            `json:"type"`
+	ID            string            `json:"id,omitempty"`
+	ClientID      string            `json:"client_id,omitempty"`      // identity in handshake, client a message belongs to otherwise
+	CorrelationID string            `json:"correlation_id,omitempty"` // request a reply belongs to
+	Key           string            `json:"key,omitempty"`            // messages with the same key are handled in order
+	Queue         string            `json:"queue,omitempty"`          // queue a message of a transaction is published to instead of the queue of the sender
+	Transaction   string            `json:"transaction,omitempty"`    // transaction a message or acknowledgment belongs to
+	Headers       map[string]string `json:"headers,omitempty"`        // metadata of a message, passed on as it is
+	Body          string            `json:"body,omitempty"`
+	Attempt       int               `json:"attempt,omitempty"`     // delivery attempt of a message, starting at 1
+	ProducerID    string            `json:"producer_id,omitempty"` // producer that numbers its messages with sequence
+	Sequence      uint64            `json:"sequence,omitempty"`
+	DedupID       string            `json:"dedup_id,omitempty"` // ID the broker drops duplicates of a message by
+	Role          string            `json:"role,omitempty"`
+	Username      string            `json:"username,omitempty"`
+	Password      string            `json:"password,omitempty"`
+	Token         string            `json:"token,omitempty"`
+	Version       int               `json:"version,omitempty"`
+	Capabilities  []string          `json:"capabilities,omitempty"`
+	Heartbeat     int               `json:"heartbeat,omitempty"` // heartbeat interval in seconds
+	Reason        string            `json:"reason,omitempty"`
+	Code          string            `json:"code,omitempty"`        // why a frame is rejected, one of the error codes
+	RetryAfter    int               `json:"retry_after,omitempty"` // milliseconds to wait before publishing again after a rejection
+	Messages      []Frame           `json:"messages,omitempty"`    // message frames of a batch
+}
+
+// A structure that represent a connection that reads and writes frames.
+// It sends heartbeat frames when nothing has been written for a heartbeat interval
+// and declares the other side dead when nothing has been read for MissedHeartbeats intervals.
+type Conn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	mutex        sync.Mutex // guards writes and lastWrite
+	lastWrite    time.Time
+	heartbeat    time.Duration
+	hello        Frame // hello frame sent by the dialing side
+	capabilities []string
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// Function to create a frame connection on top of a network connection.
+// Heartbeats are disabled until handshake is done.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, reader: bufio.NewReader(conn), lastWrite: time.Now(), done: make(chan struct{})}
+}
+
+// Function to negotiate heartbeat interval. The lower non-zero interval wins.
+// Zero means heartbeats are disabled, so it is only chosen when both sides disable them.
+func NegotiateHeartbeat(local, remote time.Duration) time.Duration {
+	if local == 0 || (remote != 0 && remote < local) {
+		return remote
+	}
+	return local
+}
+
+// Function to convert a heartbeat interval to the whole seconds frames carry. Intervals that are
+// not whole seconds are rounded up, so a short interval is not sent as zero, which disables heartbeats.
+func heartbeatSeconds(heartbeat time.Duration) int {
+	return int((heartbeat + time.Second - 1) / time.Second)
+}
+
+// Function to get capabilities that are in both lists.
+func NegotiateCapabilities(local, remote []string) []string {
+	result := make([]string, 0)
+	for _, capability := range local {
+		for _, other := range remote {
+			if capability == other {
+				result = append(result, capability)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Function to do handshake from the dialing side. It sends a hello frame with identity, role,
+// capabilities and proposed heartbeat interval and waits for the welcome frame.
+// Version is always set to the version of this implementation.
+func (c *Conn) Handshake(hello Frame, heartbeat time.Duration) (Frame, error) {
+	hello.Type = HelloFrame
+	hello.Version = Version
+	hello.Heartbeat = heartbeatSeconds(heartbeat)
+
+	err := c.WriteFrame(hello)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	frame, err := c.ReadFrame()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	switch frame.Type {
+	case WelcomeFrame:
+	case ErrorFrame:
+		return frame, errors.New("handshake is rejected: " + frame.Reason)
+	default:
+		return frame, errors.New("expected welcome frame but received " + frame.Type)
+	}
+
+	hello.ClientID = frame.ClientID
+	hello.Password, hello.Token = "", ""
+	c.hello = hello
+	c.capabilities = frame.Capabilities
+	c.startHeartbeat(time.Duration(frame.Heartbeat) * time.Second)
+	return frame, nil
+}
+
+// Function to do handshake from the accepting side. It waits for the hello frame, rejects
+// peers with a different protocol version or that validate does not accept, and replies
+// with a welcome frame carrying negotiated heartbeat interval, capabilities and client ID.
+// Validate can change the hello frame, for example to replace the client ID the peer declared.
+func (c *Conn) AcceptHandshake(heartbeat time.Duration, validate func(hello *Frame) error) (Frame, error) {
+	hello, err := c.ReadFrame()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	if hello.Type != HelloFrame {
+		err = errors.New("expected hello frame but received " + hello.Type)
+	} else if hello.Version != Version {
+		err = fmt.Errorf("protocol version %d is not supported, broker speaks version %d", hello.Version, Version)
+	} else if validate != nil {
+		err = validate(&hello)
+	}
+
+	if err != nil {
+		c.WriteFrame(Frame{Type: ErrorFrame, Reason: err.Error()})
+		return hello, err
+	}
+
+	// Both sides use the interval in whole seconds the welcome frame carries.
+	seconds := heartbeatSeconds(NegotiateHeartbeat(heartbeat, time.Duration(hello.Heartbeat)*time.Second))
+	negotiated := time.Duration(seconds) * time.Second
+	capabilities := NegotiateCapabilities(Capabilities, hello.Capabilities)
+
+	err = c.WriteFrame(Frame{Type: WelcomeFrame, ClientID: hello.ClientID, Version: Version,
+		Capabilities: capabilities, Heartbeat: seconds})
+	if err != nil {
+		return hello, err
+	}
+
+	hello.Password, hello.Token = "", ""
+	c.hello = hello
+	c.capabilities = capabilities
+	c.startHeartbeat(negotiated)
+	return hello, nil
+}
+
+// Function to start sending heartbeat frames whenever the connection is idle.
+func (c *Conn) startHeartbeat(heartbeat time.Duration) {
+	c.heartbeat = heartbeat
+	if heartbeat == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(heartbeat / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				c.mutex.Lock()
+				idle := time.Since(c.lastWrite) >= heartbeat/2
+				c.mutex.Unlock()
+
+				if idle && c.WriteFrame(Frame{Type: HeartbeatFrame}) != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Function to get negotiated heartbeat interval.
+func (c *Conn) Heartbeat() time.Duration {
+	return c.heartbeat
+}
+
+// Function to get client ID of the dialing side.
+func (c *Conn) ClientID() string {
+	return c.hello.ClientID
+}
+
+// Function to get user name of the dialing side. On the accepting side it is
+// the authenticated user after validate has checked the credentials.
+func (c *Conn) Username() string {
+	return c.hello.Username
+}
+
+// Function to get role of the dialing side.
+func (c *Conn) Role() string {
+	return c.hello.Role
+}
+
+// Function to check whether both sides support a capability.
+func (c *Conn) HasCapability(capability string) bool {
+	for _, other := range c.capabilities {
+		if other == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to write a frame to the connection.
+func (c *Conn) WriteFrame(frame Frame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.heartbeat > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(MissedHeartbeats * c.heartbeat))
+	}
+
+	_, err = c.conn.Write(append(data, '\n'))
+	if err != nil {
+		return c.translateError(err)
+	}
+
+	c.lastWrite = time.Now()
+	return nil
+}
+
+// Function to read a frame from the connection. Heartbeat frames only prove
+// that the other side is alive so they are skipped.
+func (c *Conn) ReadFrame() (Frame, error) {
+	for {
+		if c.heartbeat > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(MissedHeartbeats * c.heartbeat))
+		}
+
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			return Frame{}, c.translateError(err)
+		}
+
+		var frame Frame
+		err = json.Unmarshal(line, &frame)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		if frame.Type != HeartbeatFrame {
+			return frame, nil
+		}
+	}
+}
+
+// Function to acknowledge a message frame with given ID.
+func (c *Conn) Ack(id string) error {
+	return c.WriteFrame(Frame{Type: AckFrame, ID: id})
+}
+
+// Function to reject a message frame with given ID so it is delivered again.
+func (c *Conn) Nack(id, reason string) error {
+	return c.WriteFrame(Frame{Type: NackFrame, ID: id, Reason: reason})
+}
+
+// Function to watch a connection that is only written to. It reads frames until
+// the other side closes the connection or is declared dead, then closes the connection.
+// Every frame read is passed to handle unless handle is nil.
+func (c *Conn) Watch(handle func(frame Frame)) error {
+	for {
+		frame, err := c.ReadFrame()
+		if err != nil {
+			c.Close()
+			return err
+		}
+
+		if handle != nil {
+			handle(frame)
+		}
+	}
+}
+
+// Function to convert a timeout caused by missed heartbeats to ErrPeerDead.
+func (c *Conn) translateError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && c.heartbeat > 0 {
+		return ErrPeerDead
+	}
+	return err
+}
+
+// Function to get underlying network connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// Function to get address of the other side.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Function to get local address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Function to close the connection and stop sending heartbeats.
+func (c *Conn) Close() error {
+	err := errors.New("connection is already closed")
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,312 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Function to check that the lower interval wins and that zero only wins when both sides disable heartbeats.
+func TestNegotiateHeartbeat(t *testing.T) {
+	tests := []struct {
+		local, remote, expects time.Duration
+	}{
+		{10 * time.Second, 30 * time.Second, 10 * time.Second},
+		{30 * time.Second, 10 * time.Second, 10 * time.Second},
+		{10 * time.Second, 10 * time.Second, 10 * time.Second},
+		{0, 10 * time.Second, 10 * time.Second},
+		{10 * time.Second, 0, 10 * time.Second},
+		{0, 0, 0},
+	}
+
+	for _, test := range tests {
+		if negotiated := NegotiateHeartbeat(test.local, test.remote); negotiated != test.expects {
+			t.Errorf("NegotiateHeartbeat(%v, %v) = %v, expected %v", test.local, test.remote, negotiated, test.expects)
+		}
+	}
+}
+
+// Function to create two frame connections that are connected to each other.
+func pipe() (*Conn, *Conn) {
+	first, second := net.Pipe()
+	return NewConn(first), NewConn(second)
+}
+
+// Function to check that only capabilities in both lists are enabled, in the order of the local list.
+func TestNegotiateCapabilities(t *testing.T) {
+	tests := []struct {
+		local, remote, expects []string
+	}{
+		{[]string{"heartbeat", "ack"}, []string{"ack", "heartbeat"}, []string{"heartbeat", "ack"}},
+		{[]string{"heartbeat", "ack"}, []string{"ack", "compression"}, []string{"ack"}},
+		{[]string{"heartbeat"}, nil, []string{}},
+		{nil, []string{"ack"}, []string{}},
+	}
+
+	for _, test := range tests {
+		if capabilities := NegotiateCapabilities(test.local, test.remote); !reflect.DeepEqual(capabilities, test.expects) {
+			t.Errorf("NegotiateCapabilities(%v, %v) = %v, expected %v", test.local, test.remote, capabilities, test.expects)
+		}
+	}
+}
+
+// Function to check that both sides of a connection agree on heartbeat interval and capabilities
+// and that the accepting side learns the identity of the dialing side.
+func TestHandshake(t *testing.T) {
+	dialer, acceptor := pipe()
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	accepted := make(chan Frame, 1)
+	go func() {
+		hello, err := acceptor.AcceptHandshake(5*time.Second, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- hello
+	}()
+
+	welcome, err := dialer.Handshake(Frame{ClientID: "client-0", Role: RoleProducer, Capabilities: []string{AckCapability}},
+		20*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := <-accepted
+
+	if welcome.Type != WelcomeFrame || welcome.Version != Version || welcome.Heartbeat != 5 {
+		t.Errorf("welcome = %+v", welcome)
+	}
+	if hello.Version != Version || hello.Heartbeat != 20 {
+		t.Errorf("hello = %+v", hello)
+	}
+	if acceptor.ClientID() != "client-0" || acceptor.Role() != RoleProducer {
+		t.Errorf("accepting side sees client %q with role %q", acceptor.ClientID(), acceptor.Role())
+	}
+	if dialer.Heartbeat() != 5*time.Second || acceptor.Heartbeat() != 5*time.Second {
+		t.Errorf("connections keep %v and %v", dialer.Heartbeat(), acceptor.Heartbeat())
+	}
+	for _, c := range []*Conn{dialer, acceptor} {
+		if !c.HasCapability(AckCapability) || c.HasCapability(HeartbeatCapability) {
+			t.Errorf("negotiated capabilities are %v, expected only ack", c.capabilities)
+		}
+	}
+}
+
+// Function to check that intervals that are not whole seconds are rounded up on both sides of a handshake,
+// instead of being sent as zero, which disables heartbeats.
+func TestHandshakeSubSecondHeartbeat(t *testing.T) {
+	tests := []struct {
+		name               string
+		accepting, dialing time.Duration
+		hello, welcome     int
+	}{
+		{"dialing side", 0, 500 * time.Millisecond, 1, 1},
+		{"accepting side", 200 * time.Millisecond, 0, 0, 1},
+		{"fraction of a second", 0, 1500 * time.Millisecond, 2, 2},
+		{"lower of both", 300 * time.Millisecond, 5 * time.Second, 5, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer, acceptor := pipe()
+			defer dialer.Close()
+			defer acceptor.Close()
+
+			accepted := make(chan Frame, 1)
+			go func() {
+				hello, _ := acceptor.AcceptHandshake(test.accepting, nil)
+				accepted <- hello
+			}()
+
+			welcome, err := dialer.Handshake(Frame{ClientID: "client-0", Role: RoleProducer}, test.dialing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hello := <-accepted
+
+			if hello.Heartbeat != test.hello || welcome.Heartbeat != test.welcome {
+				t.Errorf("hello carries %d and welcome %d seconds, expected %d and %d",
+					hello.Heartbeat, welcome.Heartbeat, test.hello, test.welcome)
+			}
+			expects := time.Duration(test.welcome) * time.Second
+			if dialer.Heartbeat() != expects || acceptor.Heartbeat() != expects {
+				t.Errorf("connections keep %v and %v, expected %v", dialer.Heartbeat(), acceptor.Heartbeat(), expects)
+			}
+		})
+	}
+}
+
+// Function to check that the client ID validate replaces the declared one with is used by both sides.
+func TestHandshakeReplacedClientID(t *testing.T) {
+	dialer, acceptor := pipe()
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	accepted := make(chan struct{})
+	go func() {
+		acceptor.AcceptHandshake(time.Second, func(hello *Frame) error {
+			hello.ClientID = "worker-01"
+			return nil
+		})
+		close(accepted)
+	}()
+
+	welcome, err := dialer.Handshake(Frame{ClientID: "client-0", Role: RoleConsumer}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if welcome.ClientID != "worker-01" || dialer.ClientID() != "worker-01" {
+		t.Errorf("dialing side has client ID %q, welcome %q, expected worker-01", dialer.ClientID(), welcome.ClientID)
+	}
+	<-accepted
+	if acceptor.ClientID() != "worker-01" {
+		t.Errorf("accepting side has client ID %q, expected worker-01", acceptor.ClientID())
+	}
+}
+
+// Function to check that the accepting side rejects unexpected frames, other versions and peers
+// that validate does not accept, and that the dialing side learns the reason.
+func TestAcceptHandshakeRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		hello    Frame
+		validate func(hello *Frame) error
+		reason   string
+	}{
+		{"not a hello frame", Frame{Type: MessageFrame, ID: "1"}, nil, "expected hello frame but received message"},
+		{"other version", Frame{Type: HelloFrame, Version: Version + 1}, nil, "protocol version 2 is not supported"},
+		{"not validated", Frame{Type: HelloFrame, Version: Version, ClientID: "client-0"},
+			func(hello *Frame) error { return errors.New("client " + hello.ClientID + " is already connected") },
+			"client client-0 is already connected"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer, acceptor := pipe()
+			defer dialer.Close()
+			defer acceptor.Close()
+
+			go dialer.WriteFrame(test.hello)
+
+			result := make(chan error, 1)
+			go func() {
+				_, err := acceptor.AcceptHandshake(time.Second, test.validate)
+				result <- err
+			}()
+
+			frame, err := dialer.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.Type != ErrorFrame || !strings.HasPrefix(frame.Reason, test.reason) {
+				t.Errorf("reply = %+v, expected error %q", frame, test.reason)
+			}
+			if err := <-result; err == nil {
+				t.Error("handshake is accepted")
+			}
+			if acceptor.Heartbeat() != 0 {
+				t.Error("heartbeats are started for a rejected peer")
+			}
+		})
+	}
+}
+
+// Function to check that the dialing side fails with the reason the accepting side gives.
+func TestHandshakeRejected(t *testing.T) {
+	dialer, acceptor := pipe()
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	go acceptor.AcceptHandshake(time.Second, func(hello *Frame) error { return errors.New("role is not allowed") })
+
+	_, err := dialer.Handshake(Frame{ClientID: "client-0", Role: "stranger"}, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "role is not allowed") {
+		t.Errorf("err = %v, expected the reason of the broker", err)
+	}
+}
+
+// Function to check that heartbeat frames are skipped when reading.
+func TestReadFrameSkipsHeartbeats(t *testing.T) {
+	writer, reader := pipe()
+	defer writer.Close()
+	defer reader.Close()
+
+	go func() {
+		writer.WriteFrame(Frame{Type: HeartbeatFrame})
+		writer.WriteFrame(Frame{Type: HeartbeatFrame})
+		writer.WriteFrame(Frame{Type: MessageFrame, ID: "7", Body: "hello"})
+	}()
+
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != MessageFrame || frame.ID != "7" || frame.Body != "hello" {
+		t.Errorf("frame = %+v, expected message 7", frame)
+	}
+}
+
+// Function to check that a side that sends nothing for MissedHeartbeats intervals is declared dead,
+// and that one that sends heartbeats is not.
+func TestPeerDead(t *testing.T) {
+	silent, reader := pipe()
+	defer silent.Close()
+	defer reader.Close()
+
+	reader.heartbeat = 20 * time.Millisecond
+	start := time.Now()
+	if _, err := reader.ReadFrame(); err != ErrPeerDead {
+		t.Fatalf("err = %v, expected ErrPeerDead", err)
+	}
+	if elapsed := time.Since(start); elapsed < MissedHeartbeats*reader.heartbeat {
+		t.Errorf("peer is declared dead after %v", elapsed)
+	}
+
+	alive, watcher := pipe()
+	defer alive.Close()
+	defer watcher.Close()
+
+	alive.startHeartbeat(20 * time.Millisecond)
+	watcher.heartbeat = 20 * time.Millisecond
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		alive.WriteFrame(Frame{Type: MessageFrame, ID: "1"})
+	}()
+
+	if frame, err := watcher.ReadFrame(); err != nil || frame.ID != "1" {
+		t.Errorf("frame = %+v, %v, expected message 1 after heartbeats", frame, err)
+	}
+}
+
+// Function to check that neither side keeps the password or token after handshake.
+func TestHandshakeForgetsCredentials(t *testing.T) {
+	dialer, acceptor := pipe()
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	accepted := make(chan struct{})
+	go func() {
+		acceptor.AcceptHandshake(time.Second, func(hello *Frame) error {
+			if hello.Password != "secret" || hello.Token != "token" {
+				t.Errorf("validate gets password %q and token %q", hello.Password, hello.Token)
+			}
+			return nil
+		})
+		close(accepted)
+	}()
+
+	if _, err := dialer.Handshake(Frame{ClientID: "client-0", Username: "alice", Password: "secret", Token: "token"},
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+
+	for _, c := range []*Conn{dialer, acceptor} {
+		if c.Username() != "alice" || c.hello.Password != "" || c.hello.Token != "" {
+			t.Errorf("connection keeps %+v", c.hello)
+		}
+	}
+}
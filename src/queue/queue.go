@@ -2,76 +2,275 @@ package queue
 
 import (
 	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
-// A structure that represent a queue.
+// A structure that represent a message stored in a queue.
+type Message struct {
+	ClientID      string            // client the message belongs to, used to route replies
+	CorrelationID string            // request a reply belongs to, kept so the reply can be matched by the client
+	Key           string            // messages with the same key are delivered in order, one at a time
+	Headers       map[string]string // metadata the broker passes on without looking at it
+	Body          string
+	Deliveries    int // number of times the message has been delivered to a receiver that acknowledges
+}
+
+// An error returned when a queue has no room for the items to add.
+type FullError struct {
+	Queue string
+}
+
+// Function to describe a full queue.
+func (e *FullError) Error() string {
+	return "queue " + e.Queue + " is full"
+}
+
+// Number of queues created so far, used to give every queue a sequence number.
+var created uint64
+
+// A structure that represent a queue. It is safe to use from multiple goroutines.
 type Queue struct {
+	name              string
+	sequence          uint64 // order queues are locked in, unique even when a name is used again
+	mutex             sync.Mutex
 	front, rear, size int
 	capacity          int
-	array             []string // circular array
+	array             []Message // circular array, it can be longer than capacity after capacity is reduced
 }
 
-// Function to create a queue of given capacity.
+// Function to create a queue of given name and capacity.
 // It initializes size of queue as 0.
-func CreateQueue(capacity int) *Queue {
-	array := make([]string, capacity)
-	q := Queue{front: 0, rear: capacity - 1, size: 0, capacity: capacity, array: array}
+func CreateQueue(name string, capacity int) *Queue {
+	array := make([]Message, capacity)
+	q := Queue{name: name, sequence: atomic.AddUint64(&created, 1), front: 0, rear: capacity - 1, size: 0, capacity: capacity, array: array}
 	return &q
 }
 
+// Function to get name of queue.
+func (q *Queue) GetName() string {
+	return q.name
+}
+
+// Function to change capacity of queue. Messages in the queue are kept in order, even
+// if there are more of them than the new capacity. Then queue stays full until enough
+// messages are dequeued.
+func (q *Queue) SetCapacity(capacity int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	length := capacity
+	if q.size > length {
+		length = q.size
+	}
+
+	array := make([]Message, length)
+	for i := 0; i < q.size; i++ {
+		array[i] = q.array[(q.front+i)%len(q.array)]
+	}
+
+	q.array = array
+	q.capacity = capacity
+	q.front = 0
+	q.rear = q.size - 1
+	if q.rear < 0 {
+		q.rear = length - 1
+	}
+}
+
+// Function to get capacity of queue.
+func (q *Queue) GetCapacity() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.capacity
+}
+
 // Function to check if queue is full.
 // Queue is full when size becomes equal to the capacity.
 func (q *Queue) IsFull() bool {
-	return (q.size == q.capacity)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.isFull()
+}
+
+// Function to check if queue is full without locking.
+func (q *Queue) isFull() bool {
+	return (q.size >= q.capacity)
 }
 
 // Function to check if queue is empty.
 // Queue is empty when size is 0.
 func (q *Queue) IsEmpty() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
 	return (q.size == 0)
 }
 
 // Function to add an item to the queue.
 // It changes rear and size.
-func (q *Queue) Enqueue(item string) error {
-	if q.IsFull() {
-		return errors.New("queue is full")
+func (q *Queue) Enqueue(item Message) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.isFull() {
+		return &FullError{Queue: q.name}
 	}
-	q.rear = (q.rear + 1) % q.capacity
+	q.rear = (q.rear + 1) % len(q.array)
 	q.array[q.rear] = item
 	q.size = q.size + 1
 	return nil
 }
 
+// Function to add items to the queue at once. Either all items are added or,
+// if there is not enough room for all of them, none.
+func (q *Queue) EnqueueAll(items []Message) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.size+len(items) > q.capacity {
+		return &FullError{Queue: q.name}
+	}
+	q.enqueueAll(items)
+	return nil
+}
+
+// Function to add items to the queue without locking or checking capacity.
+func (q *Queue) enqueueAll(items []Message) {
+	for _, item := range items {
+		q.rear = (q.rear + 1) % len(q.array)
+		q.array[q.rear] = item
+		q.size = q.size + 1
+	}
+}
+
+// Function to add items to several queues at once. Either all items are added or, if any
+// of the queues has not enough room for its items, none. Queues are locked in order of their
+// sequence numbers, so two calls with the same queues cannot wait for each other, even when a
+// queue was deleted and another one was created with its name.
+func EnqueueEach(items map[*Queue][]Message) error {
+	queues := make([]*Queue, 0, len(items))
+	for q := range items {
+		queues = append(queues, q)
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].sequence < queues[j].sequence
+	})
+
+	for _, q := range queues {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+	}
+
+	for _, q := range queues {
+		if q.size+len(items[q]) > q.capacity {
+			return &FullError{Queue: q.name}
+		}
+	}
+	for _, q := range queues {
+		q.enqueueAll(items[q])
+	}
+	return nil
+}
+
 // Function to remove an item from queue.
 // It changes front and size.
-func (q *Queue) Dequeue() (string, error) {
-	if q.IsEmpty() {
-		return "", errors.New("queue is empty")
+func (q *Queue) Dequeue() (Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.size == 0 {
+		return Message{}, errors.New("queue is empty")
 	}
 	item := q.array[q.front]
-	q.front = (q.front + 1) % q.capacity
+	q.front = (q.front + 1) % len(q.array)
 	q.size = q.size - 1
 	return item, nil
 }
 
+// Function to remove the first item of queue that accept returns true for.
+// Items before it stay in the queue in the same order.
+func (q *Queue) DequeueFunc(accept func(item Message) bool) (Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.size == 0 {
+		return Message{}, errors.New("queue is empty")
+	}
+
+	for i := 0; i < q.size; i++ {
+		index := (q.front + i) % len(q.array)
+		item := q.array[index]
+		if !accept(item) {
+			continue
+		}
+
+		// Items before the accepted one move one place towards its end.
+		for ; i > 0; i-- {
+			previous := (q.front + i - 1) % len(q.array)
+			q.array[(q.front+i)%len(q.array)] = q.array[previous]
+		}
+		q.front = (q.front + 1) % len(q.array)
+		q.size = q.size - 1
+		return item, nil
+	}
+
+	return Message{}, errors.New("no message can be dequeued")
+}
+
+// Function to put an item back to front of queue, so it is dequeued first.
+// It is added even if the queue is full, as the item was in the queue before.
+func (q *Queue) Requeue(item Message) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.size == len(q.array) {
+		array := make([]Message, len(q.array)+1)
+		for i := 0; i < q.size; i++ {
+			array[i] = q.array[(q.front+i)%len(q.array)]
+		}
+		q.array = array
+		q.front = 0
+		q.rear = q.size - 1
+		if q.rear < 0 {
+			q.rear = len(array) - 1
+		}
+	}
+
+	q.front = (q.front - 1 + len(q.array)) % len(q.array)
+	q.array[q.front] = item
+	q.size = q.size + 1
+}
+
 // Function to get front of queue.
-func (q *Queue) GetFront() (string, error) {
-	if q.IsEmpty() {
-		return "", errors.New("queue is empty")
+func (q *Queue) GetFront() (Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.size == 0 {
+		return Message{}, errors.New("queue is empty")
 	}
 	return q.array[q.front], nil
 }
 
 // Function to get rear of queue.
-func (q *Queue) GetRear() (string, error) {
-	if q.IsEmpty() {
-		return "", errors.New("queue is empty")
+func (q *Queue) GetRear() (Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.size == 0 {
+		return Message{}, errors.New("queue is empty")
 	}
 	return q.array[q.rear], nil
 }
 
 // Function to get size of queue.
 func (q *Queue) GetSize() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
 	return q.size
 }
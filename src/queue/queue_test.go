@@ -0,0 +1,287 @@
+package queue
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Function to create a queue whose items were added and removed so that they wrap around the end of its array.
+func wrappedQueue(t *testing.T, capacity int, bodies string) *Queue {
+	t.Helper()
+
+	q := CreateQueue("test", capacity)
+	for i := 0; i < capacity-1; i++ {
+		q.Enqueue(Message{})
+	}
+	for i := 0; i < capacity-1; i++ {
+		q.Dequeue()
+	}
+	for _, body := range bodies {
+		if err := q.Enqueue(Message{Body: string(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return q
+}
+
+// Function to get the bodies of the items of a queue in order, as one string.
+func bodies(q *Queue) string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var result strings.Builder
+	for i := 0; i < q.size; i++ {
+		result.WriteString(q.array[(q.front+i)%len(q.array)].Body)
+	}
+	return result.String()
+}
+
+// Function to check that changing capacity keeps messages in order, also when the new capacity
+// is below the number of messages.
+func TestSetCapacity(t *testing.T) {
+	q := CreateQueue("test", 4)
+	for _, body := range "abcd" {
+		q.Enqueue(Message{Body: string(body)})
+	}
+	q.Dequeue()
+	q.Dequeue()
+	q.Enqueue(Message{Body: "e"}) // wraps around the end of the array
+
+	q.SetCapacity(2)
+	if bodies(q) != "cde" || q.GetCapacity() != 2 {
+		t.Fatalf("queue has %q with capacity %d after shrinking, expected cde with capacity 2", bodies(q), q.GetCapacity())
+	}
+	if err := q.Enqueue(Message{Body: "f"}); err == nil || !q.IsFull() {
+		t.Error("queue above its capacity takes messages")
+	}
+
+	q.Dequeue()
+	q.Dequeue()
+	if err := q.Enqueue(Message{Body: "f"}); err != nil {
+		t.Errorf("queue below its capacity does not take messages: %v", err)
+	}
+
+	q.SetCapacity(5)
+	for _, body := range "ghi" {
+		if err := q.Enqueue(Message{Body: string(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bodies(q) != "efghi" || !q.IsFull() {
+		t.Errorf("queue has %q after growing, expected efghi", bodies(q))
+	}
+	if rear, _ := q.GetRear(); rear.Body != "i" {
+		t.Errorf("rear = %q, expected i", rear.Body)
+	}
+
+	empty := CreateQueue("empty", 3)
+	empty.SetCapacity(1)
+	if err := empty.Enqueue(Message{Body: "a"}); err != nil || bodies(empty) != "a" {
+		t.Errorf("empty queue has %q after changing capacity, %v", bodies(empty), err)
+	}
+}
+
+// Function to check that DequeueFunc takes the first accepted item and keeps the others in order.
+func TestDequeueFunc(t *testing.T) {
+	tests := []struct {
+		name    string
+		queue   func(t *testing.T) *Queue
+		accept  string // bodies that are accepted
+		expects string // body of the dequeued item, empty if none
+		rest    string
+	}{
+		{"first item", func(t *testing.T) *Queue { return wrappedQueue(t, 5, "abc") }, "abc", "a", "bc"},
+		{"skips items", func(t *testing.T) *Queue { return wrappedQueue(t, 5, "abcd") }, "c", "c", "abd"},
+		{"last item", func(t *testing.T) *Queue { return wrappedQueue(t, 5, "abcd") }, "d", "d", "abc"},
+		{"nothing accepted", func(t *testing.T) *Queue { return wrappedQueue(t, 5, "abc") }, "x", "", "abc"},
+		{"empty queue", func(t *testing.T) *Queue { return CreateQueue("test", 5) }, "abc", "", ""},
+		{"full queue", func(t *testing.T) *Queue { return wrappedQueue(t, 4, "abcd") }, "cd", "c", "abd"},
+		{"without wrapping", func(t *testing.T) *Queue {
+			q := CreateQueue("test", 5)
+			for _, body := range "abc" {
+				q.Enqueue(Message{Body: string(body)})
+			}
+			return q
+		}, "b", "b", "ac"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := test.queue(t)
+
+			item, err := q.DequeueFunc(func(item Message) bool {
+				return strings.Contains(test.accept, item.Body)
+			})
+			if test.expects == "" {
+				if err == nil {
+					t.Errorf("item %q is dequeued, expected none", item.Body)
+				}
+			} else if err != nil || item.Body != test.expects {
+				t.Errorf("item = %q, %v, expected %q", item.Body, err, test.expects)
+			}
+
+			if rest := bodies(q); rest != test.rest {
+				t.Errorf("queue has %q, expected %q", rest, test.rest)
+			}
+
+			// Items added afterwards go to the end.
+			q.Enqueue(Message{Body: "z"})
+			if rest := bodies(q); rest != test.rest+"z" {
+				t.Errorf("queue has %q after enqueue, expected %q", rest, test.rest+"z")
+			}
+		})
+	}
+}
+
+// Function to check that Requeue puts an item to the front, even when the queue is full.
+func TestRequeue(t *testing.T) {
+	tests := []struct {
+		name     string
+		queue    func(t *testing.T) *Queue
+		expects  string
+		capacity int
+	}{
+		{"empty queue", func(t *testing.T) *Queue { return CreateQueue("test", 3) }, "x", 3},
+		{"front at the start of the array", func(t *testing.T) *Queue {
+			q := CreateQueue("test", 3)
+			q.Enqueue(Message{Body: "a"})
+			return q
+		}, "xa", 3},
+		{"wrapped queue", func(t *testing.T) *Queue { return wrappedQueue(t, 4, "ab") }, "xab", 4},
+		{"full queue", func(t *testing.T) *Queue { return wrappedQueue(t, 3, "abc") }, "xabc", 3},
+		{"queue without room", func(t *testing.T) *Queue { return CreateQueue("test", 0) }, "x", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := test.queue(t)
+			q.Requeue(Message{Body: "x"})
+
+			if items := bodies(q); items != test.expects {
+				t.Errorf("queue has %q, expected %q", items, test.expects)
+			}
+			if capacity := q.GetCapacity(); capacity != test.capacity {
+				t.Errorf("capacity = %d, expected %d", capacity, test.capacity)
+			}
+			if front, _ := q.GetFront(); front.Body != "x" {
+				t.Errorf("front = %q, expected x", front.Body)
+			}
+			if rear, _ := q.GetRear(); rear.Body != test.expects[len(test.expects)-1:] {
+				t.Errorf("rear = %q, expected %q", rear.Body, test.expects[len(test.expects)-1:])
+			}
+		})
+	}
+}
+
+// Function to check that EnqueueAll adds all items when there is room for them and none otherwise.
+func TestEnqueueAll(t *testing.T) {
+	q := wrappedQueue(t, 5, "ab")
+
+	if err := q.EnqueueAll([]Message{{Body: "c"}, {Body: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.EnqueueAll([]Message{{Body: "e"}, {Body: "f"}}); err == nil {
+		t.Error("items above capacity are added")
+	}
+	if items := bodies(q); items != "abcd" {
+		t.Fatalf("queue has %q, expected abcd", items)
+	}
+
+	if err := q.EnqueueAll([]Message{{Body: "e"}}); err != nil || !q.IsFull() {
+		t.Errorf("queue is not full after adding the last item: %v", err)
+	}
+	if rear, _ := q.GetRear(); rear.Body != "e" {
+		t.Errorf("rear = %q, expected e", rear.Body)
+	}
+}
+
+// Function to check that EnqueueEach adds the items of all queues or, when one is full, of none.
+func TestEnqueueEach(t *testing.T) {
+	tests := []struct {
+		name       string
+		capacities []int
+		items      []string // bodies to add to every queue
+		expects    []string // bodies every queue has afterwards
+		full       string   // name of the queue that is full, empty if the items are added
+	}{
+		{"room for all", []int{3, 3}, []string{"ab", "c"}, []string{"pab", "pc"}, ""},
+		{"exactly full", []int{3, 2}, []string{"ab", "c"}, []string{"pab", "pc"}, ""},
+		{"one queue full", []int{3, 1}, []string{"ab", "c"}, []string{"p", "p"}, "q1"},
+		{"nothing to add", []int{1, 1}, []string{"", ""}, []string{"p", "p"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queues := make([]*Queue, len(test.capacities))
+			items := make(map[*Queue][]Message)
+			for i, capacity := range test.capacities {
+				queues[i] = CreateQueue("q"+string(rune('0'+i)), capacity)
+				queues[i].Enqueue(Message{Body: "p"})
+				for _, body := range test.items[i] {
+					items[queues[i]] = append(items[queues[i]], Message{Body: string(body)})
+				}
+			}
+
+			err := EnqueueEach(items)
+
+			if test.full == "" && err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if full, ok := err.(*FullError); test.full != "" && (!ok || full.Queue != test.full) {
+				t.Fatalf("err = %v, expected queue %s to be full", err, test.full)
+			}
+
+			got := make([]string, len(queues))
+			for i, q := range queues {
+				got[i] = bodies(q)
+			}
+			if !reflect.DeepEqual(got, test.expects) {
+				t.Errorf("queues have %q, expected %q", got, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that calls of EnqueueEach with the same queues do not wait for each other
+// forever, also when the queues have the same name.
+func TestEnqueueEachLockOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+	}{
+		{"different names", []string{"a", "b"}},
+		{"same name", []string{"jobs", "jobs"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, second := CreateQueue(test.names[0], 40000), CreateQueue(test.names[1], 40000)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 10000; j++ {
+						EnqueueEach(map[*Queue][]Message{first: {{}}, second: {{}}})
+					}
+				}()
+			}
+
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("EnqueueEach calls wait for each other")
+			}
+		})
+	}
+}
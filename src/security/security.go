@@ -0,0 +1,343 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Environment variables used to configure TLS.
+const (
+	TLSEnv           = "MQ_TLS"
+	TLSCertEnv       = "MQ_TLS_CERT"
+	TLSKeyEnv        = "MQ_TLS_KEY"
+	TLSCAEnv         = "MQ_TLS_CA"
+	TLSServerNameEnv = "MQ_TLS_SERVER_NAME"
+	TLSClientAuthEnv = "MQ_TLS_CLIENT_AUTH"
+)
+
+// Server name used to verify the broker certificate when none is configured and the broker is dialed without host.
+const defaultServerName = "localhost"
+
+// A structure that represent TLS settings. When TLS is not enabled connections are plain TCP.
+type TLSSettings struct {
+	Enabled    bool
+	CertFile   string // certificate of this side
+	KeyFile    string // private key of this side
+	CAFile     string // certificate authority used to verify the other side
+	ServerName string // name the broker certificate has to be valid for, the dialed host if empty
+	ClientAuth bool   // whether the broker requires client certificates signed by the CA
+}
+
+// Function to get TLS settings from environment variables.
+func TLSSettingsFromEnv() (TLSSettings, error) {
+	settings := TLSSettings{
+		CertFile:   os.Getenv(TLSCertEnv),
+		KeyFile:    os.Getenv(TLSKeyEnv),
+		CAFile:     os.Getenv(TLSCAEnv),
+		ServerName: os.Getenv(TLSServerNameEnv),
+	}
+
+	if value := os.Getenv(TLSEnv); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return settings, errors.New(TLSEnv + " should be true or false")
+		}
+		settings.Enabled = enabled
+	}
+
+	if value := os.Getenv(TLSClientAuthEnv); value != "" {
+		clientAuth, err := strconv.ParseBool(value)
+		if err != nil {
+			return settings, errors.New(TLSClientAuthEnv + " should be true or false")
+		}
+		settings.ClientAuth = clientAuth
+	}
+
+	return settings, nil
+}
+
+// Function to create TLS configuration for the broker listeners.
+// It returns nil when TLS is not enabled. Certificate and key are required.
+// When client authentication is on, clients need a certificate signed by the CA.
+func (s TLSSettings) ServerConfig() (*tls.Config, error) {
+	if !s.Enabled {
+		if s.ClientAuth {
+			return nil, errors.New(TLSClientAuthEnv + " requires " + TLSEnv + " to be true")
+		}
+		return nil, nil
+	}
+
+	if s.CertFile == "" || s.KeyFile == "" {
+		return nil, errors.New("TLS is enabled but " + TLSCertEnv + " or " + TLSKeyEnv + " is missing")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+
+	if s.ClientAuth {
+		if s.CAFile == "" {
+			return nil, errors.New(TLSClientAuthEnv + " is enabled but " + TLSCAEnv + " is missing")
+		}
+
+		pool, err := loadCertPool(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// Function to get identity in the certificate of this side, that is its subject common name.
+// It returns an empty identity when TLS is not enabled or there is no certificate.
+func (s TLSSettings) Identity() (string, error) {
+	if !s.Enabled || s.CertFile == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(s.CertFile)
+	if err != nil {
+		return "", err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", errors.New("no certificate found in " + s.CertFile)
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return certificate.Subject.CommonName, nil
+}
+
+// Function to get identity of the other side of a connection from its verified certificate.
+// It returns false if the connection is not TLS or the other side has not sent a certificate.
+func PeerIdentity(conn net.Conn) (string, bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+
+	return StateIdentity(tlsConn.ConnectionState())
+}
+
+// Function to get the identity of a peer from the state of its TLS connection, like PeerIdentity.
+func StateIdentity(state tls.ConnectionState) (string, bool) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// Function to create TLS configuration for connections dialed to the broker.
+// It returns nil when TLS is not enabled. Without a CA file the system roots are used.
+func (s TLSSettings) ClientConfig() (*tls.Config, error) {
+	if !s.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: s.ServerName, MinVersion: tls.VersionTLS12}
+
+	if s.CAFile != "" {
+		pool, err := loadCertPool(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if s.CertFile != "" && s.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// Function to load certificates of a CA file into a pool.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found in " + file)
+	}
+
+	return pool, nil
+}
+
+// Function to listen on a port. If config is not nil, connections use TLS.
+func Listen(port string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return net.Listen("tcp", ":"+port)
+	}
+	return tls.Listen("tcp", ":"+port, config)
+}
+
+// Function to dial an address given as host:port, an empty host is the local machine.
+// If config is not nil, connection uses TLS. The broker certificate has to be valid for the host,
+// or for localhost when the host is empty, unless config names another server.
+func Dial(address string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		return net.Dial("tcp", address)
+	}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			host = defaultServerName
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	return tls.Dial("tcp", address, config)
+}
+
+// A structure that represent a certificate with its private key.
+type keyPair struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// Function to generate a self-signed CA for local development and write it to
+// ca.pem and ca-key.pem in given directory.
+func GenerateCA(directory string) error {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "message queue test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	_, err := generate(directory, "ca", template, nil)
+	return err
+}
+
+// Function to generate a certificate signed by the CA in given directory and write it
+// to <name>.pem and <name>-key.pem. The certificate is valid for localhost, so it can be
+// used by the broker, and it can also be used by clients.
+func GenerateCertificate(directory, name string) error {
+	ca, err := loadKeyPair(directory, "ca")
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{defaultServerName},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	_, err = generate(directory, name, template, ca)
+	return err
+}
+
+// Function to generate a key and a certificate from template, signed by parent or by itself
+// when parent is nil, and write both in PEM format.
+func generate(directory, name string, template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().AddDate(1, 0, 0)
+
+	signer := &keyPair{certificate: template, key: key}
+	if parent != nil {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.certificate, &key.PublicKey, signer.key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writePEM(filepath.Join(directory, name+".pem"), "CERTIFICATE", der, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writePEM(filepath.Join(directory, name+"-key.pem"), "EC PRIVATE KEY", keyDer, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyPair{certificate: certificate, key: key}, nil
+}
+
+// Function to load a certificate and its key written by generate.
+func loadKeyPair(directory, name string) (*keyPair, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(directory, name+".pem"), filepath.Join(directory, name+"-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New(name + " key is not an ECDSA key")
+	}
+
+	return &keyPair{certificate: certificate, key: key}, nil
+}
+
+// Function to write a PEM block to a file.
+func writePEM(file, blockType string, bytes []byte, mode os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes})
+	return os.WriteFile(file, data, mode)
+}
@@ -0,0 +1,259 @@
+package security
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// Function to check TLS settings read from environment variables.
+func TestTLSSettingsFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		expects TLSSettings
+		fails   bool
+	}{
+		{"nothing set", nil, TLSSettings{}, false},
+		{"enabled", map[string]string{TLSEnv: "true", TLSCertEnv: "cert.pem", TLSKeyEnv: "key.pem", TLSCAEnv: "ca.pem"},
+			TLSSettings{Enabled: true, CertFile: "cert.pem", KeyFile: "key.pem", CAFile: "ca.pem"}, false},
+		{"server name", map[string]string{TLSEnv: "1", TLSServerNameEnv: "broker.internal"},
+			TLSSettings{Enabled: true, ServerName: "broker.internal"}, false},
+		{"client authentication", map[string]string{TLSEnv: "true", TLSClientAuthEnv: "true"},
+			TLSSettings{Enabled: true, ClientAuth: true}, false},
+		{"not a boolean", map[string]string{TLSEnv: "yes"}, TLSSettings{}, true},
+		{"client authentication not a boolean", map[string]string{TLSClientAuthEnv: "required"}, TLSSettings{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{TLSEnv, TLSCertEnv, TLSKeyEnv, TLSCAEnv, TLSServerNameEnv, TLSClientAuthEnv} {
+				t.Setenv(name, test.env[name])
+			}
+
+			settings, err := TLSSettingsFromEnv()
+			if test.fails {
+				if err == nil {
+					t.Error("invalid value is accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if settings != test.expects {
+				t.Errorf("settings = %+v, expected %+v", settings, test.expects)
+			}
+		})
+	}
+}
+
+// Function to check that configurations are nil without TLS and that the broker needs a certificate.
+func TestConfigs(t *testing.T) {
+	if config, err := (TLSSettings{}).ServerConfig(); config != nil || err != nil {
+		t.Errorf("server config without TLS = %v, %v", config, err)
+	}
+	if config, err := (TLSSettings{}).ClientConfig(); config != nil || err != nil {
+		t.Errorf("client config without TLS = %v, %v", config, err)
+	}
+	if _, err := (TLSSettings{Enabled: true, CertFile: "cert.pem"}).ServerConfig(); err == nil {
+		t.Error("server config without key is accepted")
+	}
+	if _, err := (TLSSettings{ClientAuth: true}).ServerConfig(); err == nil {
+		t.Error("client authentication without TLS is accepted")
+	}
+	if _, err := (TLSSettings{Enabled: true, CertFile: "cert.pem", KeyFile: "key.pem", ClientAuth: true}).ServerConfig(); err == nil {
+		t.Error("client authentication without CA is accepted")
+	}
+	if _, err := (TLSSettings{Enabled: true, CAFile: filepath.Join(t.TempDir(), "ca.pem")}).ClientConfig(); err == nil {
+		t.Error("client config with a missing CA file is accepted")
+	}
+}
+
+// Function to generate a CA and a broker certificate in a temporary directory.
+func generateFiles(t *testing.T) string {
+	t.Helper()
+
+	directory := t.TempDir()
+	if err := GenerateCA(directory); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateCertificate(directory, "broker"); err != nil {
+		t.Fatal(err)
+	}
+	return directory
+}
+
+// Function to listen with TLS on a free port and echo one line back on every connection.
+func listenEcho(t *testing.T, settings TLSSettings) string {
+	t.Helper()
+
+	config, err := settings.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := Listen("0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil {
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// Function to check that a client trusting the generated CA talks to a broker with a generated
+// certificate, and that a client trusting another CA or expecting another name does not.
+func TestDial(t *testing.T) {
+	directory := generateFiles(t)
+	port := listenEcho(t, TLSSettings{Enabled: true, CertFile: filepath.Join(directory, "broker.pem"),
+		KeyFile: filepath.Join(directory, "broker-key.pem")})
+
+	other := generateFiles(t)
+
+	ca := filepath.Join(directory, "ca.pem")
+	tests := []struct {
+		name     string
+		address  string
+		settings TLSSettings
+		fails    bool
+	}{
+		{"trusted CA", ":" + port, TLSSettings{Enabled: true, CAFile: ca}, false},
+		{"other CA", ":" + port, TLSSettings{Enabled: true, CAFile: filepath.Join(other, "ca.pem")}, true},
+		{"host name", "localhost:" + port, TLSSettings{Enabled: true, CAFile: ca}, false},
+		{"host address", "127.0.0.1:" + port, TLSSettings{Enabled: true, CAFile: ca}, false},
+		{"server name overrides host", "127.0.0.1:" + port, TLSSettings{Enabled: true, CAFile: ca, ServerName: defaultServerName}, false},
+		{"other server name", "localhost:" + port, TLSSettings{Enabled: true, CAFile: ca, ServerName: "broker.internal"}, true},
+		{"no port", "localhost", TLSSettings{Enabled: true, CAFile: ca}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := test.settings.ClientConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := Dial(test.address, config)
+			if err == nil {
+				defer conn.Close()
+				_, err = conn.Write([]byte("ping\n"))
+			}
+			if err == nil {
+				var line string
+				line, err = bufio.NewReader(conn).ReadString('\n')
+				if err == nil && line != "ping\n" {
+					t.Errorf("echo = %q", line)
+				}
+			}
+
+			if (err != nil) != test.fails {
+				t.Errorf("err = %v, expected to fail: %v", err, test.fails)
+			}
+		})
+	}
+
+	config, _ := TLSSettings{Enabled: true, CAFile: ca}.ClientConfig()
+	if conn, err := Dial("localhost:"+port, config); err == nil {
+		conn.Close()
+	}
+	if config.ServerName != "" {
+		t.Errorf("dialing sets server name %q on the given configuration", config.ServerName)
+	}
+}
+
+// Function to check that a broker requiring client certificates rejects clients without one and
+// sees the common name of the certificate of the others.
+func TestClientAuth(t *testing.T) {
+	directory := generateFiles(t)
+	if err := GenerateCertificate(directory, "worker-01"); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := TLSSettings{Enabled: true, CertFile: filepath.Join(directory, "broker.pem"),
+		KeyFile: filepath.Join(directory, "broker-key.pem"), CAFile: filepath.Join(directory, "ca.pem"),
+		ClientAuth: true}.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := Listen("0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	identities := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					identities <- ""
+					return
+				}
+				identity, _ := PeerIdentity(conn)
+				identities <- identity
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		settings TLSSettings
+		expects  string
+	}{
+		{"with certificate", TLSSettings{Enabled: true, CAFile: filepath.Join(directory, "ca.pem"),
+			CertFile: filepath.Join(directory, "worker-01.pem"), KeyFile: filepath.Join(directory, "worker-01-key.pem")}, "worker-01"},
+		{"without certificate", TLSSettings{Enabled: true, CAFile: filepath.Join(directory, "ca.pem")}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := test.settings.Identity()
+			if err != nil || identity != test.expects {
+				t.Errorf("Identity = %q, %v, expected %q", identity, err, test.expects)
+			}
+
+			clientConfig, err := test.settings.ClientConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := Dial(":"+port, clientConfig)
+			if err == nil {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+
+			if identity := <-identities; identity != test.expects {
+				t.Errorf("broker sees identity %q, expected %q", identity, test.expects)
+			}
+		})
+	}
+
+	if _, ok := PeerIdentity(&net.TCPConn{}); ok {
+		t.Error("plain connection has an identity")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-systems-message-queue/src/consumer"
+)
+
+// Function to get environment variables that describe a message to the command handling it.
+// Headers are given as MQ_HEADER_<NAME> with the name in upper case and other characters than
+// letters and digits replaced by underscores.
+func messageEnv(message consumer.Message) []string {
+	env := append(os.Environ(),
+		"MQ_MESSAGE_ID="+message.ID,
+		"MQ_CLIENT_ID="+message.ClientID,
+		"MQ_CORRELATION_ID="+message.CorrelationID,
+		"MQ_KEY="+message.Key,
+		"MQ_ATTEMPT="+strconv.Itoa(message.Attempt))
+
+	for name, value := range message.Headers {
+		env = append(env, "MQ_HEADER_"+strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+				return r
+			default:
+				return '_'
+			}
+		}, name)+"="+value)
+	}
+	return env
+}
+
+// Function to handle a message with an external command. The body is written to the standard input
+// of the command. Exit code 0 acknowledges the message, and its standard output is sent as reply when
+// replies is true and the output is not empty. Any other exit code, or a command that runs longer than
+// the timeout, rejects the message so the broker delivers it again.
+func execute(c *consumer.Consumer, command []string, timeout time.Duration, replies bool) consumer.Handler {
+	return func(ctx context.Context, message consumer.Message) error {
+		fmt.Println("-> " + message.ClientID + ": " + message.Body)
+
+		runCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		// Output goes to a file, not a pipe, so a killed command does not wait for its children to close it.
+		stdout, err := os.CreateTemp("", "mq-exec-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(stdout.Name())
+		defer stdout.Close()
+
+		cmd := exec.CommandContext(runCtx, command[0], command[1:]...)
+		cmd.Stdin = strings.NewReader(message.Body)
+		cmd.Stdout = stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = messageEnv(message)
+
+		err = cmd.Run()
+		if runCtx.Err() == context.DeadlineExceeded {
+			return errors.New("command timed out after " + timeout.String())
+		}
+		if err != nil {
+			return errors.New("command failed: " + err.Error())
+		}
+
+		output, err := os.ReadFile(stdout.Name())
+		if err != nil {
+			return err
+		}
+		if !replies || len(output) == 0 {
+			return nil
+		}
+
+		body := strings.TrimRight(string(output), "\n")
+		err = reply(ctx, c, message, body)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(">> " + body)
+		return nil
+	}
+}
+
+// Function to handle exec mode. Every message is handled by running a command, by as many workers
+// as the concurrency option allows. Without a writing port, given as "-", replies are not sent.
+func handleExecuting(ctx context.Context, readingPort, writingPort string, arguments []string) {
+	flags := flag.NewFlagSet("exec", flag.ExitOnError)
+	name := flags.String("name", "", "client ID, the certificate subject or server-<pid> by default")
+	concurrency := flags.Int("concurrency", 1, "number of commands running at the same time")
+	timeout := flags.Duration("timeout", 30*time.Second, "time a command may run before the message is rejected")
+	maxDeliveries := flags.Int("max-deliveries", 0, "deliveries after which a failing message is dropped, 0 never drops it")
+	flags.Parse(arguments)
+
+	command := flags.Args()
+	if len(command) == 0 {
+		handleError(errors.New("error: please provide a command to run for every message"))
+	}
+	if *concurrency < 1 {
+		handleError(errors.New("error: concurrency should be at least 1"))
+	}
+	if *timeout <= 0 {
+		handleError(errors.New("error: timeout should be positive"))
+	}
+
+	identity, err := loadIdentity()
+	handleError(err)
+	if *name != "" && identity == "" {
+		serverID = *name
+	}
+
+	if writingPort == "-" {
+		writingPort = ""
+	}
+	brokerHost, readingPort, writingPort, err = splitPorts(readingPort, writingPort)
+	handleError(err)
+
+	c := createConsumer(ctx, readingPort, writingPort, *concurrency,
+		consumer.WithRetries(0, 0),
+		consumer.WithMaxDeliveries(*maxDeliveries))
+
+	run(ctx, c, execute(c, command, *timeout, writingPort != ""))
+}
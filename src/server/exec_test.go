@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-systems-message-queue/src/consumer"
+)
+
+// Function to check that a message is described to its command by environment variables.
+func TestMessageEnv(t *testing.T) {
+	env := messageEnv(consumer.Message{ID: "7", ClientID: "client-0", Key: "user-1", Attempt: 2,
+		Headers: map[string]string{"content-type": "json", "Trace.ID": "abc", "x1": "y"}})
+
+	expects := []string{"MQ_MESSAGE_ID=7", "MQ_CLIENT_ID=client-0", "MQ_CORRELATION_ID=", "MQ_KEY=user-1",
+		"MQ_ATTEMPT=2", "MQ_HEADER_CONTENT_TYPE=json", "MQ_HEADER_TRACE_ID=abc", "MQ_HEADER_X1=y"}
+	for _, variable := range expects {
+		found := false
+		for _, e := range env {
+			found = found || e == variable
+		}
+		if !found {
+			t.Errorf("environment has no %s", variable)
+		}
+	}
+}
+
+// Function to check which exit of a command acknowledges a message and which rejects it.
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		err    string
+	}{
+		{"success", "exit 0", ""},
+		{"body on standard input", `test "$(cat)" = "hello world"`, ""},
+		{"headers in environment", `test "$MQ_HEADER_SOURCE" = cli`, ""},
+		{"failure", "exit 3", "command failed: exit status 3"},
+		{"timeout", "exec sleep 5", "command timed out after 200ms"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handle := execute(nil, []string{"sh", "-c", test.script}, 200*time.Millisecond, false)
+			started := time.Now()
+
+			err := handle(context.Background(), consumer.Message{ClientID: "client-0",
+				Headers: map[string]string{"source": "cli"}, Body: "hello world"})
+
+			if test.err == "" && err != nil {
+				t.Errorf("error is %v, expected none", err)
+			}
+			if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+				t.Errorf("error is %v, expected %q", err, test.err)
+			}
+			if time.Since(started) > 2*time.Second {
+				t.Errorf("command is not stopped after its timeout")
+			}
+		})
+	}
+}
@@ -2,184 +2,245 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"distributed-systems-message-queue/src/auth"
+	"distributed-systems-message-queue/src/consumer"
+	"distributed-systems-message-queue/src/security"
+)
+
+const (
+	heartbeat_interval = 10 * time.Second
+	reconnect_delay    = 1 * time.Second
+	processing_time    = 3 * time.Second
+	async_workers      = 4 // number of requests handled at the same time in async mode
 )
 
+// Client ID the server uses in handshake. Both connections of the server share it.
+// A server with a certificate uses its certificate subject instead.
+var serverID = "server-" + strconv.Itoa(os.Getpid())
+
+// Host of the broker, given with the ports as host:port. It is the local machine when it is empty.
+var brokerHost string
+
+// TLS configuration of connections to broker. Connections use plain TCP when it is nil.
+var tlsConfig *tls.Config
+
+// Credentials sent to broker in handshake.
+var credentials = auth.CredentialsFromEnv()
+
+// Number of responses the server has sent.
+var messageNumber int64
+
 // Function to pring a text on standard output.
 func write(text string) {
-	fmt.Print(">> processing " + text)
+	fmt.Println(">> processing " + text)
 	// fmt.Fprintf(conn, "processing "+text)
 }
 
-// Function to handle server writing. It first creates a TCP client and establishes a connection.
-// It tryes to write message to broekr (TCP server).
-func handleWrite(port string, messages chan string) {
-	conn, _ := createTCPclient(port)
+// Function to create a consumer connected to broker. Writing port is empty when the server only reads.
+// Messages are handled by given number of workers. Given options are applied after the defaults.
+func createConsumer(ctx context.Context, readingPort, writingPort string, workers int, options ...consumer.Option) *consumer.Consumer {
+	options = append([]consumer.Option{
+		consumer.WithAddress(brokerHost),
+		consumer.WithClientID(serverID),
+		consumer.WithTLSConfig(tlsConfig),
+		consumer.WithPassword(credentials.Username, credentials.Password),
+		consumer.WithToken(credentials.Token),
+		consumer.WithHeartbeat(heartbeat_interval),
+		consumer.WithReconnectDelay(reconnect_delay),
+		consumer.WithConcurrency(workers),
+		consumer.WithErrorHandler(printError)}, options...)
+
+	c, err := consumer.Connect(ctx, readingPort, writingPort, options...)
 
-	messageNumber := 0
-	for {
-		// a select can be used to make Non-Blocking Channel Operations
-		receivedMessage := <-messages
-		message := "response " + fmt.Sprint(messageNumber) + " to " + receivedMessage
-		sendMessage(conn, message)
-		fmt.Print(">> " + message)
-		messageNumber++
-	}
-}
+	handleError(err)
 
-// Function to handle server reading. It first creates a TCP client and establishes a connection.
-// Then starts receiving messages from broekr (TCP server).
-func handleRead(port string, messages chan string) {
-	conn, _ := createTCPclient(port)
+	return c
+}
 
-	for {
-		message, _ := receiveMessage(conn)
-		messages <- message
-	}
+// Function to print an error of the consumer.
+func printError(err error) {
+	fmt.Println("-> error: " + err.Error())
 }
 
-// Function to handle network errors.
-func handleNetError(err error) {
-	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-		fmt.Println("read timeout:", err) // time out
-	} else {
-		fmt.Println("read error:", err) // some error else, do something else, for example create new conn
+// Function to handle a request. Processing takes a while, then a response is sent.
+// Responses carry client ID and correlation ID of the request so the broker can route them back
+// and the client can match them with its request.
+func respond(c *consumer.Consumer) consumer.Handler {
+	return func(ctx context.Context, request consumer.Message) error {
+		fmt.Println("-> " + request.ClientID + ": " + request.Body)
+
+		select {
+		case <-time.After(processing_time):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		message := "response " + fmt.Sprint(atomic.AddInt64(&messageNumber, 1)-1) + " to " + request.Body
+		err := reply(ctx, c, request, "server "+message)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(">> " + message)
+		return nil
 	}
 }
 
-// Function to receive a message from a server with given connection.
-func receiveMessage(conn net.Conn) (string, error) {
-	// set SetReadDeadline
-	err := conn.SetReadDeadline(time.Now().Add(50 * time.Second))
+// Function to send a response to a request. When the broker supports transactions, the response
+// and the acknowledgment of the request are committed together, so a request that is delivered
+// again has not been responded to yet.
+func reply(ctx context.Context, c *consumer.Consumer, request consumer.Message, body string) error {
+	tx, err := c.Begin()
+	if err == consumer.ErrNoTransactions {
+		return c.Reply(request, body)
+	}
 	if err != nil {
-		log.Println("ERROR:", "SetReadDeadline failed:", err)
-		// do something else, for example create new conn
+		return err
 	}
 
-	// recvBuf := make([]byte, 1024)
-	// _, err = conn.Read(recvBuf[:]) // recv data
-
-	message, err := bufio.NewReader(conn).ReadString('\n')
+	err = tx.Reply(request, body)
+	if err == nil {
+		err = tx.Ack(request)
+	}
 	if err != nil {
-		handleNetError(err)
-	} else {
-		fmt.Print("-> " + string(message))
+		tx.Abort()
+		return err
 	}
 
-	return message, err
+	return tx.Commit(ctx)
 }
 
-// Function to send a message to a server with given message and connection.
-func sendMessage(conn net.Conn, message string) {
-	time.Sleep(3 * time.Second)
-	fmt.Fprintf(conn, "server "+message+"\n")
+// Function to handle a message that needs no response.
+func process(ctx context.Context, message consumer.Message) error {
+	fmt.Println("-> " + message.ClientID + ": " + message.Body)
+	write(message.Body)
+	return nil
 }
 
-// Fucntion to create TCP client and establish connection.
-func createTCPclient(port string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", ":"+port)
+// Function to consume messages until the server is interrupted. Messages that are being
+// handled are finished before the server exits.
+func run(ctx context.Context, c *consumer.Consumer, handler consumer.Handler) {
+	err := c.Run(ctx, handler)
+	c.Close()
 
 	handleError(err)
-
-	return conn, err
 }
 
-// Function to handle massage passing asynchronously.
-func handleMessagePassingAsynchronously(readingPort, writingPort string) {
-	messages := make(chan string, 10)
-
-	go handleRead(readingPort, messages)
-
-	time.Sleep(1 * time.Second)
-
-	go handleWrite(writingPort, messages)
-
-	for {
-		time.Sleep(10 * time.Second)
-		fmt.Println("doing something ...")
+// Function to split an argument given as port or host:port into host and port.
+func splitAddress(argument string) (string, string, error) {
+	if !strings.Contains(argument, ":") {
+		return "", argument, nil
 	}
-}
-
-// Function to handle massage passing synchronously.
-func handleMessagePassingSynchronously(readingPort, writingPort string) {
-	fmt.Println(readingPort, writingPort)
 
-	serverReadConn, _ := createTCPclient(readingPort)
-	time.Sleep(1 * time.Second)
-	serverWriteConn, _ := createTCPclient(writingPort)
+	return net.SplitHostPort(argument)
+}
 
-	messageNumber := 0
-	for {
-		receivedMessage, _ := receiveMessage(serverReadConn)
+// Function to get host of the broker from ports given as port or host:port, and the ports without it.
+// Both ports have to be on the same host. An empty writing port, when the server only reads, is not checked.
+func splitPorts(readingAddress, writingAddress string) (string, string, string, error) {
+	host, readingPort, err := splitAddress(readingAddress)
+	if err != nil || writingAddress == "" {
+		return host, readingPort, "", err
+	}
 
-		message := "response " + fmt.Sprint(messageNumber) + "to " + receivedMessage
-		sendMessage(serverWriteConn, message)
-		fmt.Print(">> " + message)
-		messageNumber++
+	writingHost, writingPort, err := splitAddress(writingAddress)
+	if err != nil {
+		return "", "", "", err
+	}
+	if writingHost != host {
+		return "", "", "", fmt.Errorf("error: reading port is on %q and writing port on %q, both should be on the same host",
+			host, writingHost)
 	}
+
+	return host, readingPort, writingPort, nil
 }
 
-// Function to get two ports. One for reading and one for wrting.
+// Function to get two ports. One for reading and one for wrting. Ports can be given as host:port
+// when the broker runs on another host, then brokerHost is set.
 func getPorts(name string) (string, string) {
 	fmt.Println("Enter input: <" + name + " reading port> <" + name + " writing port>")
 	input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
 	inputs := strings.Split(strings.TrimSpace(input), " ")
+	if len(inputs) < 2 {
+		handleError(errors.New("error: please provide reading and writing ports"))
+	}
+
+	host, readingPort, writingPort, err := splitPorts(inputs[0], inputs[1])
 
-	return inputs[0], inputs[1]
+	handleError(err)
+
+	brokerHost = host
+
+	return readingPort, writingPort
 }
 
-// Function to handle how server message passing works when messaging mode is multi
-func handleMultiWayMessaging() {
+// Function to handle how server message passing works when messaging mode is multi.
+// In sync mode requests are handled one by one, in async mode several at the same time.
+func handleMultiWayMessaging(ctx context.Context) {
 	messagePassingMode := getMessagePassingMode()
 	readingPort, writingPort := getPorts("server")
 
 	switch messagePassingMode {
 	case "sync":
-		handleMessagePassingSynchronously(readingPort, writingPort)
+		c := createConsumer(ctx, readingPort, writingPort, 1)
+		run(ctx, c, respond(c))
 	case "async":
-		handleMessagePassingAsynchronously(readingPort, writingPort)
+		c := createConsumer(ctx, readingPort, writingPort, async_workers)
+		run(ctx, c, respond(c))
 	default:
 		log.Println("ERROR:", "mode does not exist")
 	}
 }
 
-// Function to get one port number that is for reading.
+// Function to get one port number that is for reading. It can be given as host:port like in getPorts.
 func getPort(name string) string {
 	fmt.Println("Enter input: <" + name + " reading port>")
 	input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
 	inputs := strings.Split(strings.TrimSpace(input), " ")
 
-	return inputs[0]
+	host, readingPort, _, err := splitPorts(inputs[0], "")
+
+	handleError(err)
+
+	brokerHost = host
+
+	return readingPort
 }
 
 // Function to handle how server message passing works when messaging mode is one
-func handleOneWayMessaging() {
+func handleOneWayMessaging(ctx context.Context) {
 	readingPort := getPort("server")
 
-	serverReadConn, _ := createTCPclient(readingPort)
-	for {
-		receivedMessage, _ := receiveMessage(serverReadConn)
-
-		write(receivedMessage)
-	}
-
+	run(ctx, createConsumer(ctx, readingPort, "", 1), process)
 }
 
-// Function to handle how server message passing works based on messaging mode that can be one or multi.
+// Function to handle how server message passing works based on messaging mode that can be one, multi or exec.
 // When messaging mode is one that means server only reads from broker.
 // when messaging mode is multi that means server reads and writes from and to broker.
-func handleMessagePassing(messagingMode string) {
+// When messaging mode is exec every message is handled by running a command.
+func handleMessagePassing(ctx context.Context, messagingMode string) {
 	switch messagingMode {
 	case "one":
-		handleOneWayMessaging()
+		handleOneWayMessaging(ctx)
 	case "multi":
-		handleMultiWayMessaging()
+		handleMultiWayMessaging(ctx)
+	case "exec":
+		arguments := os.Args
+		handleExecuting(ctx, arguments[2], arguments[3], arguments[4:])
 	default:
 		log.Println("ERROR:", "mode does not exist")
 	}
@@ -192,7 +253,7 @@ func getMessagePassingMode() string {
 	return arguments[2]
 }
 
-// Function to get messaging mode that can be one or multi.
+// Function to get messaging mode that can be one, multi or exec.
 func getMessagingMode() string {
 	arguments := os.Args
 
@@ -205,6 +266,26 @@ func getCommandLineArguments() string {
 	return getMessagingMode
 }
 
+// Function to load TLS configuration for connections to broker from environment variables.
+func loadTLSConfig() (*tls.Config, error) {
+	settings, err := security.TLSSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return settings.ClientConfig()
+}
+
+// Function to load identity from the certificate configured in environment variables.
+func loadIdentity() (string, error) {
+	settings, err := security.TLSSettingsFromEnv()
+	if err != nil {
+		return "", err
+	}
+
+	return settings.Identity()
+}
+
 // Function to handle error.
 // If there is an error it will be logged.
 func handleError(err error) {
@@ -218,6 +299,13 @@ func handleError(err error) {
 func checkCommandLineArguments() error {
 	arguments := os.Args
 
+	if len(arguments) > 1 && arguments[1] == "exec" {
+		if len(arguments) < 5 {
+			return errors.New(`error: too few arguments. please provide exec <ReadingPort> <WritingPort|-> [options] <command>`)
+		}
+		return nil
+	}
+
 	if len(arguments) < 3 {
 		return errors.New(`error: too few arguments. please provide <MessagingMode> <MessagePassingMode>`)
 	} else if len(arguments) > 3 {
@@ -235,5 +323,20 @@ func main() {
 
 	messagingMode := getCommandLineArguments()
 
-	handleMessagePassing(messagingMode)
+	tlsConfig, err = loadTLSConfig()
+
+	handleError(err)
+
+	identity, err := loadIdentity()
+
+	handleError(err)
+
+	if identity != "" {
+		serverID = identity
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	handleMessagePassing(ctx, messagingMode)
 }
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+// Function to check that the host of the broker is taken from ports given as host:port.
+func TestSplitPorts(t *testing.T) {
+	tests := []struct {
+		name                           string
+		reading, writing               string
+		host, readingPort, writingPort string
+		err                            bool
+	}{
+		{"ports", "8001", "8002", "", "8001", "8002", false},
+		{"host name", "broker.example:8001", "broker.example:8002", "broker.example", "8001", "8002", false},
+		{"IPv6 address", "[::1]:8001", "[::1]:8002", "::1", "8001", "8002", false},
+		{"only reading", "broker.example:8001", "", "broker.example", "8001", "", false},
+		{"hosts differ", "broker.example:8001", "8002", "", "", "", true},
+		{"invalid address", "::1:8001", "8002", "", "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host, readingPort, writingPort, err := splitPorts(test.reading, test.writing)
+
+			if (err != nil) != test.err {
+				t.Fatalf("error is %v", err)
+			}
+			if host != test.host || readingPort != test.readingPort || writingPort != test.writingPort {
+				t.Errorf("split into %q, %q and %q, expected %q, %q and %q",
+					host, readingPort, writingPort, test.host, test.readingPort, test.writingPort)
+			}
+		})
+	}
+}